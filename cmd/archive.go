@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/figadore/darktable-auto-export/internal/archive"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// archiveCmd represents the archive command
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Find raws and xmps that clean moved to an archive",
+}
+
+var archiveSearchCmd = &cobra.Command{
+	Use:   "search [pattern...]",
+	Short: "List archived files matching the patterns",
+	Long: `List archived files matching the patterns
+
+Files are listed from the manifest in the archive directory. Patterns are globs matching the
+original path relative to the input directory, a file name or a parent directory, e.g. '2024/trip'
+or '_DSC12*'. Without patterns, every archived file is listed`,
+	RunE: archiveSearch,
+}
+
+func archiveSearch(cmd *cobra.Command, args []string) error {
+	root := viper.GetString("archive-to")
+	if root == "" {
+		return fmt.Errorf("Set the archive directory with --archive-to")
+	}
+	a, err := archive.Open(root, "")
+	if err != nil {
+		return err
+	}
+	entries, err := a.Search(args)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, e := range entries {
+		fmt.Printf("%10s  %s\n", formatSize(e.Size), e)
+		fmt.Println("           ", filepath.Join(root, filepath.FromSlash(e.Path)))
+		size += e.Size
+	}
+	fmt.Printf("%d archived files, %s\n", len(entries), formatSize(size))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+	archiveCmd.AddCommand(archiveSearchCmd)
+	archiveCmd.PersistentFlags().String("archive-to", "", "Archive directory that clean moved files to")
+	archiveCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	}
+}
@@ -1,14 +1,23 @@
 package cmd
 
 import (
-	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"log"
 
+	"github.com/figadore/darktable-auto-export/internal/archive"
+	"github.com/figadore/darktable-auto-export/internal/cleanup"
+	"github.com/figadore/darktable-auto-export/internal/datefilter"
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/library"
 	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/scancache"
+	"github.com/figadore/darktable-auto-export/internal/staging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -24,134 +33,247 @@ Only run this when all raws have been exported, as any jpgs missing in the outpu
 }
 
 func clean(cmd *cobra.Command, args []string) {
-	inDir := viper.GetString("in")
-	outDir := viper.GetString("out")
-	extensions := viper.GetStringSlice("extension")
-	raws, xmps, _ := linkedimage.FindImages(inDir, outDir, extensions)
-
-	// Trace
-	// Print all raws
-	//for _, raw := range raws {
-	//    fmt.Println(raw)
-	//    //fmt.Println("xmps")
-	//    //for _, xmp := range raw.Xmps {
-	//    //	fmt.Println("xmp:", xmp)
-	//    //	fmt.Println("jpg:", xmp.Jpg)
-	//    //}
-	//    //fmt.Println("jpgs")
-	//    //for _, jpg := range raw.Jpgs {
-	//    //	fmt.Println("jpg:", jpg)
-	//    //	fmt.Println("xmp:", jpg.Xmp)
-	//    //}
-	//}
-
-	rawsToDelete := make(map[string]*linkedimage.Raw)
-	xmpsToDelete := make(map[string]*linkedimage.Xmp)
-	// for each jpg without a matching raw or xmp, aggregate the raw and/or xmp (making sure to get the xmps if deleting the raw)
-	for _, raw := range raws {
-		if len(raw.Jpgs) == 0 {
-			rawsToDelete[raw.GetPath()] = raw
-			// Clean up any orphan xmps
-			for _, xmp := range raw.Xmps {
-				xmpsToDelete[xmp.GetPath()] = xmp
-			}
-		}
+	if err := runClean(); err != nil {
+		log.Fatalf("Error cleaning: %v", err)
 	}
-	for i := range xmps {
-		xmp := xmps[i]
-		if xmp.Jpg == nil {
-			xmpsToDelete[xmp.GetPath()] = xmp
-		}
+}
+
+// prompter asks before each step on the terminal, unless --yes answers yes to all of them
+func prompter() cleanup.Prompter {
+	if viper.GetBool("yes") {
+		return cleanup.Always(true)
 	}
+	return terminal
+}
+
+// terminal is shared by every prompt, so answers piped in ahead aren't lost
+var terminal = cleanup.NewTerminal(os.Stdin, os.Stderr)
+
+// YesNoPrompt asks yes/no questions using the label.
+func YesNoPrompt(label string, defaultChoice bool) bool {
+	return terminal.Confirm(label, defaultChoice)
+}
 
-	// list all raw and xmp files to delete. prompt for confirmation
-	for k := range rawsToDelete {
-		fmt.Println("Delete raw", k)
+func runClean() error {
+	if viper.GetBool("stage-only") && viper.GetBool("delete-staged") {
+		return fmt.Errorf("Set either --stage-only or --delete-staged, not both")
 	}
-	for k := range xmpsToDelete {
-		fmt.Println("Delete xmp", k)
+	archiveTo, err := archiveRoot()
+	if err != nil {
+		return err
+	}
+	if archiveTo != "" && (viper.GetBool("stage-only") || viper.GetBool("delete-staged")) {
+		return fmt.Errorf("--archive-to moves files instead of staging them, it can't be combined with --stage-only or --delete-staged")
+	}
+	// Staged files are logged in the manifest, so `restore` can put them back
+	manifest, err := staging.Load(viper.GetString("in"))
+	if err != nil {
+		return fmt.Errorf("Unable to read the staging manifest: %w", err)
+	}
+	if viper.GetBool("delete-staged") {
+		return cleanup.DeleteStaged(manifest, prompter(), viper.GetInt("max-deletions"), viper.GetBool("dry-run"))
 	}
-	if len(xmpsToDelete) > 0 || len(rawsToDelete) > 0 {
-
-		doStage := YesNoPrompt("Stage files listed above for deletion?", false)
 
-		if doStage {
-			fmt.Println("Staging raws")
-			for k := range rawsToDelete {
-				raw := rawsToDelete[k]
-				fmt.Println("Staging", raw)
-				err := raw.StageForDeletion(viper.GetBool("dry-run"))
-				if err != nil {
-					log.Fatalf("Error staging %s for deletion: %v", raw.GetPath(), err)
-				}
-			}
-			fmt.Println("Staging xmps")
-			for k := range xmpsToDelete {
-				xmp := xmpsToDelete[k]
-				fmt.Println("Staging", xmp)
-				err := xmp.StageForDeletion(viper.GetBool("dry-run"))
-				fmt.Println("xmp after staging", xmp, ":", xmp.GetPath())
-				if err != nil {
-					log.Fatalf("Error staging %s for deletion: %v", xmp.GetPath(), err)
-				}
-			}
+	opts, err := scanOptions()
+	if err != nil {
+		return err
+	}
+	raws, xmps, _, err := findImages(opts)
+	if err != nil {
+		return err
+	}
+	protection, err := cleanup.NewProtection(viper.GetInt("protect-rating"), viper.GetStringSlice("protect-tag"), viper.GetStringSlice("protect-label"))
+	if err != nil {
+		return err
+	}
+	plan, err := applyGrace(cleanup.NewPlan(raws, xmps).Protect(protection))
+	if err != nil {
+		return err
+	}
+	// Only raws past the grace period are hashed
+	plan = plan.RequireBackup(viper.GetStringSlice("backup-root"))
+	plan.Print(os.Stdout)
+	if path := viper.GetString("plan-file"); path != "" {
+		if err := writePlan(plan, path); err != nil {
+			return err
 		}
-
-		// if "move" selected at prompt, stage files for deletion in a folder. keep a log so it can be undone
-
-		// if "yes" selected, or confirm after move, delete all enumerated raw and xmp files
-		doDelete := YesNoPrompt("Delete the source files listed above?", false)
-		if doDelete {
-			fmt.Println("Deleting raws")
-			for k := range rawsToDelete {
-				raw := rawsToDelete[k]
-				fmt.Println("Deleting", raw)
-				err := raw.Delete(viper.GetBool("dry-run"))
-				if err != nil {
-					log.Fatalf("Error deleting %s: %v", raw.GetPath(), err)
-				}
-			}
-			fmt.Println("Deleting xmps")
-			for k := range xmpsToDelete {
-				xmp := xmpsToDelete[k]
-				fmt.Println("Deleting", xmp)
-				err := xmp.Delete(viper.GetBool("dry-run"))
-				if err != nil {
-					log.Fatalf("Error deleting %s: %v", xmp.GetPath(), err)
-				}
+	}
+	if err := plan.CheckLimit(viper.GetInt("max-deletions")); err != nil {
+		return err
+	}
+	if viper.GetBool("remove-from-library") {
+		// Check before removing anything, rather than leave the library out of date
+		if _, err := libraryClosed(); err != nil {
+			return err
+		}
+	}
+	cleanOpts := cleanup.Options{
+		StageOnly: viper.GetBool("stage-only"),
+		DryRun:    viper.GetBool("dry-run"),
+	}
+	if archiveTo != "" {
+		a, err := archive.Open(archiveTo, viper.GetString("in"))
+		if err != nil {
+			return fmt.Errorf("Unable to read the archive manifest: %w", err)
+		}
+		a.Verify = viper.GetBool("verify-archive")
+		cleanOpts.Archive = a
+	}
+	err = cleanup.Run(plan, manifest, prompter(), cleanOpts)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool("remove-from-library") {
+		removed := plan.Removed(manifest)
+		if viper.GetBool("dry-run") && !viper.GetBool("stage-only") {
+			removed = nil
+			for _, item := range plan.Items {
+				removed = append(removed, item.Path)
 			}
 		}
-		fmt.Println("doDelete:", doDelete)
-	} else {
-		fmt.Println("No candidate source files to delete")
+		if err := removeFromLibrary(removed); err != nil {
+			return fmt.Errorf("Error removing images from the darktable library: %w", err)
+		}
+	}
+
+	// Files staged by earlier runs are deleted for good once the retention period is over
+	retention, err := trashRetention()
+	if err != nil {
+		return err
 	}
+	if retention > 0 {
+		return purgeTrash(func(m *staging.Manifest) []staging.Entry {
+			return m.Expired(retention, time.Now())
+		})
+	}
+	return nil
 }
 
-// YesNoPrompt asks yes/no questions using the label.
-func YesNoPrompt(label string, defaultChoice bool) bool {
-	choices := "Y/n"
-	if !defaultChoice {
-		choices = "y/N"
+// archiveRoot gets the directory clean moves files to, or "" if they are deleted
+// Archived raws inside the input directory would be scanned again, and cleaned up again
+func archiveRoot() (string, error) {
+	root := viper.GetString("archive-to")
+	if root == "" {
+		return "", nil
 	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absIn, err := filepath.Abs(viper.GetString("in"))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absIn, absRoot)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive-to '%s' must be a directory outside the input directory", root)
+	}
+	return root, nil
+}
 
-	r := bufio.NewReader(os.Stdin)
-	var s string
+// libraryClosed gets the library.db to remove images from, checking that darktable isn't
+// using it through its lock files
+func libraryClosed() (string, error) {
+	path, err := libraryPath()
+	if err != nil {
+		return "", err
+	}
+	lockDir := viper.GetString("lockdir")
+	if lockDir == "" {
+		lockDir = filepath.Dir(path)
+	}
+	locks, err := library.Locked(lockDir)
+	if err != nil {
+		return "", err
+	}
+	if len(locks) > 0 {
+		return "", fmt.Errorf("darktable is running, or didn't exit cleanly, found %v. Close darktable, or run unlock if it isn't running", locks)
+	}
+	return path, nil
+}
 
-	for {
-		fmt.Fprintf(os.Stderr, "%s (%s) ", label, choices)
-		s, _ = r.ReadString('\n')
-		s = strings.TrimSpace(s)
-		if s == "" {
-			return defaultChoice
-		}
-		s = strings.ToLower(s)
-		if s == "y" || s == "yes" {
-			return true
+// removeFromLibrary removes the images of deleted or archived raws and xmps from
+// library.db, once darktable is closed, after backing it up
+func removeFromLibrary(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	// darktable may have been opened while files were being removed
+	path, err := libraryClosed()
+	if err != nil {
+		return err
+	}
+	var absPaths []string
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
 		}
-		if s == "n" || s == "no" {
-			return false
+		absPaths = append(absPaths, abs)
+	}
+	dryRun := viper.GetBool("dry-run")
+	open := library.OpenReadWrite
+	if dryRun {
+		open = library.Open
+	}
+	lib, err := open(path)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	if !dryRun {
+		backup, err := lib.Backup(time.Now())
+		if err != nil {
+			return fmt.Errorf("Unable to back up %s: %w", path, err)
 		}
+		fmt.Println("Backed up", path, "to", backup)
+	}
+	removed, err := lib.RemoveImages(absPaths, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, image := range removed {
+		fmt.Println("Remove from library", image.XmpPath())
+	}
+	if !dryRun {
+		fmt.Printf("Removed %d images from %s\n", len(removed), path)
+	}
+	return nil
+}
+
+// applyGrace holds back raws and xmps whose jpg went missing within the grace period,
+// recording when the others were first seen without a jpg
+func applyGrace(plan cleanup.Plan) (cleanup.Plan, error) {
+	grace, err := datefilter.ParseDuration(viper.GetString("grace-period"))
+	if err != nil {
+		return plan, fmt.Errorf("Invalid grace-period: %w", err)
+	}
+	// Without a grace period, files are removed right away and nothing is recorded
+	if grace == 0 {
+		return plan, nil
+	}
+	missing, err := cleanup.LoadMissing(viper.GetString("in"))
+	if err != nil {
+		return plan, err
+	}
+	plan = plan.ApplyGrace(missing, grace, time.Now())
+	if viper.GetBool("dry-run") {
+		return plan, nil
+	}
+	return plan, missing.Save()
+}
+
+// writePlan saves the plan as json for scripts
+func writePlan(plan cleanup.Plan, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := plan.WriteJSON(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
 
 func init() {
@@ -159,6 +281,33 @@ func init() {
 	cleanCmd.Flags().StringP("in", "i", "./", "Directory or file of raw image(s)")
 	cleanCmd.Flags().StringP("out", "o", "./", "Directory where jpgs exist")
 	cleanCmd.Flags().StringSliceP("extension", "e", []string{".ARW"}, "Extension of raw files")
+	cleanCmd.Flags().String("source", sourceFilesystem, "Where to find raws and xmps: 'filesystem' walks the input directory, 'library' reads darktable's library.db")
+	cleanCmd.Flags().String("library", "", "Path to darktable's library.db for the library source (default <configdir>/library.db)")
+	cleanCmd.Flags().StringSlice("include", []string{}, "Only scan directories matching these gitignore style patterns, e.g. /2024/ or '*Weekend*'. Applies to both the input and output directories")
+	cleanCmd.Flags().StringSlice("exclude", ignore.DefaultExcludes, "Skip paths matching these gitignore style patterns, in both the input and output directories. A .daeignore file in any directory adds patterns relative to that directory")
+	cleanCmd.Flags().StringSlice("film-roll", []string{}, "Only process these film rolls (directories), keeping output paths as in a full run. One of name:<glob>, path:<prefix relative to in> or date:<YYYY-MM-DD>..<YYYY-MM-DD>, where the date is read from the start of the directory name. May be repeated")
+	cleanCmd.Flags().Int("parallelism", linkedimage.DefaultParallelism, "Number of directories to read at once while scanning")
+	cleanCmd.Flags().String("cache-dir", scancache.DefaultDir(), "Where directory listings are cached between runs, keyed by each directory's modification time. Empty to disable the cache")
+	cleanCmd.Flags().Bool("rescan", false, "Read every directory instead of using cached listings, refreshing the cache")
+	cleanCmd.Flags().String("naming", string(linkedimage.NamingExtension), "How exports of raws sharing a basename in a directory are named, as for sync: 'extension', 'model' or 'fail'")
+	cleanCmd.Flags().String("sidecars", string(linkedimage.SidecarsDarktable), "Which xmp sidecar sync used where a raw has both, as for sync: 'darktable' or 'adobe'. The other one is kept, unless the raw is deleted")
+	cleanCmd.Flags().String("layout", outputs.LayoutMirror, "How sync organised the jpgs in the output directory, 'mirror' or 'date'")
+	cleanCmd.Flags().String("output-template", "", "Template the jpgs were named with by sync, e.g. $(FILE_FOLDER)/$(FILE_NAME)_$(VERSION). Empty if they mirror the input directory")
+	cleanCmd.Flags().String("trash-retention", "", "Purge files staged more than this long ago, e.g. 30d or 2w, at the end of each run. Empty to keep them until purged with the trash command")
+	cleanCmd.Flags().String("grace-period", "0", "Only remove raws and xmps whose jpg has been missing for this long, e.g. 7d or 48h, so a jpg deleted by mistake can be exported again. When each was first seen without a jpg is kept in "+cleanup.MissingFileName+" in the input directory. 0, the default, removes them right away")
+	cleanCmd.Flags().Int("protect-rating", 0, "Never remove images rated at least this in darktable, even without a jpg. 0 to disable")
+	cleanCmd.Flags().StringSlice("protect-tag", []string{}, "Never remove images with this tag, or a tag under it, e.g. keep or 'clients|Smith'. May be repeated")
+	cleanCmd.Flags().StringSlice("protect-label", []string{}, "Never remove images with this color label: red, yellow, green, blue or purple. May be repeated")
+	cleanCmd.Flags().StringSlice("backup-root", []string{}, "Only remove raws with a copy at the same relative path in one of these directories, with the same size and sha256. May be repeated")
+	cleanCmd.Flags().BoolP("yes", "y", false, "Answer yes to every prompt, for cron and scripts")
+	cleanCmd.Flags().Bool("stage-only", false, "Stage files for deletion without deleting them, so they can be checked and restored. Combine with --yes to run unattended")
+	cleanCmd.Flags().Bool("delete-staged", false, "Delete the files staged by earlier runs instead of scanning")
+	cleanCmd.Flags().String("archive-to", "", "Move raws and xmps to this directory outside the input directory, keeping their paths relative to it, instead of deleting them. Each move is recorded in "+archive.ManifestFileName+" there, see the archive command")
+	cleanCmd.Flags().Bool("verify-archive", true, "Compare the sha256 of files copied to the archive from another filesystem before removing the originals")
+	cleanCmd.Flags().Bool("remove-from-library", false, "Remove the images of deleted or archived raws and xmps, with their history and tags, from darktable's library.db, after backing it up next to it. darktable must be closed")
+	cleanCmd.Flags().String("lockdir", "", "Directory where darktable lock files are kept, checked before changing library.db (default the directory of library.db)")
+	cleanCmd.Flags().Int("max-deletions", 0, "Refuse to stage or delete anything if more than this many raws and xmps would be removed. 0 for no limit")
+	cleanCmd.Flags().String("plan-file", "", "Write the raws and xmps that would be removed, and why, as json to this file")
 	cleanCmd.Flags().Bool("dry-run", false, "Show actions that would be performed, but don't do them")
 
 	viper.SetConfigName("config")
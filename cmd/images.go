@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/filmroll"
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/library"
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+
+	"github.com/spf13/viper"
+)
+
+// Values for the source setting
+const (
+	sourceFilesystem = "filesystem"
+	sourceLibrary    = "library"
+)
+
+// findImages lists and links all images for the configured source mode,
+// restricted to the selected film rolls
+func findImages(opts linkedimage.Options) ([]*linkedimage.Raw, []*linkedimage.Xmp, []*linkedimage.Jpg, error) {
+	batches, err := streamImages(opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var raws []*linkedimage.Raw
+	var xmps []*linkedimage.Xmp
+	var jpgs []*linkedimage.Jpg
+	var collisions []linkedimage.Collision
+	var conflicts []linkedimage.Conflict
+	var duplicates []linkedimage.DuplicateSidecar
+	var ambiguous []linkedimage.AmbiguousSidecar
+	var scanErrs []error
+	for batch := range batches {
+		if batch.Err != nil {
+			scanErrs = append(scanErrs, batch.Err)
+			continue
+		}
+		collisions = append(collisions, batch.Collisions...)
+		conflicts = append(conflicts, batch.Conflicts...)
+		duplicates = append(duplicates, batch.DuplicateSidecars...)
+		ambiguous = append(ambiguous, batch.AmbiguousSidecars...)
+		raws = append(raws, batch.Raws...)
+		xmps = append(xmps, batch.Xmps...)
+		jpgs = append(jpgs, batch.Jpgs...)
+	}
+	if err := errors.Join(scanErrs...); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := reportCollisions(collisions); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := linkedimage.CheckConflicts(conflicts); err != nil {
+		return nil, nil, nil, err
+	}
+	reportDuplicateSidecars(duplicates)
+	reportAmbiguousSidecars(ambiguous)
+	return raws, xmps, jpgs, nil
+}
+
+// namingSetting gets how exports of raws sharing a basename are named
+func namingSetting() (linkedimage.Naming, error) {
+	return linkedimage.ParseNaming(viper.GetString("naming"))
+}
+
+// reportCollisions lists raws sharing a basename, failing if the naming setting is fail
+func reportCollisions(collisions []linkedimage.Collision) error {
+	naming, err := namingSetting()
+	if err != nil {
+		return err
+	}
+	if err := linkedimage.CheckCollisions(collisions, naming); err != nil {
+		return err
+	}
+	for _, c := range collisions {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+// reportDuplicateSidecars warns about raws with both an Adobe and a darktable style xmp
+func reportDuplicateSidecars(duplicates []linkedimage.DuplicateSidecar) {
+	for _, d := range duplicates {
+		fmt.Println("Warning:", d)
+	}
+}
+
+// reportAmbiguousSidecars warns about xmps that may belong to several raws sharing a basename
+func reportAmbiguousSidecars(ambiguous []linkedimage.AmbiguousSidecar) {
+	for _, a := range ambiguous {
+		fmt.Println("Warning:", a)
+	}
+}
+
+// streamImages sends the linked images of each directory as it is scanned, for the
+// configured source mode and restricted to the selected film rolls
+// The library source is read up front and sent as a single batch
+func streamImages(opts linkedimage.Options) (<-chan linkedimage.Batch, error) {
+	inDir := viper.GetString("in")
+	outDir := viper.GetString("out")
+	extensions := viper.GetStringSlice("extension")
+	selection, err := filmroll.ParseSelection(viper.GetStringSlice("film-roll"))
+	if err != nil {
+		return nil, err
+	}
+	var batches <-chan linkedimage.Batch
+	switch source := viper.GetString("source"); source {
+	case sourceFilesystem, "":
+		batches = linkedimage.StreamImages(inDir, outDir, extensions, opts)
+	case sourceLibrary:
+		batch, err := findLibraryImages(inDir, outDir, extensions, opts)
+		if err != nil {
+			return nil, err
+		}
+		single := make(chan linkedimage.Batch, 1)
+		single <- batch
+		close(single)
+		batches = single
+	default:
+		return nil, fmt.Errorf("Unknown source '%s', expected '%s' or '%s'", source, sourceFilesystem, sourceLibrary)
+	}
+	if len(selection) == 0 {
+		return batches, nil
+	}
+	fmt.Printf("Selecting images in film rolls %v\n", selection)
+	selected := make(chan linkedimage.Batch)
+	go func() {
+		defer close(selected)
+		for batch := range batches {
+			batch.Raws, batch.Xmps, batch.Jpgs = selectFilmRolls(selection, batch.Raws, batch.Xmps, batch.Jpgs)
+			selected <- batch
+		}
+	}()
+	return selected, nil
+}
+
+// scanOptions builds the scan settings from the include and exclude patterns
+// With an output template, the map of export sources is loaded from the output directory
+func scanOptions() (linkedimage.Options, error) {
+	// Files staged by clean are only skipped in the input tree
+	inputExcludes := append(append([]string{}, ignore.InputExcludes...), viper.GetStringSlice("exclude")...)
+	matcher, err := ignore.New(viper.GetStringSlice("include"), inputExcludes)
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	naming, err := namingSetting()
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	sidecars, err := linkedimage.ParseSidecars(viper.GetString("sidecars"))
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	opts := linkedimage.Options{
+		Ignore:      matcher,
+		Naming:      naming,
+		Sidecars:    sidecars,
+		Parallelism: viper.GetInt("parallelism"),
+		CacheDir:    viper.GetString("cache-dir"),
+		Rescan:      viper.GetBool("rescan"),
+	}
+	opts.Template, err = outputTemplate()
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	albumDir, err := albumsDir()
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	includes := viper.GetStringSlice("include")
+	// The output tree doesn't mirror the input tree, so include patterns only apply to the input
+	if opts.Template != nil {
+		includes = nil
+	}
+	excludes := append([]string{}, viper.GetStringSlice("exclude")...)
+	// Album entries are links to exports, not exports themselves
+	if albumDir != "" {
+		excludes = append(excludes, "/"+filepath.ToSlash(albumDir)+"/")
+	}
+	opts.ExportIgnore, err = ignore.New(includes, excludes)
+	if err != nil {
+		return linkedimage.Options{}, err
+	}
+	// Moves are detected from the hashes recorded for each export
+	opts.DetectMoves = viper.GetBool("detect-moves")
+	if opts.Template != nil || opts.DetectMoves {
+		opts.Outputs, err = outputs.LoadMap(viper.GetString("out"))
+		if err != nil {
+			return linkedimage.Options{}, fmt.Errorf("Unable to read %s: %w", outputs.MapFileName, err)
+		}
+	}
+	return opts, nil
+}
+
+// albumsDir gets the directory in out that albums are kept in, or "" if albums are disabled
+func albumsDir() (string, error) {
+	if viper.GetString("album-tag") == "" {
+		return "", nil
+	}
+	dir := filepath.Clean(viper.GetString("album-dir"))
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("album-dir '%s' must be a directory inside the output directory", viper.GetString("album-dir"))
+	}
+	return dir, nil
+}
+
+// outputTemplate gets the template jpgs are named with, from the output template or
+// layout setting, nil if they mirror the input directory
+func outputTemplate() (*outputs.Template, error) {
+	source := viper.GetString("output-template")
+	layout := viper.GetString("layout")
+	if source == "" {
+		return outputs.ParseLayout(layout)
+	}
+	if layout != "" && layout != outputs.LayoutMirror {
+		return nil, fmt.Errorf("Set either output-template or layout, not both")
+	}
+	return outputs.ParseTemplate(source)
+}
+
+// selectFilmRolls drops images outside the selected film rolls
+// Images are linked before they are selected, so they keep the same relative paths
+// as in a full run
+func selectFilmRolls(selection filmroll.Selection, raws []*linkedimage.Raw, xmps []*linkedimage.Xmp, jpgs []*linkedimage.Jpg) ([]*linkedimage.Raw, []*linkedimage.Xmp, []*linkedimage.Jpg) {
+	var selectedRaws []*linkedimage.Raw
+	for _, raw := range raws {
+		if selection.Matches(raw.Path.GetRelativeDir()) {
+			selectedRaws = append(selectedRaws, raw)
+		}
+	}
+	var selectedXmps []*linkedimage.Xmp
+	for _, xmp := range xmps {
+		if selection.Matches(xmp.Path.GetRelativeDir()) {
+			selectedXmps = append(selectedXmps, xmp)
+		}
+	}
+	var selectedJpgs []*linkedimage.Jpg
+	for _, jpg := range jpgs {
+		// Prefer the source's film roll, in case the output tree doesn't mirror the source tree
+		relativeDir := jpg.Path.GetRelativeDir()
+		if jpg.Raw != nil {
+			relativeDir = jpg.Raw.Path.GetRelativeDir()
+		}
+		if selection.Matches(relativeDir) {
+			selectedJpgs = append(selectedJpgs, jpg)
+		}
+	}
+	return selectedRaws, selectedXmps, selectedJpgs
+}
+
+// libraryPath gets the configured library.db, defaulting to the one in darktable's config dir
+func libraryPath() (string, error) {
+	if path := viper.GetString("library"); path != "" {
+		return path, nil
+	}
+	if dir := viper.GetString("configdir"); dir != "" {
+		return filepath.Join(dir, "library.db"), nil
+	}
+	return "", errors.New("Set library or configdir to read images from the darktable library")
+}
+
+// findLibraryImages lists raws and xmps known to darktable instead of walking the source dir
+// Only images under inDir with one of the given extensions, and not skipped by the
+// include and exclude patterns, are included. Xmps get the time darktable last changed them
+func findLibraryImages(inDir, outDir string, extensions []string, opts linkedimage.Options) (linkedimage.Batch, error) {
+	path, err := libraryPath()
+	if err != nil {
+		return linkedimage.Batch{}, err
+	}
+	lib, err := library.Open(path)
+	if err != nil {
+		return linkedimage.Batch{}, err
+	}
+	defer lib.Close()
+	images, err := lib.Images()
+	if err != nil {
+		return linkedimage.Batch{}, err
+	}
+	absIn, err := filepath.Abs(inDir)
+	if err != nil {
+		return linkedimage.Batch{}, err
+	}
+
+	var rawPaths, xmpPaths []string
+	seenRaws := make(map[string]bool)
+	missingRaws := make(map[string]bool)
+	hasSidecar := make(map[string]bool)
+	type version struct {
+		rawPath, xmpPath string
+		number           int
+	}
+	var noSidecar []version
+	changed := make(map[string]time.Time)
+	for _, image := range images {
+		if !hasExtension(extensions, filepath.Ext(image.Filename)) {
+			continue
+		}
+		// Film roll folders are absolute, keep paths relative to inDir like the filesystem source
+		rel, err := filepath.Rel(absIn, image.RawPath())
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if opts.Ignore.SkipPath(rel) {
+			continue
+		}
+		rawPath := filepath.Join(inDir, rel)
+		if missingRaws[rawPath] {
+			continue
+		}
+		if !seenRaws[rawPath] {
+			if _, err := os.Stat(rawPath); err != nil {
+				missingRaws[rawPath] = true
+				continue
+			}
+			seenRaws[rawPath] = true
+			rawPaths = append(rawPaths, rawPath)
+		}
+		xmpPath := filepath.Join(filepath.Dir(rawPath), filepath.Base(image.XmpPath()))
+		if _, err := os.Stat(xmpPath); err == nil {
+			xmpPaths = append(xmpPaths, xmpPath)
+			hasSidecar[rawPath] = true
+			changed[xmpPath] = image.Changed
+		} else {
+			noSidecar = append(noSidecar, version{rawPath, xmpPath, image.Version})
+		}
+	}
+	fmt.Printf("Found %d raws in darktable library %s\n", len(rawPaths), path)
+	if len(missingRaws) > 0 {
+		fmt.Printf("Skipping %d raws listed in the library but missing on disk\n", len(missingRaws))
+	}
+	// darktable-cli only reads edits from sidecars, so versions without one can't be exported
+	// as edited. A raw without any sidecar is still exported from the raw alone
+	var skipped, unedited int
+	for _, v := range noSidecar {
+		if v.number == 0 && !hasSidecar[v.rawPath] {
+			fmt.Println("Exporting", v.rawPath, "without edits, as it has no xmp sidecar", v.xmpPath)
+			unedited++
+			continue
+		}
+		fmt.Println("Skipping", v.xmpPath, "listed in the library, as the xmp sidecar is missing")
+		skipped++
+	}
+	if skipped > 0 || unedited > 0 {
+		fmt.Printf("Skipping %d versions and exporting %d raws without edits, as their xmp sidecars are missing. Enable writing sidecars in darktable, or run 'write sidecar files' on them\n", skipped, unedited)
+	}
+	jpgPaths, err := opts.ForExports().FindFilesWithExt(outDir, ".jpg")
+	if err != nil {
+		return linkedimage.Batch{}, err
+	}
+	batch := opts.NewBatch(inDir, outDir, rawPaths, xmpPaths, jpgPaths)
+	for _, xmp := range batch.Xmps {
+		xmp.Changed = changed[xmp.GetPath()]
+	}
+	return batch, nil
+}
+
+// hasExtension checks extensions for ext, ignoring case
+func hasExtension(extensions []string, ext string) bool {
+	for _, v := range extensions {
+		if strings.EqualFold(ext, v) {
+			return true
+		}
+	}
+	return false
+}
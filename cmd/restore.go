@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/figadore/darktable-auto-export/internal/staging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [pattern...]",
+	Short: "Put raws and xmps staged by clean back where they were",
+	Long: `Put raws and xmps staged by clean back where they were
+
+Files are restored from the staging manifest in the delete directory of the input directory.
+Patterns are globs matching the original path relative to the input directory, a file name
+or a parent directory, e.g. '2024/trip' or '_DSC12*'. Without patterns, every staged file is restored.
+Nothing is restored if a staged file changed since it was staged, or its original path is taken`,
+	RunE: restore,
+}
+
+func restore(cmd *cobra.Command, args []string) error {
+	manifest, err := staging.Load(viper.GetString("in"))
+	if err != nil {
+		return err
+	}
+	entries, err := manifest.Select(args)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No staged files to restore")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Println("Restoring", e)
+	}
+	err = manifest.Restore(entries, viper.GetBool("dry-run"))
+	// Files restored before an error are no longer staged
+	if saveErr := manifest.Save(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d files\n", len(entries))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringP("in", "i", "./", "Input directory that clean staged files from")
+	restoreCmd.Flags().Bool("dry-run", false, "Show files that would be restored, but don't move them")
+	restoreCmd.PreRun = func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(restoreCmd.Flags())
+	}
+}
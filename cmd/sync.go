@@ -3,11 +3,19 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/figadore/darktable-auto-export/internal/albums"
+	"github.com/figadore/darktable-auto-export/internal/cleanup"
 	"github.com/figadore/darktable-auto-export/internal/darktable"
+	"github.com/figadore/darktable-auto-export/internal/datefilter"
+	"github.com/figadore/darktable-auto-export/internal/ignore"
 	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/scancache"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -36,9 +44,34 @@ func init() {
 	// Local flags which will only run when this command is called directly
 	syncCmd.Flags().StringP("in", "i", "./", "Directory or file of raw image(s)")
 	syncCmd.Flags().StringP("out", "o", "./", "Directory to export jpgs to")
-	syncCmd.Flags().StringP("command", "c", "flatpak run --command=darktable-cli org.darktable.Darktable", "Darktable command or binary")
+	syncCmd.Flags().StringP("command", "c", "flatpak run --command=darktable-cli org.darktable.Darktable", `Darktable command or binary. Arguments are split like a shell would, and may use the placeholders {raw}, {xmp}, {out} and {configdir}. Without placeholders, the raw, xmp and jpg paths are appended. May also be a list of arguments in the config file`)
+	syncCmd.Flags().String("configdir", "", "Darktable config directory, substituted for {configdir} in the command")
 	syncCmd.Flags().StringSliceP("extension", "e", []string{".ARW"}, "Extension of raw files")
+	syncCmd.Flags().String("source", sourceFilesystem, "Where to find raws and xmps: 'filesystem' walks the input directory, 'library' reads darktable's library.db")
+	syncCmd.Flags().String("library", "", "Path to darktable's library.db for the library source (default <configdir>/library.db)")
+	syncCmd.Flags().StringSlice("include", []string{}, "Only scan directories matching these gitignore style patterns, e.g. /2024/ or '*Weekend*'. Applies to both the input and output directories")
+	syncCmd.Flags().StringSlice("exclude", ignore.DefaultExcludes, "Skip paths matching these gitignore style patterns, in both the input and output directories. A .daeignore file in any directory adds patterns relative to that directory")
+	syncCmd.Flags().StringSlice("film-roll", []string{}, "Only process these film rolls (directories), keeping output paths as in a full run. One of name:<glob>, path:<prefix relative to in> or date:<YYYY-MM-DD>..<YYYY-MM-DD>, where the date is read from the start of the directory name. May be repeated")
+	syncCmd.Flags().Int("parallelism", linkedimage.DefaultParallelism, "Number of directories to read at once while scanning")
+	syncCmd.Flags().String("cache-dir", scancache.DefaultDir(), "Where directory listings are cached between runs, keyed by each directory's modification time. Empty to disable the cache")
+	syncCmd.Flags().Bool("rescan", false, "Read every directory instead of using cached listings, refreshing the cache")
+	syncCmd.Flags().String("naming", string(linkedimage.NamingExtension), "How exports of raws sharing a basename in a directory, e.g. IMG_0001.CR3 and IMG_0001.ARW, are told apart: 'extension' exports IMG_0001.CR3.jpg, 'model' exports IMG_0001.<camera model>.jpg using tiff:Model from the xmp (falling back to the extension), 'fail' stops instead")
+	syncCmd.Flags().String("sidecars", string(linkedimage.SidecarsDarktable), "Which xmp sidecar to export where a raw has both, e.g. _DSC1234.ARW.xmp and _DSC1234.xmp: 'darktable' uses IMG.ARW.xmp, 'adobe' uses IMG.xmp as written by Lightroom. The other one is reported and ignored")
+	syncCmd.Flags().String("layout", outputs.LayoutMirror, "How jpgs are organised in the output directory: 'mirror' follows the input directory, 'date' places them in YYYY/YYYY-MM-DD directories by capture date, read from the xmp. Shorthand for an output template, see --output-template")
+	syncCmd.Flags().String("output-template", "", "Name jpgs from a darktable style template instead of mirroring the input directory, e.g. $(EXIF.DATE.YEAR)/$(FILE_NAME)_$(VERSION). Variables: $(FILE_FOLDER), $(FILE_NAME), $(FILE_EXTENSION), $(VERSION), $(EXIF.DATE.YEAR|MONTH|DAY|HOUR|MINUTE|SECOND), $(RATING), $(TITLE) and $(LABELS). The source of each jpg is recorded in "+outputs.MapFileName+" in the output directory, so renamed jpgs are still linked")
+	syncCmd.Flags().String("album-tag", "", "Tag prefix for albums, e.g. 'albums'. Images tagged albums|Family|2024 Trip in darktable are hardlinked into <album-dir>/Family/2024 Trip, and removed from it when the tag is removed. Empty to disable albums")
+	syncCmd.Flags().String("album-dir", "albums", "Directory in the output directory that albums are kept in. It is left out of scans for exports")
+	syncCmd.Flags().Bool("detect-moves", false, "Move the jpgs of raws that were moved in the input directory, instead of exporting them again and deleting the old ones. Raws are found by the size and hash recorded for each export in "+outputs.MapFileName+", so only images exported with this enabled are followed. Scans complete before anything is exported")
 	syncCmd.Flags().BoolP("new", "n", false, "Only export when target jpg does not exist")
+	syncCmd.Flags().String("since", "", "Only export images taken (or modified, see --date-field) on or after this date, YYYY-MM-DD or YYYY-MM-DD HH:MM")
+	syncCmd.Flags().String("until", "", "Only export images taken (or modified, see --date-field) on or before this date, YYYY-MM-DD or YYYY-MM-DD HH:MM")
+	syncCmd.Flags().String("modified-within", "", "Only export images whose xmp (or raw, without an xmp) was modified within this duration, e.g. 48h, 7d or 2w. With the library source, xmps use the time darktable last changed them")
+	syncCmd.Flags().String("date-field", string(datefilter.Capture), "Date compared against --since and --until: 'capture' reads exif:DateTimeOriginal from the xmp, 'modified' uses the xmp's modification time, or with the library source the time darktable last changed it. Without an xmp, the raw's modification time is used")
+	syncCmd.Flags().Bool("prune-rejected", false, "Skip images rejected in darktable, and delete their jpgs. The raws and xmps are kept")
+	syncCmd.Flags().Int("prune-rating", 0, "Skip images rated below this in darktable, including rejected ones, and delete their jpgs. The raws and xmps are kept. Images without an xmp or a rating are kept. 0 to disable")
+	syncCmd.Flags().Float64("max-delete-percent", 10, "With --delete-missing or pruning, refuse to delete more than this share of the jpgs in one run, as the input directory is more likely unmounted or mistyped. 0 for no limit")
+	syncCmd.Flags().Int("max-delete", 0, "With --delete-missing or pruning, refuse to delete more than this many jpgs in one run. 0 for no limit")
+	syncCmd.Flags().Bool("force-delete", false, "Delete jpgs with --delete-missing or pruning even over --max-delete-percent or --max-delete, or when no raws were found")
 	syncCmd.Flags().Bool("dry-run", false, "Show actions that would be performed, but don't do them")
 	syncCmd.Flags().BoolP("delete-missing", "d", false, `Delete jpgs where corresponding raw files are missing. This is useful for darktable workflows where editing and culling can be done at any time, not just up front. *warning* This will delete all jpgs in the output directory where a corresponding raw file with the specified extension cannot be found! Only use this for directories that are exclusively for this workflow, and where the source files stay where they are/were.
 `)
@@ -59,6 +92,10 @@ func init() {
 }
 
 func sync(cmd *cobra.Command, args []string) error {
+	command, err := darktable.ParseCommand(viper.Get("command"), viper.GetString("configdir"))
+	if err != nil {
+		return fmt.Errorf("Invalid command: %w", err)
+	}
 	// Check whether input arg is a directory or a xmp file
 	isDir, err := linkedimage.IsDir(viper.GetString("in"))
 	if err != nil {
@@ -66,50 +103,147 @@ func sync(cmd *cobra.Command, args []string) error {
 	}
 
 	if isDir {
-		return syncDir()
+		return syncDir(command)
 	} else {
-		return syncFile(viper.GetString("in"))
+		return syncFile(command, viper.GetString("in"))
 	}
 
 }
 
-func syncDir() error {
-	inDir := viper.GetString("in")
-	outDir := viper.GetString("out")
-	extensions := viper.GetStringSlice("extension")
-	raws, _, jpgs := linkedimage.FindImages(inDir, outDir, extensions)
-	for _, raw := range raws {
-		params := darktable.ExportParams{
-			Command: viper.GetString("command"),
-			RawPath: raw.GetPath(),
-			OnlyNew: viper.GetBool("new"),
-			DryRun:  viper.GetBool("dry-run"),
-		}
-		err := raw.Sync(params, viper.GetString("out"))
+func syncDir(command darktable.Command) error {
+	dateFilter, err := datefilter.New(viper.GetString("since"), viper.GetString("until"), viper.GetString("modified-within"), viper.GetString("date-field"), time.Now())
+	if err != nil {
+		return err
+	}
+	culling, err := cleanup.NewCulling(viper.GetBool("prune-rejected"), viper.GetInt("prune-rating"))
+	if err != nil {
+		return err
+	}
+	opts, err := scanOptions()
+	if err != nil {
+		return err
+	}
+	batches, err := streamImages(opts)
+	if err != nil {
+		return err
+	}
+	var moved map[string]bool
+	if opts.DetectMoves {
+		batches, moved, err = moveExports(batches, opts)
 		if err != nil {
 			return err
 		}
 	}
-	// Delete jpgs with missing raws and xmps
-	if viper.GetBool("delete-missing") {
-		fmt.Println("Deleting jpgs for missing raws")
+	// Raws are synced as their directory is scanned, jpgs are only checked once the scan is complete
+	var raws []*linkedimage.Raw
+	var jpgs []*linkedimage.Jpg
+	var scanErrs []error
+	for batch := range batches {
+		if batch.Err != nil {
+			scanErrs = append(scanErrs, batch.Err)
+			continue
+		}
+		if err := reportCollisions(batch.Collisions); err != nil {
+			return err
+		}
+		if err := linkedimage.CheckConflicts(batch.Conflicts); err != nil {
+			return err
+		}
+		reportDuplicateSidecars(batch.DuplicateSidecars)
+		reportAmbiguousSidecars(batch.AmbiguousSidecars)
+		for _, raw := range batch.Raws {
+			params := darktable.ExportParams{
+				Command: command,
+				RawPath: raw.GetPath(),
+				OnlyNew: viper.GetBool("new"),
+				DryRun:  viper.GetBool("dry-run"),
+			}
+			err := syncRaw(raw, params, viper.GetString("out"), dateFilter, moved, culling)
+			if err != nil {
+				return err
+			}
+		}
+		raws = append(raws, batch.Raws...)
+		jpgs = append(jpgs, batch.Jpgs...)
+	}
+	// Raws in the unscanned directories would look missing, so nothing is deleted
+	if err := errors.Join(scanErrs...); err != nil {
+		return err
+	}
+	// Delete jpgs with missing raws and xmps, and those of culled images
+	var deleteErr error
+	if viper.GetBool("delete-missing") || !culling.IsZero() {
 		// Use a map to avoid duplicates
 		jpgsToDelete := make(map[string]*linkedimage.Jpg)
-		for _, jpg := range jpgs {
-			if jpg.Raw == nil {
-				jpgsToDelete[jpg.GetPath()] = jpg
+		if !culling.IsZero() {
+			fmt.Println("Deleting jpgs of rejected or low rated images")
+			for _, jpg := range jpgs {
+				if jpg.Xmp == nil {
+					continue
+				}
+				why, err := culling.Culled(jpg.Xmp)
+				if err != nil {
+					fmt.Printf("Keeping %s, unable to read the rating: %v\n", jpg.GetPath(), err)
+					continue
+				}
+				if why != "" {
+					fmt.Printf("Pruning %s (%s)\n", jpg.GetPath(), why)
+					jpgsToDelete[jpg.GetPath()] = jpg
+				}
 			}
-			if jpg.Xmp == nil && jpg.IsVirtualCopy() {
-				jpgsToDelete[jpg.GetPath()] = jpg
+		}
+		if viper.GetBool("delete-missing") {
+			fmt.Println("Deleting jpgs for missing raws")
+			for _, jpg := range jpgs {
+				if jpg.Raw == nil && len(jpg.AmbiguousRaws) > 0 && !replaced(jpg, viper.GetString("out")) {
+					fmt.Println("Keeping", jpg.GetPath(), "until each raw sharing its basename has been exported with a suffix")
+					continue
+				}
+				if jpg.Raw == nil {
+					jpgsToDelete[jpg.GetPath()] = jpg
+				}
+				if jpg.Outdated && replacedOutput(jpg, viper.GetString("out")) {
+					jpgsToDelete[jpg.GetPath()] = jpg
+				}
+				if jpg.Xmp == nil && jpg.IsVirtualCopy() {
+					jpgsToDelete[jpg.GetPath()] = jpg
+				}
 			}
 		}
-		fmt.Printf("Deleting %v of %v jpgs\n", len(jpgsToDelete), len(jpgs))
-		for _, v := range jpgsToDelete {
-			v.Delete(viper.GetBool("dry-run"))
+		var paths []string
+		for path := range jpgsToDelete {
+			paths = append(paths, path)
+		}
+		limit := cleanup.DeletionLimit{MaxPercent: viper.GetFloat64("max-delete-percent"), MaxCount: viper.GetInt("max-delete")}
+		if err := limit.Check(paths, len(jpgs), len(raws)); err != nil && !viper.GetBool("force-delete") {
+			// Albums and the outputs map are still updated, the error is returned once done
+			fmt.Println(err)
+			deleteErr = errors.New("Jpgs were not deleted, check the input directory or rerun with --force-delete")
+		} else {
+			fmt.Printf("Deleting %v of %v jpgs\n", len(jpgsToDelete), len(jpgs))
+			// Keep going, so one unremovable jpg doesn't hold back the others
+			var failed []error
+			for _, v := range jpgsToDelete {
+				if err := v.Delete(viper.GetBool("dry-run")); err != nil {
+					failed = append(failed, err)
+				}
+			}
+			if len(failed) > 0 {
+				deleteErr = fmt.Errorf("Unable to delete %d of %d jpgs: %w", len(failed), len(jpgsToDelete), errors.Join(failed...))
+			}
 		}
 	} else {
 		fmt.Printf("Not deleting jpgs for missing raws")
 	}
+	if err := syncAlbums(raws, culling); err != nil {
+		return err
+	}
+	if err := saveOutputs(opts); err != nil {
+		return err
+	}
+	if deleteErr != nil {
+		return deleteErr
+	}
 	// Look for xmp file(s) for the raw file
 	// If no xmp file exists for a RAW...
 	// Run darktable cli, setting export path to match structure of input dir
@@ -118,20 +252,177 @@ func syncDir() error {
 	return nil
 }
 
+// replaced checks whether every raw an ambiguous jpg may belong to has an export with its new name
+func replaced(jpg *linkedimage.Jpg, outDir string) bool {
+	for _, raw := range jpg.AmbiguousRaws {
+		paths := []string{raw.GetJpgPath(outDir)}
+		for _, xmp := range raw.Xmps {
+			paths = append(paths, xmp.GetJpgPath(outDir))
+		}
+		exported := false
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				exported = true
+				break
+			}
+		}
+		if !exported {
+			return false
+		}
+	}
+	return true
+}
+
+// syncAlbums links the exports of raws and their xmps into albums from their tags,
+// and removes entries whose tag was removed, or whose image was culled
+func syncAlbums(raws []*linkedimage.Raw, culling cleanup.Culling) error {
+	dir, err := albumsDir()
+	if err != nil || dir == "" {
+		return err
+	}
+	prefix := viper.GetString("album-tag")
+	outDir := viper.GetString("out")
+	fmt.Println("Updating albums tagged", prefix)
+	albumSet := albums.New(filepath.Join(outDir, dir))
+	albumSet.AddImages(raws, outDir, prefix, culling)
+	// Entries of images outside the scan are only known to be stale after a full scan
+	partial := len(viper.GetStringSlice("include")) > 0 || len(viper.GetStringSlice("film-roll")) > 0 || viper.GetString("source") == sourceLibrary
+	return albumSet.Sync(viper.GetBool("dry-run"), partial)
+}
+
+// replacedOutput checks whether a jpg named from outdated metadata has been exported with its new name
+func replacedOutput(jpg *linkedimage.Jpg, outDir string) bool {
+	path := jpg.Replacement(outDir)
+	if path == "" || path == jpg.GetPath() {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// moveExports waits for the scan to complete, then moves the jpgs of raws that moved
+// It returns the batches to sync, and the moved raws and xmps, which don't need exporting
+// unless the xmp was edited since the jpg was exported
+func moveExports(batches <-chan linkedimage.Batch, opts linkedimage.Options) (<-chan linkedimage.Batch, map[string]bool, error) {
+	var collected []linkedimage.Batch
+	var raws []*linkedimage.Raw
+	var jpgs []*linkedimage.Jpg
+	for batch := range batches {
+		// Jpgs of raws in unscanned directories would look orphaned
+		if batch.Err != nil {
+			return nil, nil, batch.Err
+		}
+		if err := reportCollisions(batch.Collisions); err != nil {
+			return nil, nil, err
+		}
+		if err := linkedimage.CheckConflicts(batch.Conflicts); err != nil {
+			return nil, nil, err
+		}
+		reportDuplicateSidecars(batch.DuplicateSidecars)
+		reportAmbiguousSidecars(batch.AmbiguousSidecars)
+		// Already reported
+		batch.Collisions, batch.Conflicts, batch.DuplicateSidecars, batch.AmbiguousSidecars = nil, nil, nil, nil
+		collected = append(collected, batch)
+		raws = append(raws, batch.Raws...)
+		jpgs = append(jpgs, batch.Jpgs...)
+	}
+	moved := make(map[string]bool)
+	moves := linkedimage.DetectMoves(raws, jpgs, viper.GetString("out"), opts.Outputs)
+	for _, move := range moves {
+		if err := move.Apply(viper.GetBool("dry-run")); err != nil {
+			return nil, nil, err
+		}
+		if move.Stale() {
+			// Exported again by syncRaw
+			continue
+		}
+		if move.Xmp != nil {
+			moved[move.Xmp.GetPath()] = true
+		} else {
+			moved[move.Raw.GetPath()] = true
+		}
+	}
+	fmt.Printf("Moved %d jpgs of moved raws\n", len(moves))
+	replay := make(chan linkedimage.Batch, len(collected))
+	for _, batch := range collected {
+		replay <- batch
+	}
+	close(replay)
+	return replay, moved, nil
+}
+
+// syncRaw exports the raw's xmps, or the raw alone if it has none, that pass the date
+// filter, whose jpg wasn't just moved, and that aren't culled
+func syncRaw(raw *linkedimage.Raw, params darktable.ExportParams, outDir string, dateFilter datefilter.Filter, moved map[string]bool, culling cleanup.Culling) error {
+	if dateFilter.IsZero() && len(moved) == 0 && culling.IsZero() {
+		return raw.Sync(params, outDir)
+	}
+	if len(raw.Xmps) == 0 {
+		if moved[raw.GetPath()] || !matchesDates(dateFilter, raw.Path, nil) {
+			return nil
+		}
+		return raw.Sync(params, outDir)
+	}
+	for _, xmp := range raw.Xmps {
+		if moved[xmp.GetPath()] || !matchesDates(dateFilter, xmp.Path, xmp) {
+			continue
+		}
+		// Its jpg is pruned instead
+		if why, err := culling.Culled(xmp); err == nil && why != "" {
+			fmt.Printf("Skipping %s (%s)\n", xmp.GetPath(), why)
+			continue
+		}
+		params.XmpPath = xmp.GetPath()
+		err := xmp.Sync(params, outDir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesDates checks an xmp, or a raw without xmps, against the date filter
+// Images whose times can't be read are skipped
+func matchesDates(dateFilter datefilter.Filter, path linkedimage.ImagePath, xmp *linkedimage.Xmp) bool {
+	modified, err := path.ModTime()
+	if err != nil {
+		fmt.Printf("Skipping %s, unable to get modification time: %v\n", path.GetFullPath(), err)
+		return false
+	}
+	// darktable's own change time isn't affected by sidecars being copied or rewritten
+	if xmp != nil && !xmp.Changed.IsZero() {
+		modified = xmp.Changed
+	}
+	var captured time.Time
+	if xmp != nil && dateFilter.NeedsCapture() {
+		meta, err := xmp.Metadata()
+		if err != nil {
+			fmt.Printf("Unable to read capture time, using modification time instead: %v\n", err)
+		} else {
+			captured, _ = meta.DateTimeOriginal()
+		}
+	}
+	return dateFilter.Matches(captured, modified)
+}
+
 // syncFile takes the path to a raw file or xmp and exports jpgs
-func syncFile(path string) error {
+func syncFile(command darktable.Command, path string) error {
 	inDir := viper.GetString("in")
 	outDir := viper.GetString("out")
 	extensions := viper.GetStringSlice("extension")
+	opts, err := scanOptions()
+	if err != nil {
+		return err
+	}
 	//switch ext := filepath.Ext(viper.GetString("in")); {
 	switch ext := filepath.Ext(path); {
 	case ext == ".xmp":
-		xmp, err := linkedimage.FindXmp(path, inDir, outDir, extensions)
+		xmp, err := opts.FindXmp(path, inDir, outDir, extensions)
 		if err != nil {
 			return err
 		}
 		params := darktable.ExportParams{
-			Command: viper.GetString("command"),
+			Command: command,
 			XmpPath: path,
 			OnlyNew: viper.GetBool("new"),
 			DryRun:  viper.GetBool("dry-run"),
@@ -143,12 +434,12 @@ func syncFile(path string) error {
 	// raw
 	case caseInsensitiveContains(viper.GetStringSlice("extension"), ext):
 		fmt.Println("Syncing raw file with extension", ext, ":", path)
-		raw, err := linkedimage.FindRaw(path, inDir, outDir)
+		raw, err := opts.FindRaw(path, inDir, outDir, extensions)
 		if err != nil {
 			return err
 		}
 		params := darktable.ExportParams{
-			Command: viper.GetString("command"),
+			Command: command,
 			RawPath: path,
 			OnlyNew: viper.GetBool("new"),
 			DryRun:  viper.GetBool("dry-run"),
@@ -160,6 +451,17 @@ func syncFile(path string) error {
 	default:
 		return errors.New(fmt.Sprintf("Extension of file to be synced ('%s') does not match the extension specified for processing ('%s')", ext, viper.GetStringSlice("extension")))
 	}
+	return saveOutputs(opts)
+}
+
+// saveOutputs writes the sources of exports named from the output template, if there is one
+func saveOutputs(opts linkedimage.Options) error {
+	if opts.Outputs == nil || viper.GetBool("dry-run") {
+		return nil
+	}
+	if err := opts.Outputs.Save(); err != nil {
+		return fmt.Errorf("Unable to save %s: %w", outputs.MapFileName, err)
+	}
 	return nil
 }
 
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/datefilter"
+	"github.com/figadore/darktable-auto-export/internal/staging"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// trashCmd represents the trash command
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List and purge raws and xmps staged by clean",
+	Long: `List and purge raws and xmps staged by clean
+
+Only files recorded in the staging manifest are ever purged, anything else in the delete directory is left alone`,
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List staged files, their age and the space they use",
+	RunE:  trashList,
+}
+
+var trashPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete staged files older than the retention period",
+	RunE:  trashPurge,
+}
+
+var trashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "Delete every staged file",
+	RunE:  trashEmpty,
+}
+
+// trashRetention gets how long staged files are kept, 0 to keep them until purged by hand
+func trashRetention() (time.Duration, error) {
+	if viper.GetString("trash-retention") == "" {
+		return 0, nil
+	}
+	retention, err := datefilter.ParseDuration(viper.GetString("trash-retention"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid trash-retention: %w", err)
+	}
+	return retention, nil
+}
+
+// formatSize shows a size in bytes in binary units
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func trashList(cmd *cobra.Command, args []string) error {
+	manifest, err := staging.Load(viper.GetString("in"))
+	if err != nil {
+		return err
+	}
+	retention, err := trashRetention()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entries := manifest.Entries()
+	for _, e := range entries {
+		fmt.Printf("%10s  %4dd  %s\n", formatSize(e.Size), int(now.Sub(e.StagedAt).Hours()/24), e)
+	}
+	fmt.Printf("%d staged files, %s\n", len(entries), formatSize(staging.Size(entries)))
+	if retention > 0 {
+		expired := manifest.Expired(retention, now)
+		fmt.Printf("%d older than %s, %s\n", len(expired), viper.GetString("trash-retention"), formatSize(staging.Size(expired)))
+	}
+	untracked, err := manifest.Untracked()
+	if err != nil {
+		return err
+	}
+	if len(untracked) > 0 {
+		fmt.Printf("%d files in %s aren't in the manifest, and are never purged:\n", len(untracked), staging.Dir)
+		for _, path := range untracked {
+			fmt.Println(" ", path)
+		}
+	}
+	return nil
+}
+
+func trashPurge(cmd *cobra.Command, args []string) error {
+	retention, err := trashRetention()
+	if err != nil {
+		return err
+	}
+	if retention == 0 {
+		return fmt.Errorf("Set trash-retention to purge staged files, e.g. --trash-retention 30d")
+	}
+	return purgeTrash(func(m *staging.Manifest) []staging.Entry {
+		return m.Expired(retention, time.Now())
+	})
+}
+
+func trashEmpty(cmd *cobra.Command, args []string) error {
+	return purgeTrash(func(m *staging.Manifest) []staging.Entry {
+		entries := m.Entries()
+		if len(entries) > 0 && !viper.GetBool("dry-run") &&
+			!YesNoPrompt(fmt.Sprintf("Delete all %d staged files (%s) for good?", len(entries), formatSize(staging.Size(entries))), false) {
+			return nil
+		}
+		return entries
+	})
+}
+
+// purgeTrash deletes the staged files selected from the manifest for good
+func purgeTrash(selectEntries func(*staging.Manifest) []staging.Entry) error {
+	manifest, err := staging.Load(viper.GetString("in"))
+	if err != nil {
+		return err
+	}
+	entries := selectEntries(manifest)
+	if len(entries) == 0 {
+		fmt.Println("No staged files to purge")
+		return nil
+	}
+	freed, err := manifest.Purge(entries, viper.GetBool("dry-run"))
+	if saveErr := manifest.Save(); err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %s of staged files\n", formatSize(freed))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(trashCmd)
+	trashCmd.AddCommand(trashListCmd, trashPurgeCmd, trashEmptyCmd)
+	trashCmd.PersistentFlags().StringP("in", "i", "./", "Input directory that clean staged files from")
+	trashCmd.PersistentFlags().String("trash-retention", "", "How long staged files are kept before purge deletes them, e.g. 30d or 2w")
+	trashCmd.PersistentFlags().Bool("dry-run", false, "Show files that would be purged, but don't delete them")
+	trashCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	}
+}
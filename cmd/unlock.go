@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/figadore/darktable-auto-export/internal/library"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -50,15 +51,11 @@ func init() {
 func Unlock(cmd *cobra.Command, args []string) error {
 	fmt.Println("Deleting lock files")
 
-	dbLockPath := filepath.Join(viper.GetString("lockdir"), "data.db.lock")
-	libraryLockPath := filepath.Join(viper.GetString("lockdir"), "library.db.lock")
-	err := deleteFile(dbLockPath)
-	if err != nil {
-		return err
-	}
-	err = deleteFile(libraryLockPath)
-	if err != nil {
-		return err
+	for _, name := range library.LockFiles {
+		err := deleteFile(filepath.Join(viper.GetString("lockdir"), name))
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,42 @@
+package albums
+
+import (
+	"fmt"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+)
+
+// Culler decides which exports are pruned, see cleanup.Culling
+type Culler interface {
+	Culled(xmp *linkedimage.Xmp) (string, error)
+}
+
+// AddImages puts the exports of the raws and their xmps in the albums of their tags under prefix
+// Exports pruned by culling are added without albums, so their entries are removed
+// Images whose tags can't be read are left out of albums, and their rating is ignored
+func (a *Albums) AddImages(raws []*linkedimage.Raw, outDir, prefix string, culling Culler) {
+	add := func(export string, xmp *linkedimage.Xmp) {
+		var tags []string
+		if xmp != nil {
+			meta, err := xmp.Metadata()
+			if err != nil {
+				fmt.Printf("Unable to read tags, leaving %s out of albums: %v\n", export, err)
+			} else if why, _ := culling.Culled(xmp); why != "" {
+				fmt.Printf("Leaving %s out of albums (%s)\n", export, why)
+			} else {
+				tags = meta.Tags()
+			}
+		}
+		if err := a.Add(export, FromTags(tags, prefix)); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for _, raw := range raws {
+		if len(raw.Xmps) == 0 {
+			add(raw.GetJpgPath(outDir), nil)
+		}
+		for _, xmp := range raw.Xmps {
+			add(xmp.GetJpgPath(outDir), xmp)
+		}
+	}
+}
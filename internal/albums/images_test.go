@@ -0,0 +1,75 @@
+package albums
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/cleanup"
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+// writeXmp writes a sidecar with a rating and a tag
+func writeXmp(t *testing.T, path string, rating int, tag string) {
+	t.Helper()
+	content := fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmp:Rating="%d">
+   <dc:subject><rdf:Bag><rdf:li>%s</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`, rating, tag)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddImagesSkipsCulled(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "trip/A.ARW", "trip/B.ARW", "trip/C.ARW")
+	testutil.WriteTree(t, dst, "trip/A.jpg", "trip/B.jpg", "trip/C.jpg")
+	writeXmp(t, filepath.Join(src, "trip", "A.ARW.xmp"), 3, "albums|Trip")
+	writeXmp(t, filepath.Join(src, "trip", "B.ARW.xmp"), -1, "albums|Trip")
+	writeXmp(t, filepath.Join(src, "trip", "C.ARW.xmp"), 1, "albums|Trip")
+	raws, _, _, err := linkedimage.FindImages(src, dst, []string{".ARW"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumsDir := filepath.Join(dst, "albums")
+
+	// Every image is in the album before pruning
+	all := New(albumsDir)
+	all.AddImages(raws, dst, "albums", cleanup.Culling{})
+	if err := all.Sync(false, false); err != nil {
+		t.Fatal(err)
+	}
+	// B was rejected, and C rated below 2
+	pruned := New(albumsDir)
+	pruned.AddImages(raws, dst, "albums", cleanup.Culling{Rejected: true, MinRating: 2})
+	if err := pruned.Sync(false, false); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		entry  string
+		exists bool
+	}{
+		{"A.jpg", true},
+		{"B.jpg", false},
+		{"C.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			if got := testutil.Exists(filepath.Join(albumsDir, "Trip", tt.entry)); got != tt.exists {
+				t.Errorf("got exists %v, want %v", got, tt.exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Package albums mirrors exported jpgs into album directories named by hierarchical tags,
+// as hardlinks so an image in several albums is only stored once
+package albums
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FromTags gets the album directories for the tags under prefix, relative to the albums root
+// With prefix albums, the tag albums|Family|2024 Trip is the album Family/2024 Trip
+func FromTags(tags []string, prefix string) []string {
+	prefix = strings.TrimSuffix(prefix, "|") + "|"
+	seen := make(map[string]bool)
+	var albums []string
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		var parts []string
+		for _, part := range strings.Split(strings.TrimPrefix(tag, prefix), "|") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, sanitize(part))
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		album := filepath.Join(parts...)
+		if !seen[album] {
+			seen[album] = true
+			albums = append(albums, album)
+		}
+	}
+	sort.Strings(albums)
+	return albums
+}
+
+// sanitize keeps a tag within a single path segment
+func sanitize(part string) string {
+	part = strings.NewReplacer("/", "-", "\\", "-").Replace(part)
+	if part == "." || part == ".." {
+		return "_"
+	}
+	return part
+}
+
+// Albums is the entries wanted in the albums directory, and the exports they link to
+type Albums struct {
+	root    string
+	entries map[string]string   // Entry path => export path
+	scanned map[string][]string // Basename => export paths, for every export added
+}
+
+// New starts an empty set of albums in root
+func New(root string) *Albums {
+	return &Albums{root: root, entries: make(map[string]string), scanned: make(map[string][]string)}
+}
+
+// Add puts an export in albums, named by its basename. Exports that aren't in any album
+// are added too, so their stale entries can be removed
+// Fails if another export with the same basename is already in one of the albums
+func (a *Albums) Add(export string, albums []string) error {
+	name := filepath.Base(export)
+	a.scanned[name] = append(a.scanned[name], export)
+	for _, album := range albums {
+		entry := filepath.Join(a.root, album, name)
+		if existing, ok := a.entries[entry]; ok && existing != export {
+			return fmt.Errorf("Album '%s' already has %s from %s, not adding %s", album, name, existing, export)
+		}
+		a.entries[entry] = export
+	}
+	return nil
+}
+
+// Sync links each entry to its export, then removes entries that are no longer wanted,
+// e.g. after a tag was removed, and empty album directories
+// With partial, when only some of the exports were added, only entries linked to one of
+// them are removed, as others may belong to images outside the scan
+func (a *Albums) Sync(dryRun, partial bool) error {
+	var entries []string
+	for entry := range a.entries {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		if err := link(a.entries[entry], entry, dryRun); err != nil {
+			return err
+		}
+	}
+
+	var stale []string
+	err := filepath.WalkDir(a.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".jpg") {
+			return nil
+		}
+		if _, ok := a.entries[path]; ok {
+			return nil
+		}
+		if !partial || a.linksScanned(path) {
+			stale = append(stale, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		fmt.Println("Remove album entry", path)
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	return removeEmptyDirs(a.root)
+}
+
+// link makes entry a hardlink to export, unless it already is one
+func link(export, entry string, dryRun bool) error {
+	exportInfo, err := os.Stat(export)
+	if err != nil {
+		// Not exported yet, e.g. in a dry run
+		return nil
+	}
+	if entryInfo, err := os.Stat(entry); err == nil && os.SameFile(exportInfo, entryInfo) {
+		return nil
+	}
+	fmt.Println("Link", export, "to album entry", entry)
+	if dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(entry), os.ModePerm); err != nil {
+		return err
+	}
+	// Replaced exports are new files, so the old link is removed first
+	if err := os.Remove(entry); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Link(export, entry)
+}
+
+// linksScanned checks whether an entry is a link to one of the added exports
+func (a *Albums) linksScanned(entry string) bool {
+	entryInfo, err := os.Stat(entry)
+	if err != nil {
+		return false
+	}
+	for _, export := range a.scanned[filepath.Base(entry)] {
+		if exportInfo, err := os.Stat(export); err == nil && os.SameFile(exportInfo, entryInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes directories under root, deepest first, that have nothing left in them
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package albums
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFromTags(t *testing.T) {
+	var tests = []struct {
+		name   string
+		tags   []string
+		prefix string
+		want   []string
+	}{
+		{"nested", []string{"albums|Family|2024 Trip", "places|Oslo"}, "albums", []string{filepath.Join("Family", "2024 Trip")}},
+		{"several", []string{"albums|Family", "albums|Best of"}, "albums", []string{"Best of", "Family"}},
+		{"prefix with separator", []string{"albums|Family"}, "albums|", []string{"Family"}},
+		{"hierarchical prefix", []string{"albums|Family|2024 Trip", "albums|Friends"}, "albums|Family", []string{"2024 Trip"}},
+		{"prefix alone", []string{"albums", "albums|"}, "albums", nil},
+		{"plain tag", []string{"Family"}, "albums", nil},
+		{"similar prefix", []string{"albums2|Family"}, "albums", nil},
+		{"unsafe", []string{"albums|a/b", "albums|..|x"}, "albums", []string{filepath.Join("_", "x"), "a-b"}},
+		{"duplicates", []string{"albums|Family", "albums|Family"}, "albums", []string{"Family"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromTags(tt.tags, tt.prefix); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func TestSync(t *testing.T) {
+	out := t.TempDir()
+	root := filepath.Join(out, "albums")
+	a := filepath.Join(out, "card1", "a.jpg")
+	b := filepath.Join(out, "card1", "b.jpg")
+	c := filepath.Join(out, "card2", "c.jpg")
+	writeFile(t, a)
+	writeFile(t, b)
+	writeFile(t, c)
+
+	first := New(root)
+	for export, albums := range map[string][]string{
+		a: {"Family", filepath.Join("Trips", "Oslo")},
+		b: {"Family"},
+		c: {"Friends"},
+	} {
+		if err := first.Add(export, albums); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Sync(false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []struct{ export, entry string }{
+		{a, filepath.Join(root, "Family", "a.jpg")},
+		{a, filepath.Join(root, "Trips", "Oslo", "a.jpg")},
+		{b, filepath.Join(root, "Family", "b.jpg")},
+		{c, filepath.Join(root, "Friends", "c.jpg")},
+	} {
+		if !sameFile(t, link.export, link.entry) {
+			t.Errorf("%s should be a hardlink to %s", link.entry, link.export)
+		}
+	}
+
+	// Only card1 is scanned, a was untagged from Trips|Oslo and b from Family
+	second := New(root)
+	if err := second.Add(a, []string{"Family"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Add(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Sync(false, true); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		entry  string
+		exists bool
+	}{
+		{filepath.Join(root, "Family", "a.jpg"), true},
+		{filepath.Join(root, "Trips", "Oslo", "a.jpg"), false},
+		{filepath.Join(root, "Trips"), false},
+		{filepath.Join(root, "Family", "b.jpg"), false},
+		// Not scanned, so kept in a partial sync
+		{filepath.Join(root, "Friends", "c.jpg"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			_, err := os.Stat(tt.entry)
+			if exists := err == nil; exists != tt.exists {
+				t.Errorf("got exists %v, want %v", exists, tt.exists)
+			}
+		})
+	}
+
+	// A full sync removes entries of exports that weren't added
+	if err := second.Sync(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Friends")); !os.IsNotExist(err) {
+		t.Errorf("Entries of missing exports should be removed in a full sync")
+	}
+}
+
+func TestAddDuplicateName(t *testing.T) {
+	albums := New("/out/albums")
+	if err := albums.Add("/out/card1/a.jpg", []string{"Family"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := albums.Add("/out/card2/a.jpg", []string{"Friends"}); err != nil {
+		t.Errorf("Same name in another album should be allowed, got %v", err)
+	}
+	if err := albums.Add("/out/card2/a.jpg", []string{"Family"}); err == nil {
+		t.Errorf("Expected error for the same name twice in one album")
+	}
+}
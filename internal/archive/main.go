@@ -0,0 +1,206 @@
+// Package archive moves source files that clean would delete into an archive directory,
+// e.g. on cold storage, keeping their relative paths and recording each one in a manifest
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/fileutil"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/staging"
+)
+
+// ManifestFileName is the file in the archive directory recording each archived file
+const ManifestFileName = ".dae-archive.json"
+
+// Entry is an archived file. Paths are relative to the input and archive directories,
+// which are the same, with "/" separators
+type Entry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Hash       string    `json:"sha256"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Reason     string    `json:"reason"`
+	Copied     bool      `json:"copied,omitempty"` // Copied across filesystems rather than renamed
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s (archived %s, %s)", e.Path, e.ArchivedAt.Local().Format("2006-01-02 15:04"), e.Reason)
+}
+
+// Archive is a directory that files from an input directory are moved to
+type Archive struct {
+	root    string
+	srcDir  string
+	entries []Entry
+	dirty   bool
+	// Verify re-reads files copied across filesystems, and only removes the original if
+	// the copy has the same sha256
+	Verify bool
+	rename func(oldpath, newpath string) error
+}
+
+// Open reads the manifest of the archive in root, or starts an empty one
+func Open(root, srcDir string) (*Archive, error) {
+	a := &Archive{root: root, srcDir: srcDir, rename: os.Rename}
+	content, err := os.ReadFile(a.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &a.entries); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", a.path(), err)
+	}
+	return a, nil
+}
+
+// Root is the archive directory
+func (a *Archive) Root() string {
+	return a.root
+}
+
+func (a *Archive) path() string {
+	return filepath.Join(a.root, ManifestFileName)
+}
+
+// Move moves a file in the input directory to the same relative path in the archive,
+// recording its size and hash. It returns the archived path
+// Files are renamed where possible, and otherwise copied, then removed
+func (a *Archive) Move(file, reason string, dryRun bool) (string, error) {
+	rel, err := filepath.Rel(a.srcDir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in the input directory %s", file, a.srcDir)
+	}
+	dest := filepath.Join(a.root, rel)
+	fmt.Println("Archive", file, "to", dest)
+	if dryRun {
+		return dest, nil
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("%s is already archived", dest)
+	}
+	size, hash, err := outputs.HashFile(file)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return "", err
+	}
+	copied := false
+	if err := a.rename(file, dest); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return "", err
+		}
+		if err := a.copy(file, dest, hash); err != nil {
+			return "", err
+		}
+		if err := os.Remove(file); err != nil {
+			return "", err
+		}
+		copied = true
+	}
+	a.entries = append(a.entries, Entry{
+		Path:       filepath.ToSlash(rel),
+		Size:       size,
+		Hash:       hash,
+		ArchivedAt: time.Now().UTC(),
+		Reason:     reason,
+		Copied:     copied,
+	})
+	a.dirty = true
+	return dest, nil
+}
+
+// copy copies file to dest through a temporary file, so dest only appears once complete
+// With Verify, the copy is read back and compared to the hash of the original
+func (a *Archive) copy(file, dest, hash string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if a.Verify {
+		_, copyHash, err := outputs.HashFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if copyHash != hash {
+			return fmt.Errorf("Copy of %s in the archive doesn't match the original, keeping the original", file)
+		}
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Search lists the archived files whose path matches one of the glob patterns, all of them
+// without patterns. Patterns match as for restoring staged files, see staging.Matches
+func (a *Archive) Search(patterns []string) ([]Entry, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	var found []Entry
+	for _, e := range a.entries {
+		if len(patterns) == 0 || staging.Matches(patterns, e.Path) {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+// Save writes the manifest if it changed
+func (a *Archive) Save() error {
+	if !a.dirty {
+		return nil
+	}
+	entries := a.entries
+	if entries == nil {
+		entries = []Entry{}
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(a.path(), content); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
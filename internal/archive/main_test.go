@@ -0,0 +1,165 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+// crossDevice fails every rename as if the archive were on another filesystem
+func crossDevice(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+}
+
+func TestMove(t *testing.T) {
+	var tests = []struct {
+		name   string
+		rename func(oldpath, newpath string) error
+		copied bool
+	}{
+		{"rename", os.Rename, false},
+		{"copy across filesystems", crossDevice, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			src := filepath.Join(root, "src")
+			dir := filepath.Join(root, "archive")
+			testutil.WriteTree(t, src, "2024/a/A.ARW")
+			original := filepath.Join(src, "2024/a/A.ARW")
+			mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(original, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			a, err := Open(dir, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.rename = tt.rename
+			a.Verify = true
+			archived, err := a.Move(original, "no jpg", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, "2024/a/A.ARW"); archived != want {
+				t.Errorf("got %s, want %s", archived, want)
+			}
+			if testutil.Exists(original) {
+				t.Errorf("Original should be removed")
+			}
+			content, err := os.ReadFile(archived)
+			if err != nil || string(content) != "2024/a/A.ARW" {
+				t.Errorf("got content %q, %v", content, err)
+			}
+			if info, err := os.Stat(archived); err != nil || !info.ModTime().Equal(mtime) {
+				t.Errorf("Archived file should keep its modification time, got %v", info.ModTime())
+			}
+			if err := a.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := Open(dir, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := reopened.Search(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("got entries %v", entries)
+			}
+			e := entries[0]
+			if e.Path != "2024/a/A.ARW" || e.Size != int64(len("2024/a/A.ARW")) || e.Hash == "" || e.Reason != "no jpg" || e.Copied != tt.copied {
+				t.Errorf("got entry %+v", e)
+			}
+
+			// Never overwrite an archived file
+			testutil.WriteTree(t, src, "2024/a/A.ARW")
+			if _, err := reopened.Move(original, "no jpg", false); err == nil {
+				t.Errorf("Expected error archiving over an archived file")
+			}
+			if !testutil.Exists(original) {
+				t.Errorf("Original should be kept when it can't be archived")
+			}
+		})
+	}
+}
+
+func TestMoveOutsideInput(t *testing.T) {
+	root := t.TempDir()
+	testutil.WriteTree(t, root, "other/A.ARW")
+	a, err := Open(filepath.Join(root, "archive"), filepath.Join(root, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Move(filepath.Join(root, "other/A.ARW"), "no jpg", false); err == nil {
+		t.Errorf("Expected error archiving a file outside the input directory")
+	}
+}
+
+func TestMoveDryRun(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dir := filepath.Join(root, "archive")
+	testutil.WriteTree(t, src, "a/A.ARW")
+	a, err := Open(dir, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Move(filepath.Join(src, "a/A.ARW"), "no jpg", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.Exists(filepath.Join(src, "a/A.ARW")) || testutil.Exists(dir) {
+		t.Errorf("Dry run should not move anything")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	testutil.WriteTree(t, src, "2023/trip/A.ARW", "2023/trip/A.ARW.xmp", "2024/home/B.ARW")
+	a, err := Open(filepath.Join(root, "archive"), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"2023/trip/A.ARW", "2023/trip/A.ARW.xmp", "2024/home/B.ARW"} {
+		if _, err := a.Move(filepath.Join(src, rel), "no jpg", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		patterns []string
+		want     []string
+	}{
+		{nil, []string{"2023/trip/A.ARW", "2023/trip/A.ARW.xmp", "2024/home/B.ARW"}},
+		{[]string{"2023"}, []string{"2023/trip/A.ARW", "2023/trip/A.ARW.xmp"}},
+		{[]string{"*.xmp"}, []string{"2023/trip/A.ARW.xmp"}},
+		{[]string{"B.*", "2023/trip/A.ARW"}, []string{"2023/trip/A.ARW", "2024/home/B.ARW"}},
+		{[]string{"2025"}, nil},
+	}
+	for _, tt := range tests {
+		entries, err := a.Search(tt.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.patterns, got, tt.want)
+		}
+	}
+	if _, err := a.Search([]string{"["}); err == nil {
+		t.Errorf("Expected error for an invalid pattern")
+	}
+}
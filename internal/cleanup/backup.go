@@ -0,0 +1,86 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+)
+
+// RequireBackup keeps the raws that don't have a verified copy in one of the backup roots,
+// along with their xmps. A copy is verified when it is at the same path relative to the
+// root as the raw is to the input directory, with the same size and sha256
+func (p Plan) RequireBackup(roots []string) Plan {
+	if len(roots) == 0 {
+		return p
+	}
+	unbackedRaws := make(map[string]string)
+	var items []Item
+	for _, item := range p.Items {
+		var why string
+		if item.raw != nil {
+			why = checkBackup(item.Path, item.raw.Path.GetRelativePath(), roots)
+			if why != "" {
+				unbackedRaws[item.Path] = why
+			}
+		} else if item.xmp.Raw != nil {
+			why = unbackedRaws[item.xmp.Raw.GetPath()]
+		}
+		if why == "" {
+			items = append(items, item)
+			continue
+		}
+		item.ProtectedBy = why
+		p.Unbacked = append(p.Unbacked, item)
+	}
+	p.Items = items
+	return p
+}
+
+// checkBackup looks for a verified copy of file in the roots, and explains why none of
+// them has one, or returns "" when one does
+func checkBackup(file, rel string, roots []string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Sprintf("unreadable: %v", err)
+	}
+	var hash string
+	var problems []string
+	for _, root := range roots {
+		backup := filepath.Join(root, rel)
+		backupInfo, err := os.Stat(backup)
+		if errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, "missing in "+root)
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unreadable in %s: %v", root, err))
+			continue
+		}
+		if !backupInfo.Mode().IsRegular() || backupInfo.Size() != info.Size() {
+			problems = append(problems, "different size in "+root)
+			continue
+		}
+		// Only hash the raw once a backup of the same size is found
+		if hash == "" {
+			if _, hash, err = outputs.HashFile(file); err != nil {
+				return fmt.Sprintf("unreadable: %v", err)
+			}
+		}
+		_, backupHash, err := outputs.HashFile(backup)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unreadable in %s: %v", root, err))
+			continue
+		}
+		if backupHash != hash {
+			problems = append(problems, "different sha256 in "+root)
+			continue
+		}
+		return ""
+	}
+	return "no verified backup: " + strings.Join(problems, ", ")
+}
@@ -0,0 +1,70 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+func TestRequireBackup(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	nas := filepath.Join(root, "nas")
+	usb := filepath.Join(root, "usb")
+	testutil.WriteTree(t, src, "a/Backed.ARW", "a/Backed.ARW.xmp", "a/Second.ARW", "a/Missing.ARW", "a/Missing.ARW.xmp",
+		"a/Size.ARW", "a/Changed.ARW", "a/Orphan_01.ARW.xmp")
+	// writeTree writes each file's relative path as its content, so copies match
+	testutil.WriteTree(t, nas, "a/Backed.ARW", "a/Size.ARW", "a/Changed.ARW")
+	testutil.WriteTree(t, usb, "a/Second.ARW")
+	if err := os.WriteFile(filepath.Join(nas, "a/Size.ARW"), []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Same size, different content
+	if err := os.WriteFile(filepath.Join(nas, "a/Changed.ARW"), []byte("a/Changed.ARx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	raws, xmps, _, err := linkedimage.FindImages(src, dst, []string{".ARW"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := NewPlan(raws, xmps).RequireBackup([]string{nas, usb})
+
+	rel := func(items []Item) []string {
+		var paths []string
+		for _, item := range items {
+			r, _ := filepath.Rel(src, item.Path)
+			paths = append(paths, filepath.ToSlash(r)+" "+item.ProtectedBy)
+		}
+		return paths
+	}
+	want := []string{
+		"a/Backed.ARW ",
+		"a/Second.ARW ",
+		"a/Backed.ARW.xmp ",
+		"a/Orphan_01.ARW.xmp ",
+	}
+	if got := rel(plan.Items); !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %q, want %q", got, want)
+	}
+	want = []string{
+		"a/Changed.ARW no verified backup: different sha256 in " + nas + ", missing in " + usb,
+		"a/Missing.ARW no verified backup: missing in " + nas + ", missing in " + usb,
+		"a/Size.ARW no verified backup: different size in " + nas + ", missing in " + usb,
+		"a/Missing.ARW.xmp no verified backup: missing in " + nas + ", missing in " + usb,
+	}
+	if got := rel(plan.Unbacked); !reflect.DeepEqual(got, want) {
+		t.Errorf("got unbacked %q, want %q", got, want)
+	}
+
+	if got := NewPlan(raws, xmps).RequireBackup(nil); len(got.Items) != 8 || len(got.Unbacked) != 0 {
+		t.Errorf("Without backup roots nothing should be kept, got %d items", len(got.Items))
+	}
+}
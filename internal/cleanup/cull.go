@@ -0,0 +1,49 @@
+package cleanup
+
+import (
+	"fmt"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+)
+
+// Culling decides which exports are pruned after their source was rejected or rated down
+// in darktable. The raws and xmps themselves are kept
+type Culling struct {
+	Rejected  bool // Prune images rejected in darktable
+	MinRating int  // Prune images rated below this, including rejected ones. 0 to disable
+}
+
+// NewCulling checks the culling settings
+func NewCulling(rejected bool, minRating int) (Culling, error) {
+	if minRating < 0 || minRating > 5 {
+		return Culling{}, fmt.Errorf("Prune rating %d should be between 1 and 5, or 0 to disable", minRating)
+	}
+	return Culling{Rejected: rejected, MinRating: minRating}, nil
+}
+
+// IsZero checks whether nothing is pruned
+func (c Culling) IsZero() bool {
+	return !c.Rejected && c.MinRating == 0
+}
+
+// Culled gets why the export of the xmp should be pruned, or "" if it shouldn't
+// Xmps without a rating are kept
+func (c Culling) Culled(xmp *linkedimage.Xmp) (string, error) {
+	if c.IsZero() {
+		return "", nil
+	}
+	meta, err := xmp.Metadata()
+	if err != nil {
+		return "", err
+	}
+	rating, ok := meta.Rating()
+	switch {
+	case !ok:
+		return "", nil
+	case rating < 0 && (c.Rejected || c.MinRating > 0):
+		return "rejected", nil
+	case rating < c.MinRating:
+		return fmt.Sprintf("rated %d, below %d", rating, c.MinRating), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,67 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+func TestCulled(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "Rejected.ARW", "One.ARW", "Three.ARW", "Unrated.ARW")
+	writeXmp(t, filepath.Join(src, "Rejected.ARW.xmp"), -1, "", 0)
+	writeXmp(t, filepath.Join(src, "One.ARW.xmp"), 1, "", 0)
+	writeXmp(t, filepath.Join(src, "Three.ARW.xmp"), 3, "", 0)
+	if err := os.WriteFile(filepath.Join(src, "Unrated.ARW.xmp"), []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, xmps, _, err := linkedimage.FindImages(src, dst, []string{".ARW"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*linkedimage.Xmp)
+	for _, xmp := range xmps {
+		byName[filepath.Base(xmp.GetPath())] = xmp
+	}
+
+	var tests = []struct {
+		name      string
+		rejected  bool
+		minRating int
+		want      map[string]string
+	}{
+		{"disabled", false, 0, map[string]string{}},
+		{"rejected", true, 0, map[string]string{"Rejected.ARW.xmp": "rejected"}},
+		{"rating", false, 2, map[string]string{"Rejected.ARW.xmp": "rejected", "One.ARW.xmp": "rated 1, below 2"}},
+		{"both", true, 4, map[string]string{"Rejected.ARW.xmp": "rejected", "One.ARW.xmp": "rated 1, below 4", "Three.ARW.xmp": "rated 3, below 4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			culling, err := NewCulling(tt.rejected, tt.minRating)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, xmp := range byName {
+				got, err := culling.Culled(xmp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want[name] {
+					t.Errorf("%s: got %q, want %q", name, got, tt.want[name])
+				}
+			}
+		})
+	}
+
+	if _, err := NewCulling(false, 6); err == nil {
+		t.Errorf("Expected error for a rating above 5")
+	}
+}
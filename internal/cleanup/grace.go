@@ -0,0 +1,126 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/fileutil"
+)
+
+// MissingFileName is the file in the input directory recording when each raw and xmp was
+// first seen without its jpg
+const MissingFileName = ".dae-missing.json"
+
+// Missing records when raws and xmps were first seen without a jpg, by path relative to the
+// input directory with "/" separators
+type Missing struct {
+	srcDir    string
+	firstSeen map[string]time.Time
+	dirty     bool
+}
+
+// LoadMissing reads the first-seen dates of srcDir, or starts with none
+func LoadMissing(srcDir string) (*Missing, error) {
+	m := &Missing{srcDir: srcDir, firstSeen: make(map[string]time.Time)}
+	content, err := os.ReadFile(m.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &m.firstSeen); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", m.path(), err)
+	}
+	if m.firstSeen == nil {
+		m.firstSeen = make(map[string]time.Time)
+	}
+	return m, nil
+}
+
+func (m *Missing) path() string {
+	return filepath.Join(m.srcDir, MissingFileName)
+}
+
+func (m *Missing) key(path string) string {
+	rel, err := filepath.Rel(m.srcDir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// ApplyGrace holds back the items first seen in an earlier plan less than grace before now,
+// along with the xmps of raws held back, so a jpg deleted by accident can be exported
+// again before its raw goes
+// Items are recorded the first time they are seen, and forgotten once they have a jpg
+// again or no longer exist
+func (p Plan) ApplyGrace(m *Missing, grace time.Duration, now time.Time) Plan {
+	inPlan := make(map[string]bool, len(p.Items))
+	for _, item := range p.Items {
+		inPlan[m.key(item.Path)] = true
+	}
+	for key := range m.firstSeen {
+		if inPlan[key] {
+			continue
+		}
+		path := filepath.Join(m.srcDir, filepath.FromSlash(key))
+		// Only forget files that were scanned, or are gone, as a partial scan doesn't say
+		// whether the others still miss their jpg
+		if _, err := os.Stat(path); p.scanned[path] || err != nil {
+			delete(m.firstSeen, key)
+			m.dirty = true
+		}
+	}
+
+	// Until when each raw held back is kept
+	waitingRaws := make(map[string]time.Time)
+	var ready, waiting []Item
+	for _, item := range p.Items {
+		key := m.key(item.Path)
+		firstSeen, ok := m.firstSeen[key]
+		if !ok {
+			firstSeen = now
+			m.firstSeen[key] = now
+			m.dirty = true
+		}
+		item.FirstSeen = firstSeen
+		until := firstSeen.Add(grace)
+		if item.xmp != nil && item.xmp.Raw != nil {
+			if rawUntil, ok := waitingRaws[item.xmp.Raw.GetPath()]; ok && rawUntil.After(until) {
+				until = rawUntil
+			}
+		}
+		if !now.Before(until) {
+			ready = append(ready, item)
+			continue
+		}
+		if item.raw != nil {
+			waitingRaws[item.Path] = until
+		}
+		item.Until = &until
+		waiting = append(waiting, item)
+	}
+	p.Items, p.Waiting = ready, waiting
+	return p
+}
+
+// Save writes the first-seen dates if they changed
+func (m *Missing) Save() error {
+	if !m.dirty {
+		return nil
+	}
+	content, err := json.MarshalIndent(m.firstSeen, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(m.path(), content); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
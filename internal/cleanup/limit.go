@@ -0,0 +1,48 @@
+package cleanup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// previewCount is how many of the files are listed when refusing to delete them
+const previewCount = 10
+
+// DeletionLimit refuses to delete most of the exports at once, which usually means the
+// source directory is unmounted or mistyped rather than that the raws were deleted
+type DeletionLimit struct {
+	MaxPercent float64 // Largest share of the exports deleted in one run. 0 for no limit
+	MaxCount   int     // Most exports deleted in one run. 0 for no limit
+}
+
+// Check fails if deleting the paths, out of total exports, goes over the limit, or if
+// exports would be deleted although no source files were found at all
+// The error lists some of the paths
+func (l DeletionLimit) Check(paths []string, total, sources int) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	var reason string
+	switch {
+	case sources == 0:
+		reason = "no source files were found, is the input directory mounted?"
+	case l.MaxCount > 0 && len(paths) > l.MaxCount:
+		reason = fmt.Sprintf("that is more than the limit of %d", l.MaxCount)
+	case l.MaxPercent > 0 && float64(len(paths)) > float64(total)*l.MaxPercent/100:
+		reason = fmt.Sprintf("that is %.0f%% of them, more than the limit of %g%%", float64(len(paths))*100/float64(total), l.MaxPercent)
+	default:
+		return nil
+	}
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	preview := sorted
+	if len(preview) > previewCount {
+		preview = preview[:previewCount]
+	}
+	msg := fmt.Sprintf("Refusing to delete %d of %d jpgs, as %s\n  %s", len(paths), total, reason, strings.Join(preview, "\n  "))
+	if len(sorted) > len(preview) {
+		msg += fmt.Sprintf("\n  ...and %d more", len(sorted)-len(preview))
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -0,0 +1,64 @@
+package cleanup
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeletionLimit(t *testing.T) {
+	paths := func(n int) []string {
+		var paths []string
+		for i := 0; i < n; i++ {
+			paths = append(paths, fmt.Sprintf("/out/%02d.jpg", i))
+		}
+		return paths
+	}
+	var tests = []struct {
+		name    string
+		limit   DeletionLimit
+		paths   []string
+		total   int
+		sources int
+		wantErr string
+	}{
+		{"nothing to delete", DeletionLimit{MaxPercent: 10}, nil, 100, 0, ""},
+		{"within percent", DeletionLimit{MaxPercent: 10}, paths(10), 100, 90, ""},
+		{"over percent", DeletionLimit{MaxPercent: 10}, paths(11), 100, 89, "11%"},
+		{"over count", DeletionLimit{MaxPercent: 50, MaxCount: 5}, paths(6), 100, 94, "limit of 5"},
+		{"no limits", DeletionLimit{}, paths(100), 100, 1, ""},
+		{"no sources", DeletionLimit{}, paths(1), 100, 0, "mounted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limit.Check(tt.paths, tt.total, tt.sources)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want error with %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeletionLimitPreview(t *testing.T) {
+	var paths []string
+	for i := 25; i > 0; i-- {
+		paths = append(paths, fmt.Sprintf("/out/%02d.jpg", i))
+	}
+	err := DeletionLimit{MaxCount: 1}.Check(paths, 25, 1)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "/out/01.jpg") || !strings.Contains(msg, "/out/10.jpg") || strings.Contains(msg, "/out/11.jpg") {
+		t.Errorf("Preview should list the first %d paths, got %s", previewCount, msg)
+	}
+	if !strings.Contains(msg, "and 15 more") {
+		t.Errorf("Preview should count the paths left out, got %s", msg)
+	}
+}
@@ -0,0 +1,290 @@
+// Package cleanup plans and carries out the removal of raws and xmps whose jpgs were
+// deleted, staging them first so they can be restored, and guards against deleting
+// exports en masse
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/archive"
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/staging"
+)
+
+// Kinds of source files in a plan
+const (
+	KindRaw = "raw"
+	KindXmp = "xmp"
+)
+
+// Item is a source file to remove
+type Item struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// When the file was first seen without a jpg, see ApplyGrace
+	FirstSeen time.Time `json:"first_seen"`
+	// When the grace period is over, for items held back
+	Until *time.Time `json:"until,omitempty"`
+	// Why the image is kept, for protected and unbacked items
+	ProtectedBy string `json:"protected_by,omitempty"`
+	raw         *linkedimage.Raw
+	xmp         *linkedimage.Xmp
+}
+
+// Plan lists the source files clean removes, raws first, each sorted by path
+type Plan struct {
+	Items     []Item   `json:"items"`
+	Waiting   []Item   `json:"waiting"`   // Held back until the grace period is over, see ApplyGrace
+	Protected []Item   `json:"protected"` // Kept as they were rated, tagged or labelled, see Protect
+	Unbacked  []Item   `json:"unbacked"`  // Kept without a verified backup, see RequireBackup
+	Skipped   []string `json:"skipped"`   // Raws kept until they are synced, see NewPlan
+	scanned   map[string]bool
+}
+
+// NewPlan finds raws without any jpg, along with their xmps, and xmps without a jpg
+// Raws sharing a basename with another raw are skipped while their only export may
+// still be named without the suffix it needs, and sidecars they share are always kept
+func NewPlan(raws []*linkedimage.Raw, xmps []*linkedimage.Xmp) Plan {
+	plan := Plan{scanned: make(map[string]bool, len(raws)+len(xmps))}
+	for _, raw := range raws {
+		plan.scanned[raw.GetPath()] = true
+	}
+	for _, xmp := range xmps {
+		plan.scanned[xmp.GetPath()] = true
+	}
+	planned := make(map[string]bool)
+	var planXmps []Item
+	for _, raw := range raws {
+		if len(raw.Jpgs) > 0 {
+			continue
+		}
+		if len(raw.AmbiguousJpgs) > 0 {
+			plan.Skipped = append(plan.Skipped, raw.GetPath())
+			continue
+		}
+		plan.Items = append(plan.Items, Item{Kind: KindRaw, Path: raw.GetPath(), Reason: "no jpg", raw: raw})
+		// Clean up any orphan xmps
+		for _, xmp := range rawXmps(raw) {
+			if xmp.Raw != raw {
+				continue
+			}
+			planXmps = append(planXmps, Item{Kind: KindXmp, Path: xmp.GetPath(), Reason: "raw deleted", xmp: xmp})
+			planned[xmp.GetPath()] = true
+		}
+	}
+	for _, xmp := range xmps {
+		// Never exported, as the sidecar of the other convention is used instead
+		if xmp.IgnoredFor != nil || xmp.Jpg != nil || planned[xmp.GetPath()] {
+			continue
+		}
+		if xmp.Raw != nil && len(xmp.Raw.AmbiguousJpgs) > 0 {
+			continue
+		}
+		// Never linked, as it may belong to any raw sharing its basename
+		if len(xmp.AmbiguousRaws) > 0 {
+			continue
+		}
+		planXmps = append(planXmps, Item{Kind: KindXmp, Path: xmp.GetPath(), Reason: "no jpg", xmp: xmp})
+		planned[xmp.GetPath()] = true
+	}
+	sort.Slice(plan.Items, func(i, j int) bool { return plan.Items[i].Path < plan.Items[j].Path })
+	sort.Slice(planXmps, func(i, j int) bool { return planXmps[i].Path < planXmps[j].Path })
+	plan.Items = append(plan.Items, planXmps...)
+	return plan
+}
+
+// Print lists the plan for people
+func (p Plan) Print(w io.Writer) {
+	for _, path := range p.Skipped {
+		fmt.Fprintln(w, "Skipping", path, "until it has been synced, as it shares its basename with another raw")
+	}
+	for _, item := range p.Protected {
+		fmt.Fprintf(w, "Protecting %s %s (%s)\n", item.Kind, item.Path, item.ProtectedBy)
+	}
+	for _, item := range p.Unbacked {
+		fmt.Fprintf(w, "Keeping %s %s (%s)\n", item.Kind, item.Path, item.ProtectedBy)
+	}
+	for _, item := range p.Waiting {
+		fmt.Fprintf(w, "Keeping %s %s until %s (%s since %s)\n", item.Kind, item.Path, item.Until.Format(dateFormat), item.Reason, item.FirstSeen.Format(dateFormat))
+	}
+	for _, item := range p.Items {
+		if item.FirstSeen.IsZero() {
+			fmt.Fprintf(w, "Delete %s %s (%s)\n", item.Kind, item.Path, item.Reason)
+		} else {
+			fmt.Fprintf(w, "Delete %s %s (%s since %s)\n", item.Kind, item.Path, item.Reason, item.FirstSeen.Format(dateFormat))
+		}
+	}
+}
+
+const dateFormat = "2006-01-02 15:04"
+
+// WriteJSON writes the plan for scripts
+func (p Plan) WriteJSON(w io.Writer) error {
+	if p.Items == nil {
+		p.Items = []Item{}
+	}
+	if p.Protected == nil {
+		p.Protected = []Item{}
+	}
+	if p.Unbacked == nil {
+		p.Unbacked = []Item{}
+	}
+	if p.Waiting == nil {
+		p.Waiting = []Item{}
+	}
+	if p.Skipped == nil {
+		p.Skipped = []string{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// CheckLimit fails if the plan removes more than max files. 0 is no limit
+func (p Plan) CheckLimit(max int) error {
+	if max > 0 && len(p.Items) > max {
+		return fmt.Errorf("Refusing to remove %d files, more than the limit of %d. Check that the output directory is complete, or raise --max-deletions", len(p.Items), max)
+	}
+	return nil
+}
+
+// Options are the steps clean takes without asking
+type Options struct {
+	StageOnly bool             // Stage files, but never delete them
+	Archive   *archive.Archive // Move files to this archive instead of staging and deleting them
+	DryRun    bool
+}
+
+// Run stages the files in the plan, logging them in the manifest, then deletes them,
+// asking the prompter before each step
+func Run(plan Plan, manifest *staging.Manifest, prompter Prompter, opts Options) error {
+	if len(plan.Items) == 0 {
+		fmt.Println("No candidate source files to delete")
+		return nil
+	}
+	if opts.Archive != nil {
+		return moveToArchive(plan, opts.Archive, prompter, opts.DryRun)
+	}
+	if prompter.Confirm("Stage files listed above for deletion?", false) {
+		err := stage(plan, manifest, opts.DryRun)
+		if saveErr := manifest.Save(); err == nil {
+			err = saveErr
+		}
+		if err != nil {
+			return fmt.Errorf("Error staging files for deletion: %w", err)
+		}
+	}
+	if opts.StageOnly {
+		fmt.Println("Staged files are kept until deleted with --delete-staged, or purged from the trash")
+		return nil
+	}
+	if !prompter.Confirm("Delete the source files listed above?", false) {
+		return nil
+	}
+	for _, item := range plan.Items {
+		var err error
+		if item.raw != nil {
+			err = item.raw.Delete(opts.DryRun)
+		} else {
+			err = item.xmp.Delete(opts.DryRun)
+		}
+		if err != nil {
+			manifest.Save()
+			return fmt.Errorf("Error deleting %s: %w", item.Path, err)
+		}
+		manifest.Forget(item.current())
+	}
+	return manifest.Save()
+}
+
+// Removed lists the files in the plan that are gone for good after Run, i.e. deleted or
+// archived, but not staged
+func (p Plan) Removed(manifest *staging.Manifest) []string {
+	var removed []string
+	for _, item := range p.Items {
+		if _, err := os.Lstat(item.Path); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !manifest.IsStaged(item.Path) {
+			removed = append(removed, item.Path)
+		}
+	}
+	return removed
+}
+
+// current gets the path of the item's file, which changes when it is staged
+func (item Item) current() string {
+	if item.raw != nil {
+		return item.raw.GetPath()
+	}
+	return item.xmp.GetPath()
+}
+
+// stage moves the files in the plan into the staging directory
+func stage(plan Plan, manifest *staging.Manifest, dryRun bool) error {
+	for _, item := range plan.Items {
+		fmt.Println("Staging", item.Path)
+		var err error
+		if item.raw != nil {
+			err = item.raw.StageForDeletion(manifest, item.Reason, dryRun)
+		} else {
+			err = item.xmp.StageForDeletion(manifest, item.Reason, dryRun)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", item.Path, err)
+		}
+	}
+	return nil
+}
+
+// moveToArchive moves the files in the plan into the archive after asking, logging them in
+// its manifest
+func moveToArchive(plan Plan, a *archive.Archive, prompter Prompter, dryRun bool) error {
+	if !prompter.Confirm(fmt.Sprintf("Archive the files listed above to %s?", a.Root()), false) {
+		return nil
+	}
+	for _, item := range plan.Items {
+		var err error
+		if item.raw != nil {
+			err = item.raw.MoveToArchive(a, item.Reason, dryRun)
+		} else {
+			err = item.xmp.MoveToArchive(a, item.Reason, dryRun)
+		}
+		if err != nil {
+			a.Save()
+			return fmt.Errorf("Error archiving %s: %w", item.Path, err)
+		}
+	}
+	return a.Save()
+}
+
+// DeleteStaged deletes the files staged by earlier runs, e.g. with StageOnly, after asking
+func DeleteStaged(manifest *staging.Manifest, prompter Prompter, max int, dryRun bool) error {
+	entries := manifest.Entries()
+	if len(entries) == 0 {
+		fmt.Println("No staged files to delete")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Println("Delete staged", e)
+	}
+	if max > 0 && len(entries) > max {
+		return fmt.Errorf("Refusing to delete %d staged files, more than the limit of %d", len(entries), max)
+	}
+	if !prompter.Confirm(fmt.Sprintf("Delete the %d staged files listed above?", len(entries)), false) {
+		return nil
+	}
+	_, err := manifest.Purge(entries, dryRun)
+	if saveErr := manifest.Save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
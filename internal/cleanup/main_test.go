@@ -0,0 +1,317 @@
+package cleanup
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/archive"
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/staging"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+// answers confirms each step with the next answer, failing the test if asked too often
+type answers struct {
+	t       *testing.T
+	answers []bool
+	asked   []string
+}
+
+func (a *answers) Confirm(label string, defaultChoice bool) bool {
+	a.asked = append(a.asked, label)
+	if len(a.answers) == 0 {
+		a.t.Fatalf("Unexpected question %s", label)
+	}
+	answer := a.answers[0]
+	a.answers = a.answers[1:]
+	return answer
+}
+
+// newTree has a raw and xmp whose jpg was deleted, a virtual copy whose jpg was
+// deleted, and an image with its jpg
+func newTree(t *testing.T) (string, Plan) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "a/A.ARW", "a/A.ARW.xmp", "a/B.ARW", "a/B.ARW.xmp", "a/B_01.ARW.xmp")
+	testutil.WriteTree(t, dst, "a/B.jpg")
+	raws, xmps, _, err := linkedimage.FindImages(src, dst, []string{".ARW"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, NewPlan(raws, xmps)
+}
+
+func TestNewPlan(t *testing.T) {
+	src, plan := newTree(t)
+	var got []string
+	for _, item := range plan.Items {
+		rel, _ := filepath.Rel(src, item.Path)
+		got = append(got, item.Kind+" "+filepath.ToSlash(rel)+" "+item.Reason)
+	}
+	want := []string{
+		"raw a/A.ARW no jpg",
+		"xmp a/A.ARW.xmp raw deleted",
+		"xmp a/B_01.ARW.xmp no jpg",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got plan %q, want %q", got, want)
+	}
+
+	var out bytes.Buffer
+	if err := plan.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Items) != 3 || decoded.Items[0].Kind != KindRaw || decoded.Items[0].Path != plan.Items[0].Path {
+		t.Errorf("got json plan %s", out.String())
+	}
+
+	if err := plan.CheckLimit(3); err != nil {
+		t.Errorf("Plan within the limit should pass, got %v", err)
+	}
+	if err := plan.CheckLimit(2); err == nil {
+		t.Errorf("Expected error for a plan over the limit")
+	}
+}
+
+func TestNewPlanKeepsAmbiguousSidecars(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	// An Adobe style sidecar shared by raws with the same basename, only one of them exported
+	testutil.WriteTree(t, src, "a/IMG.ARW", "a/IMG.CR2", "a/IMG.xmp")
+	testutil.WriteTree(t, dst, "a/IMG.ARW.jpg")
+	raws, xmps, _, err := linkedimage.FindImages(src, dst, []string{".ARW", ".CR2"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range NewPlan(raws, xmps).Items {
+		rel, _ := filepath.Rel(src, item.Path)
+		got = append(got, item.Kind+" "+filepath.ToSlash(rel)+" "+item.Reason)
+	}
+	want := []string{"raw a/IMG.CR2 no jpg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got plan %q, want %q", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var tests = []struct {
+		name      string
+		answers   []bool
+		opts      Options
+		original  bool // Files still at their original paths
+		staged    bool // Files in the staging directory
+		manifest  int  // Entries left in the manifest
+		removed   int  // Files gone for good
+		questions int
+	}{
+		{"declined", []bool{false, false}, Options{}, true, false, 0, 0, 2},
+		{"stage and delete", []bool{true, true}, Options{}, false, false, 0, 3, 2},
+		{"stage only", []bool{true}, Options{StageOnly: true}, false, true, 3, 0, 1},
+		{"delete without staging", []bool{false, true}, Options{}, false, false, 0, 3, 2},
+		{"dry run", []bool{true, true}, Options{DryRun: true}, true, false, 0, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, plan := newTree(t)
+			manifest, err := staging.Load(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prompter := &answers{t: t, answers: tt.answers}
+			if err := Run(plan, manifest, prompter, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(prompter.asked) != tt.questions {
+				t.Errorf("got questions %q", prompter.asked)
+			}
+			for _, rel := range []string{"a/A.ARW", "a/A.ARW.xmp", "a/B_01.ARW.xmp"} {
+				if got := testutil.Exists(filepath.Join(src, rel)); got != tt.original {
+					t.Errorf("%s exists %v, want %v", rel, got, tt.original)
+				}
+				if got := testutil.Exists(filepath.Join(src, staging.Dir, rel)); got != tt.staged {
+					t.Errorf("%s staged %v, want %v", rel, got, tt.staged)
+				}
+			}
+			if !testutil.Exists(filepath.Join(src, "a/B.ARW")) || !testutil.Exists(filepath.Join(src, "a/B.ARW.xmp")) {
+				t.Errorf("Files with a jpg should be kept")
+			}
+			reloaded, err := staging.Load(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(reloaded.Entries()); got != tt.manifest {
+				t.Errorf("got %d manifest entries, want %d", got, tt.manifest)
+			}
+			if got := plan.Removed(reloaded); len(got) != tt.removed {
+				t.Errorf("got removed %q, want %d files", got, tt.removed)
+			}
+		})
+	}
+}
+
+func TestRunArchive(t *testing.T) {
+	src, plan := newTree(t)
+	manifest, err := staging.Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "archive")
+	a, err := archive.Open(dir, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompter := &answers{t: t, answers: []bool{true}}
+	if err := Run(plan, manifest, prompter, Options{Archive: a}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"a/A.ARW", "a/A.ARW.xmp", "a/B_01.ARW.xmp"} {
+		if testutil.Exists(filepath.Join(src, rel)) || !testutil.Exists(filepath.Join(dir, rel)) {
+			t.Errorf("%s should be moved to the archive", rel)
+		}
+	}
+	if len(manifest.Entries()) != 0 {
+		t.Errorf("Archived files should not be staged")
+	}
+	reopened, err := archive.Open(dir, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := reopened.Search(nil); len(found) != 3 {
+		t.Errorf("got %d archived files, want 3", len(found))
+	}
+}
+
+func TestDeleteStaged(t *testing.T) {
+	src, plan := newTree(t)
+	manifest, err := staging.Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(plan, manifest, Always(true), Options{StageOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteStaged(manifest, Always(true), 2, false); err == nil {
+		t.Errorf("Expected error deleting more staged files than the limit")
+	}
+	if err := DeleteStaged(manifest, &answers{t: t, answers: []bool{false}}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries()) != 3 {
+		t.Errorf("Nothing should be deleted when declined")
+	}
+	if err := DeleteStaged(manifest, Always(true), 3, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries()) != 0 || testutil.Exists(filepath.Join(src, staging.Dir, "a")) {
+		t.Errorf("Staged files should be deleted")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	var out bytes.Buffer
+	// Answers piped in ahead, with an invalid answer that is asked again
+	terminal := NewTerminal(strings.NewReader("y\nmaybe\nno\n\n"), &out)
+	var tests = []struct {
+		defaultChoice bool
+		want          bool
+	}{
+		{false, true},
+		{true, false},
+		{true, true},
+		// No more input
+		{false, false},
+	}
+	for _, tt := range tests {
+		if got := terminal.Confirm("Continue?", tt.defaultChoice); got != tt.want {
+			t.Errorf("got %v, want %v", got, tt.want)
+		}
+	}
+	if got := strings.Count(out.String(), "Continue?"); got != 5 {
+		t.Errorf("Asked %d times, want 5: %s", got, out.String())
+	}
+}
+
+func TestApplyGrace(t *testing.T) {
+	src, plan := newTree(t)
+	missing, err := LoadMissing(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := 24 * time.Hour
+	first := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Everything is new, so held back
+	held := plan.ApplyGrace(missing, 7*day, first)
+	if len(held.Items) != 0 || len(held.Waiting) != 3 {
+		t.Fatalf("got %d items and %d waiting, want all 3 waiting", len(held.Items), len(held.Waiting))
+	}
+	if until := held.Waiting[0].Until; until == nil || !until.Equal(first.Add(7*day)) {
+		t.Errorf("got until %v", until)
+	}
+	if err := missing.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The virtual copy went missing later, and A's jpg was exported again
+	missing, err = LoadMissing(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing.firstSeen["a/B_01.ARW.xmp"] = first.Add(5 * day)
+	missing.firstSeen["a/A.ARW.xmp"] = first.Add(-30 * day)
+	// Outside the scan, so kept even though it isn't in the plan
+	missing.firstSeen["other/C.ARW"] = first
+	testutil.WriteTree(t, src, "other/C.ARW")
+	ready := plan.ApplyGrace(missing, 7*day, first.Add(8*day))
+	var got []string
+	for _, item := range ready.Items {
+		got = append(got, filepath.Base(item.Path))
+	}
+	if want := []string{"A.ARW", "A.ARW.xmp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got ready %q, want %q", got, want)
+	}
+	if len(ready.Waiting) != 1 || filepath.Base(ready.Waiting[0].Path) != "B_01.ARW.xmp" {
+		t.Errorf("got waiting %v", ready.Waiting)
+	}
+	if !ready.Items[1].FirstSeen.Equal(first.Add(-30 * day)) {
+		t.Errorf("got first seen %v", ready.Items[1].FirstSeen)
+	}
+	if _, ok := missing.firstSeen["other/C.ARW"]; !ok {
+		t.Errorf("Files outside the scan should be kept")
+	}
+
+	// Once the jpg is back the raw is forgotten
+	missing.firstSeen["a/B.ARW"] = first
+	plan.ApplyGrace(missing, 7*day, first.Add(8*day))
+	if _, ok := missing.firstSeen["a/B.ARW"]; ok {
+		t.Errorf("Files with a jpg should be forgotten")
+	}
+}
+
+func TestApplyGraceHoldsXmpsOfRaw(t *testing.T) {
+	src, plan := newTree(t)
+	missing, err := LoadMissing(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// The xmp has been missing its jpg for long, but its raw only just lost its jpg
+	missing.firstSeen["a/A.ARW.xmp"] = now.Add(-30 * 24 * time.Hour)
+	held := plan.ApplyGrace(missing, 24*time.Hour, now)
+	for _, item := range held.Items {
+		if filepath.Base(item.Path) == "A.ARW.xmp" {
+			t.Errorf("The xmp of a raw held back should be held back too")
+		}
+	}
+}
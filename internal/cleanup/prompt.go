@@ -0,0 +1,56 @@
+package cleanup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Prompter confirms each step of a clean
+type Prompter interface {
+	Confirm(label string, defaultChoice bool) bool
+}
+
+// Terminal asks yes/no questions, one answer per line
+type Terminal struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// NewTerminal asks questions on out, reading the answers from in
+// The reader is kept between questions, so answers piped in ahead aren't lost
+func NewTerminal(in io.Reader, out io.Writer) *Terminal {
+	return &Terminal{in: bufio.NewReader(in), out: out}
+}
+
+// Confirm asks until the answer is yes or no, or empty for the default choice
+// The default is also taken once there is no more input
+func (t *Terminal) Confirm(label string, defaultChoice bool) bool {
+	choices := "Y/n"
+	if !defaultChoice {
+		choices = "y/N"
+	}
+	for {
+		fmt.Fprintf(t.out, "%s (%s) ", label, choices)
+		s, err := t.in.ReadString('\n')
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "y" || s == "yes" {
+			return true
+		}
+		if s == "n" || s == "no" {
+			return false
+		}
+		if s == "" || err != nil {
+			return defaultChoice
+		}
+	}
+}
+
+// Always answers every question the same way, e.g. for --yes
+type Always bool
+
+// Confirm returns the answer, without asking
+func (a Always) Confirm(label string, defaultChoice bool) bool {
+	return bool(a)
+}
@@ -0,0 +1,111 @@
+package cleanup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/xmpmeta"
+)
+
+// Protection keeps images that were rated, tagged or labelled in darktable, even once
+// their jpg is deleted
+type Protection struct {
+	MinRating int      // Protect images rated at least this. 0 to disable
+	Tags      []string // Protect images with any of these tags, or a tag under one of them
+	Labels    []string // Protect images with any of these color labels
+}
+
+// NewProtection checks the protection settings
+func NewProtection(minRating int, tags, labels []string) (Protection, error) {
+	if minRating < 0 || minRating > 5 {
+		return Protection{}, fmt.Errorf("Protected rating %d should be between 1 and 5, or 0 to disable", minRating)
+	}
+	for i, label := range labels {
+		labels[i] = strings.ToLower(label)
+		if !xmpmeta.IsColorLabel(labels[i]) {
+			return Protection{}, fmt.Errorf("Unknown color label '%s', expected red, yellow, green, blue or purple", label)
+		}
+	}
+	return Protection{MinRating: minRating, Tags: tags, Labels: labels}, nil
+}
+
+// IsZero checks whether nothing is protected
+func (p Protection) IsZero() bool {
+	return p.MinRating == 0 && len(p.Tags) == 0 && len(p.Labels) == 0
+}
+
+// check gets why the xmp is protected, or "" if it isn't
+// An xmp that can't be read is protected, as it may be rated
+func (p Protection) check(xmp *linkedimage.Xmp) string {
+	meta, err := xmp.Metadata()
+	if err != nil {
+		return fmt.Sprintf("unreadable %s: %v", xmp.GetPath(), err)
+	}
+	if rating, ok := meta.Rating(); ok && p.MinRating > 0 && rating >= p.MinRating {
+		return fmt.Sprintf("rated %d", rating)
+	}
+	for _, tag := range meta.Tags() {
+		for _, protected := range p.Tags {
+			if strings.EqualFold(tag, protected) || strings.HasPrefix(strings.ToLower(tag), strings.ToLower(protected)+"|") {
+				return fmt.Sprintf("tagged %s", tag)
+			}
+		}
+	}
+	for _, label := range meta.ColorLabels() {
+		for _, protected := range p.Labels {
+			if label == protected {
+				return fmt.Sprintf("labelled %s", label)
+			}
+		}
+	}
+	return ""
+}
+
+// Protect moves the items of protected images out of the plan
+// A raw is protected if any of its xmps is, and then its xmps are kept with it
+func (p Plan) Protect(protection Protection) Plan {
+	if protection.IsZero() {
+		return p
+	}
+	protectedRaws := make(map[string]string)
+	var items []Item
+	for _, item := range p.Items {
+		var why string
+		if item.raw != nil {
+			for _, xmp := range rawXmps(item.raw) {
+				if why = protection.check(xmp); why != "" {
+					protectedRaws[item.Path] = why
+					break
+				}
+			}
+		} else {
+			if item.xmp.Raw != nil {
+				why = protectedRaws[item.xmp.Raw.GetPath()]
+			}
+			if why == "" {
+				why = protection.check(item.xmp)
+			}
+		}
+		if why == "" {
+			items = append(items, item)
+			continue
+		}
+		item.ProtectedBy = why
+		p.Protected = append(p.Protected, item)
+	}
+	p.Items = items
+	return p
+}
+
+// rawXmps lists the xmps of a raw, including sidecars of the other convention, sorted by path
+func rawXmps(raw *linkedimage.Raw) []*linkedimage.Xmp {
+	var xmps []*linkedimage.Xmp
+	for _, xmp := range raw.Xmps {
+		xmps = append(xmps, xmp)
+	}
+	xmps = append(xmps, raw.IgnoredXmps...)
+	sort.Slice(xmps, func(i, j int) bool { return xmps[i].GetPath() < xmps[j].GetPath() })
+	return xmps
+}
@@ -0,0 +1,117 @@
+package cleanup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/linkedimage"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+// writeXmp writes a darktable style sidecar with a rating, tags and color labels
+func writeXmp(t *testing.T, path string, rating int, tag string, label int) {
+	t.Helper()
+	content := fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:darktable="http://darktable.sf.net/"
+   xmp:Rating="%d">
+   <dc:subject><rdf:Bag><rdf:li>%s</rdf:li></rdf:Bag></dc:subject>
+   <darktable:colorlabels><rdf:Seq><rdf:li>%d</rdf:li></rdf:Seq></darktable:colorlabels>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`, rating, tag, label)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "Rated.ARW", "Copy.ARW", "Tagged.ARW", "Labelled.ARW", "Plain.ARW", "Unreadable.ARW")
+	writeXmp(t, filepath.Join(src, "Rated.ARW.xmp"), 4, "trip", 4)
+	// Only the virtual copy is rated, which protects the raw too
+	writeXmp(t, filepath.Join(src, "Copy.ARW.xmp"), 1, "trip", 4)
+	writeXmp(t, filepath.Join(src, "Copy_01.ARW.xmp"), 5, "trip", 4)
+	writeXmp(t, filepath.Join(src, "Tagged.ARW.xmp"), 1, "keep|portfolio", 4)
+	writeXmp(t, filepath.Join(src, "Labelled.ARW.xmp"), 1, "trip", 0)
+	writeXmp(t, filepath.Join(src, "Plain.ARW.xmp"), 3, "keeper", 1)
+	if err := os.WriteFile(filepath.Join(src, "Unreadable.ARW.xmp"), []byte("<x:xmpmeta><rdf:RDF>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A virtual copy whose jpg was deleted, rated on its own
+	testutil.WriteTree(t, src, "Kept.ARW")
+	testutil.WriteTree(t, dst, "Kept.jpg")
+	writeXmp(t, filepath.Join(src, "Kept_01.ARW.xmp"), 4, "", 4)
+
+	protection, err := NewProtection(4, []string{"keep"}, []string{"Red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raws, xmps, _, err := linkedimage.FindImages(src, dst, []string{".ARW"}, linkedimage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := NewPlan(raws, xmps).Protect(protection)
+	names := func(items []Item) []string {
+		var names []string
+		for _, item := range items {
+			names = append(names, filepath.Base(item.Path))
+		}
+		return names
+	}
+	if got, want := names(plan.Items), []string{"Plain.ARW", "Plain.ARW.xmp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %q, want %q", got, want)
+	}
+	want := map[string]string{
+		"Copy.ARW":           "rated 5",
+		"Copy.ARW.xmp":       "rated 5",
+		"Copy_01.ARW.xmp":    "rated 5",
+		"Kept_01.ARW.xmp":    "rated 4",
+		"Labelled.ARW":       "labelled red",
+		"Labelled.ARW.xmp":   "labelled red",
+		"Rated.ARW":          "rated 4",
+		"Rated.ARW.xmp":      "rated 4",
+		"Tagged.ARW":         "tagged keep|portfolio",
+		"Tagged.ARW.xmp":     "tagged keep|portfolio",
+		"Unreadable.ARW":     "",
+		"Unreadable.ARW.xmp": "",
+	}
+	got := make(map[string]string)
+	for _, item := range plan.Protected {
+		got[filepath.Base(item.Path)] = item.ProtectedBy
+	}
+	for name, why := range want {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s should be protected", name)
+		} else if why != "" && got[name] != why {
+			t.Errorf("%s protected by %s, want %s", name, got[name], why)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got protected %v", got)
+	}
+}
+
+func TestNewProtection(t *testing.T) {
+	if _, err := NewProtection(6, nil, nil); err == nil {
+		t.Errorf("Expected error for a rating above 5")
+	}
+	if _, err := NewProtection(0, nil, []string{"orange"}); err == nil {
+		t.Errorf("Expected error for an unknown color label")
+	}
+	if p, err := NewProtection(0, nil, nil); err != nil || !p.IsZero() {
+		t.Errorf("got %v %v, want no protection", p, err)
+	}
+}
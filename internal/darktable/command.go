@@ -0,0 +1,251 @@
+package darktable
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Placeholders that may appear in a command template
+const (
+	RawPlaceholder       = "{raw}"       // Full path to raw file
+	XmpPlaceholder       = "{xmp}"       // Full path to xmp. Arguments using it are dropped when exporting without one
+	OutPlaceholder       = "{out}"       // Full path to the (temporary) target jpg
+	ConfigDirPlaceholder = "{configdir}" // Darktable config directory
+)
+
+var placeholders = []string{RawPlaceholder, XmpPlaceholder, OutPlaceholder, ConfigDirPlaceholder}
+
+// Command is a darktable-cli invocation, stored as an argv template
+// If none of {raw}, {xmp} or {out} are used, the raw, optional xmp and target
+// paths are appended in that order, as darktable-cli expects them
+type Command struct {
+	args      []string
+	configDir string
+	templated bool
+}
+
+// ParseCommand builds a Command from a config value, which is either a single
+// string split with shell-like quoting rules, or a list of arguments used as is
+// e.g. "nice -n 19 darktable-cli {raw} {xmp} '{out}' --core --configdir {configdir}"
+// or ["docker", "run", "darktable", "darktable-cli", "{raw}", "{xmp}", "{out}"]
+func ParseCommand(value interface{}, configDir string) (Command, error) {
+	var args []string
+	switch v := value.(type) {
+	case string:
+		split, err := SplitCommand(v)
+		if err != nil {
+			return Command{}, err
+		}
+		args = split
+	case []string:
+		args = v
+	case []interface{}:
+		for _, arg := range v {
+			s, ok := arg.(string)
+			if !ok {
+				return Command{}, fmt.Errorf("Command argument '%v' is not a string", arg)
+			}
+			args = append(args, s)
+		}
+	default:
+		return Command{}, fmt.Errorf("Command must be a string or a list of strings, got %T", value)
+	}
+	if len(args) == 0 {
+		return Command{}, errors.New("Command is empty")
+	}
+	if strings.Contains(args[0], "{") {
+		return Command{}, fmt.Errorf("Command binary '%s' cannot be a placeholder", args[0])
+	}
+	cmd := Command{args: args, configDir: configDir}
+	for _, arg := range args {
+		used, err := findPlaceholders(arg)
+		if err != nil {
+			return Command{}, err
+		}
+		for _, p := range used {
+			switch p {
+			case RawPlaceholder, XmpPlaceholder, OutPlaceholder:
+				cmd.templated = true
+			case ConfigDirPlaceholder:
+				if configDir == "" {
+					return Command{}, fmt.Errorf("Command uses %s but no darktable config directory is set", ConfigDirPlaceholder)
+				}
+			}
+		}
+	}
+	if cmd.templated && !cmd.uses(RawPlaceholder) {
+		return Command{}, fmt.Errorf("Command uses placeholders but is missing %s", RawPlaceholder)
+	}
+	if cmd.templated && !cmd.uses(OutPlaceholder) {
+		return Command{}, fmt.Errorf("Command uses placeholders but is missing %s", OutPlaceholder)
+	}
+	// Virtual copies would be exported without their edits
+	if cmd.templated && !cmd.uses(XmpPlaceholder) {
+		return Command{}, fmt.Errorf("Command uses placeholders but is missing %s, so edits wouldn't be exported", XmpPlaceholder)
+	}
+	return cmd, nil
+}
+
+// Argv returns the arguments to run for a single export
+func (c Command) Argv(rawPath, xmpPath, outPath string) []string {
+	values := map[string]string{
+		RawPlaceholder:       rawPath,
+		XmpPlaceholder:       xmpPath,
+		OutPlaceholder:       outPath,
+		ConfigDirPlaceholder: c.configDir,
+	}
+	var argv []string
+	for _, arg := range c.args {
+		// {xmp} is optional, e.g. a lone positional argument or --xmp={xmp}
+		if xmpPath == "" && usesPlaceholder(arg, XmpPlaceholder) {
+			continue
+		}
+		argv = append(argv, expand(arg, values))
+	}
+	if !c.templated {
+		argv = append(argv, rawPath)
+		if xmpPath != "" {
+			argv = append(argv, xmpPath)
+		}
+		argv = append(argv, outPath)
+	}
+	return argv
+}
+
+func (c Command) String() string {
+	return strings.Join(c.args, " ")
+}
+
+func (c Command) uses(placeholder string) bool {
+	for _, arg := range c.args {
+		if usesPlaceholder(arg, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// usesPlaceholder checks whether an argument that has already been validated uses the
+// placeholder, not counting escaped braces
+func usesPlaceholder(arg, placeholder string) bool {
+	found, _ := findPlaceholders(arg)
+	for _, p := range found {
+		if p == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// findPlaceholders lists the placeholders in an argument, rejecting unknown ones
+// Literal braces are written as {{ and }}
+func findPlaceholders(arg string) ([]string, error) {
+	var found []string
+	for i := 0; i < len(arg); i++ {
+		switch {
+		case strings.HasPrefix(arg[i:], "{{"), strings.HasPrefix(arg[i:], "}}"):
+			i++
+		case arg[i] == '{':
+			end := strings.IndexByte(arg[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated placeholder in command argument '%s'", arg)
+			}
+			p := arg[i : i+end+1]
+			if !isPlaceholder(p) {
+				return nil, fmt.Errorf("Unknown placeholder %s in command argument '%s', expected one of %v", p, arg, placeholders)
+			}
+			found = append(found, p)
+			i += end
+		case arg[i] == '}':
+			return nil, fmt.Errorf("Unmatched '}' in command argument '%s'", arg)
+		}
+	}
+	return found, nil
+}
+
+func isPlaceholder(s string) bool {
+	for _, p := range placeholders {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
+
+// expand substitutes placeholders in an argument that has already been validated
+func expand(arg string, values map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		switch {
+		case strings.HasPrefix(arg[i:], "{{"):
+			b.WriteByte('{')
+			i++
+		case strings.HasPrefix(arg[i:], "}}"):
+			b.WriteByte('}')
+			i++
+		case arg[i] == '{':
+			end := strings.IndexByte(arg[i:], '}')
+			b.WriteString(values[arg[i:i+end+1]])
+			i += end
+		default:
+			b.WriteByte(arg[i])
+		}
+	}
+	return b.String()
+}
+
+// SplitCommand splits a command line into arguments
+// Whitespace separates arguments unless quoted. Single quotes preserve everything
+// literally, double quotes allow backslash escapes of '"' and '\', and an unquoted
+// backslash escapes the next character
+func SplitCommand(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated single quote in command '%s'", s)
+			}
+			current.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				current.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("Unterminated double quote in command '%s'", s)
+			}
+			inArg = true
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("Trailing backslash in command '%s'", s)
+			}
+			i++
+			current.WriteByte(s[i])
+			inArg = true
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,113 @@
+package darktable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	var tests = []struct {
+		command string
+		want    []string
+	}{
+		{"darktable-cli", []string{"darktable-cli"}},
+		{"flatpak run --command=darktable-cli org.darktable.Darktable", []string{"flatpak", "run", "--command=darktable-cli", "org.darktable.Darktable"}},
+		{"  nice -n 19   ionice -c3 darktable-cli ", []string{"nice", "-n", "19", "ionice", "-c3", "darktable-cli"}},
+		{"'/opt/dark table/bin/darktable-cli' {raw}", []string{"/opt/dark table/bin/darktable-cli", "{raw}"}},
+		{`"/opt/dark table/darktable-cli" "a \"quoted\" \\ arg"`, []string{"/opt/dark table/darktable-cli", `a "quoted" \ arg`}},
+		{`/opt/dark\ table/darktable-cli`, []string{"/opt/dark table/darktable-cli"}},
+		{`--core --conf 'plugins/imageio/format/jpeg/quality=95'`, []string{"--core", "--conf", "plugins/imageio/format/jpeg/quality=95"}},
+		{`a''b ""`, []string{"ab", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, err := SplitCommand(tt.command)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCommandErrors(t *testing.T) {
+	for _, command := range []string{`'unterminated`, `"unterminated`, `trailing\`} {
+		t.Run(command, func(t *testing.T) {
+			if _, err := SplitCommand(command); err == nil {
+				t.Errorf("Expected error splitting %s", command)
+			}
+		})
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	var tests = []struct {
+		name      string
+		value     interface{}
+		configDir string
+		wantErr   bool
+	}{
+		{"string without placeholders", "darktable-cli", "", false},
+		{"string with placeholders", "darktable-cli {raw} {xmp} {out}", "", false},
+		{"list", []interface{}{"darktable-cli", "{raw}", "{xmp}", "{out}"}, "", false},
+		{"string list", []string{"darktable-cli", "{raw}", "{xmp}", "{out}"}, "", false},
+		{"configdir set", "darktable-cli --core --configdir {configdir}", "/config", false},
+		{"escaped braces", "docker ps --format {{.ID}}", "", false},
+		{"configdir missing", "darktable-cli --core --configdir {configdir}", "", true},
+		{"unknown placeholder", "darktable-cli {raw} {jpg}", "", true},
+		{"missing raw", "darktable-cli {xmp} {out}", "", true},
+		{"missing out", "darktable-cli {raw} {xmp}", "", true},
+		{"missing xmp", "darktable-cli {raw} {out}", "", true},
+		{"escaped xmp", "darktable-cli {raw} {{xmp}} {out}", "", true},
+		{"placeholder binary", "{raw} {out}", "", true},
+		{"unterminated placeholder", "darktable-cli {raw} {out", "", true},
+		{"empty", "", "", true},
+		{"empty list", []interface{}{}, "", true},
+		{"not a string", []interface{}{"darktable-cli", 3}, "", true},
+		{"wrong type", 3, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCommand(tt.value, tt.configDir)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wanted error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCommandArgv(t *testing.T) {
+	var tests = []struct {
+		value   interface{}
+		rawPath string
+		xmpPath string
+		want    []string
+	}{
+		{"darktable-cli", "/src/a b.ARW", "/src/a b.ARW.xmp", []string{"darktable-cli", "/src/a b.ARW", "/src/a b.ARW.xmp", "/dst/a b.jpg"}},
+		{"darktable-cli", "/src/a.ARW", "", []string{"darktable-cli", "/src/a.ARW", "/dst/a b.jpg"}},
+		{"nice -n 19 darktable-cli {raw} {xmp} {out} --core --configdir {configdir}", "/src/a.ARW", "/src/a.ARW.xmp", []string{"nice", "-n", "19", "darktable-cli", "/src/a.ARW", "/src/a.ARW.xmp", "/dst/a b.jpg", "--core", "--configdir", "/config dir"}},
+		{"darktable-cli {raw} {xmp} {out}", "/src/a.ARW", "", []string{"darktable-cli", "/src/a.ARW", "/dst/a b.jpg"}},
+		{[]interface{}{"docker", "run", "-v", "{raw}:/in.ARW", "dt", "{raw}", "{xmp}", "{out}"}, "/src/a.ARW", "", []string{"docker", "run", "-v", "/src/a.ARW:/in.ARW", "dt", "/src/a.ARW", "/dst/a b.jpg"}},
+		{"sh -c {{}} {raw} {xmp} {out}", "/src/a.ARW", "", []string{"sh", "-c", "{}", "/src/a.ARW", "/dst/a b.jpg"}},
+		// Arguments embedding {xmp} are dropped rather than left empty
+		{"dt --raw={raw} --xmp={xmp} {out}", "/src/a.ARW", "/src/a.ARW.xmp", []string{"dt", "--raw=/src/a.ARW", "--xmp=/src/a.ARW.xmp", "/dst/a b.jpg"}},
+		{"dt --raw={raw} --xmp={xmp} {out}", "/src/a.ARW", "", []string{"dt", "--raw=/src/a.ARW", "/dst/a b.jpg"}},
+		{"dt {raw} --label={{xmp}} {xmp} {out}", "/src/a.ARW", "", []string{"dt", "/src/a.ARW", "--label={xmp}", "/dst/a b.jpg"}},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%v:%s", tt.value, tt.xmpPath)
+		t.Run(testname, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.value, "/config dir")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			got := cmd.Argv(tt.rawPath, tt.xmpPath, "/dst/a b.jpg")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
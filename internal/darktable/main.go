@@ -5,16 +5,15 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
 )
 
 type ExportParams struct {
-	Command    string // Darktable binary
-	RawPath    string // Full path to raw file
-	XmpPath    string // Full path to xmp (optional)
-	OutputPath string // Full path to target jpg
-	OnlyNew    bool   // Only export if target doesn't exist, no replace
-	DryRun     bool   // Show actions that would be performed, but don't do them
+	Command    Command // Darktable command template
+	RawPath    string  // Full path to raw file
+	XmpPath    string  // Full path to xmp (optional)
+	OutputPath string  // Full path to target jpg
+	OnlyNew    bool    // Only export if target doesn't exist, no replace
+	DryRun     bool    // Show actions that would be performed, but don't do them
 }
 
 func Export(params ExportParams) error {
@@ -28,13 +27,8 @@ func Export(params ExportParams) error {
 			return e
 		}
 	}
-	args := strings.Fields(params.Command)
-	args = append(args, params.RawPath)
-	if params.XmpPath != "" {
-		args = append(args, params.XmpPath)
-	}
 	tmpPath := fmt.Sprintf("%s.tmp.jpg", params.OutputPath)
-	args = append(args, tmpPath)
+	args := params.Command.Argv(params.RawPath, params.XmpPath, tmpPath)
 	err := runCmd(args, params.DryRun, true)
 	if err != nil {
 		return err
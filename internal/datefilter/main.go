@@ -0,0 +1,132 @@
+// Package datefilter selects images by capture or modification time
+package datefilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field is the time that --since and --until are compared against
+type Field string
+
+const (
+	Capture  Field = "capture"  // exif:DateTimeOriginal from the xmp
+	Modified Field = "modified" // Modification time of the xmp file, or darktable's change time from its library
+)
+
+// Filter keeps images within a date range and/or recently modified
+// The zero value keeps everything
+type Filter struct {
+	Since          time.Time     // Inclusive, ignored if zero
+	Until          time.Time     // Exclusive, ignored if zero
+	ModifiedWithin time.Duration // Ignored if zero
+	Field          Field
+	Now            time.Time
+}
+
+// New parses the filter settings. Dates are YYYY-MM-DD, optionally followed by
+// a time, and a date without a time for until includes that whole day
+func New(since, until, modifiedWithin, field string, now time.Time) (Filter, error) {
+	f := Filter{Field: Field(field), Now: now}
+	if f.Field == "" {
+		f.Field = Capture
+	}
+	if f.Field != Capture && f.Field != Modified {
+		return Filter{}, fmt.Errorf("Unknown date field '%s', expected '%s' or '%s'", field, Capture, Modified)
+	}
+	var err error
+	if since != "" {
+		if f.Since, _, err = parseDate(since); err != nil {
+			return Filter{}, fmt.Errorf("Invalid since date: %w", err)
+		}
+	}
+	if until != "" {
+		var dateOnly bool
+		if f.Until, dateOnly, err = parseDate(until); err != nil {
+			return Filter{}, fmt.Errorf("Invalid until date: %w", err)
+		}
+		if dateOnly {
+			f.Until = f.Until.AddDate(0, 0, 1)
+		}
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return Filter{}, fmt.Errorf("Since date '%s' is not before until date '%s'", since, until)
+	}
+	if modifiedWithin != "" {
+		if f.ModifiedWithin, err = ParseDuration(modifiedWithin); err != nil {
+			return Filter{}, fmt.Errorf("Invalid modified-within duration: %w", err)
+		}
+		if f.ModifiedWithin <= 0 {
+			return Filter{}, fmt.Errorf("Modified-within duration '%s' must be positive", modifiedWithin)
+		}
+	}
+	return f, nil
+}
+
+// IsZero checks whether the filter keeps everything
+func (f Filter) IsZero() bool {
+	return f.Since.IsZero() && f.Until.IsZero() && f.ModifiedWithin == 0
+}
+
+// Matches checks an image's times. captured may be zero when unknown, in which
+// case the modification time is used instead
+func (f Filter) Matches(captured, modified time.Time) bool {
+	if f.ModifiedWithin > 0 && modified.Before(f.Now.Add(-f.ModifiedWithin)) {
+		return false
+	}
+	t := modified
+	if f.Field == Capture && !captured.IsZero() {
+		t = captured
+	}
+	if !f.Since.IsZero() && t.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !t.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// NeedsCapture checks whether Matches uses the capture time, which costs a read of the xmp
+func (f Filter) NeedsCapture() bool {
+	return f.Field == Capture && (!f.Since.IsZero() || !f.Until.IsZero())
+}
+
+var dateLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+func parseDate(s string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("'%s' is not a date, expected YYYY-MM-DD or YYYY-MM-DD HH:MM", s)
+}
+
+// ParseDuration extends time.ParseDuration with days (d) and weeks (w), e.g. "48h", "7d" or "2w"
+func ParseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("'%s' is not a duration", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a duration, expected e.g. 48h, 7d or 2w", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,96 @@
+package datefilter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want time.Duration
+	}{
+		{"48h", 48 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"7d", 7 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseDuration(tt.s)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+	for _, s := range []string{"", "d", "soon", "3y"} {
+		t.Run(s, func(t *testing.T) {
+			if _, err := ParseDuration(s); err == nil {
+				t.Errorf("Expected error parsing '%s'", s)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	var tests = []struct {
+		since, until, within, field string
+	}{
+		{"2024-13-01", "", "", ""},
+		{"", "tomorrow", "", ""},
+		{"2024-05-02", "2024-05-01", "", ""},
+		{"", "", "soon", ""},
+		{"", "", "-2h", ""},
+		{"", "", "", "exported"},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s..%s,%s,%s", tt.since, tt.until, tt.within, tt.field)
+		t.Run(testname, func(t *testing.T) {
+			if _, err := New(tt.since, tt.until, tt.within, tt.field, time.Now()); err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.Local)
+	day := func(d int, h int) time.Time { return time.Date(2024, 5, d, h, 0, 0, 0, time.Local) }
+	var tests = []struct {
+		name     string
+		since    string
+		until    string
+		within   string
+		field    string
+		captured time.Time
+		modified time.Time
+		want     bool
+	}{
+		{"no filter", "", "", "", "", day(1, 0), day(1, 0), true},
+		{"captured in range", "2024-05-17", "2024-05-19", "", "", day(19, 23), day(20, 0), true},
+		{"captured before range", "2024-05-17", "2024-05-19", "", "", day(16, 23), day(18, 0), false},
+		{"captured after range", "2024-05-17", "2024-05-19", "", "", day(20, 0), day(18, 0), false},
+		{"since is inclusive", "2024-05-17", "", "", "", day(17, 0), day(1, 0), true},
+		{"until with time is exclusive", "", "2024-05-17 12:00", "", "", day(17, 12), day(1, 0), false},
+		{"capture unknown uses modified", "2024-05-17", "", "", "capture", time.Time{}, day(18, 0), true},
+		{"modified in range", "2024-05-17", "", "", "modified", day(1, 0), day(18, 0), true},
+		{"modified out of range", "2024-05-17", "", "", "modified", day(18, 0), day(1, 0), false},
+		{"modified within", "", "", "48h", "", day(1, 0), day(19, 0), true},
+		{"not modified within", "", "", "48h", "", day(19, 0), day(18, 11), false},
+		{"modified within and captured in range", "2024-05-01", "2024-05-02", "2d", "", day(1, 0), day(19, 0), true},
+		{"modified within but captured out of range", "2024-05-01", "2024-05-02", "2d", "", day(3, 0), day(19, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.since, tt.until, tt.within, tt.field, now)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := f.Matches(tt.captured, tt.modified); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
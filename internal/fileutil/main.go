@@ -0,0 +1,31 @@
+// Package fileutil has file helpers shared by the packages that keep state on disk
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic replaces the file at path with content, creating its directory if needed
+// The content is written to a temporary file next to it first, so readers, or a run
+// interrupted while writing, never see a partial file. Concurrent writers each use their
+// own temporary file, and the last rename wins
+func WriteAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,58 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	var tests = []struct {
+		name     string
+		existing string // Content of the file before writing, if any
+	}{
+		{"new file", ""},
+		{"replaces file", "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "state")
+			path := filepath.Join(dir, "state.json")
+			if tt.existing != "" {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := WriteAtomic(path, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil || string(content) != "new" {
+				t.Errorf("got %q, %v, want %q", content, err, "new")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 1 {
+				t.Errorf("Expected only the file to be left in %s, got %v, %v", dir, entries, err)
+			}
+		})
+	}
+}
+
+func TestWriteAtomicFails(t *testing.T) {
+	dir := t.TempDir()
+	// A directory in the way of the file makes the rename fail
+	path := filepath.Join(dir, "state.json")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAtomic(path, []byte("new")); err == nil {
+		t.Errorf("Expected error replacing a directory")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected the temporary file to be removed, got %v, %v", entries, err)
+	}
+}
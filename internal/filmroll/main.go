@@ -0,0 +1,174 @@
+// Package filmroll selects subsets of the source tree by film roll
+// A film roll is a single directory of images, as imported into darktable
+package filmroll
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Roll names commonly start with the import date, e.g. "2022-05-14 Weekend" or "20220514_weekend"
+var rollDateExp = regexp.MustCompile(`^(\d{4})-?(\d{2})-?(\d{2})`)
+
+type Selector interface {
+	// Matches checks whether the directory, relative to the source dir, is a selected film roll
+	Matches(relativeDir string) bool
+	String() string
+}
+
+// nameSelector matches the last element of the film roll directory against a glob
+type nameSelector struct {
+	pattern string
+}
+
+func (s nameSelector) Matches(relativeDir string) bool {
+	if relativeDir == "." {
+		return false
+	}
+	matched, _ := path.Match(s.pattern, filepath.Base(relativeDir))
+	return matched
+}
+
+func (s nameSelector) String() string {
+	return "name:" + s.pattern
+}
+
+// pathSelector matches a film roll directory and everything below it
+type pathSelector struct {
+	prefix string
+}
+
+func (s pathSelector) Matches(relativeDir string) bool {
+	relativeDir = filepath.ToSlash(relativeDir)
+	return relativeDir == s.prefix || strings.HasPrefix(relativeDir, s.prefix+"/")
+}
+
+func (s pathSelector) String() string {
+	return "path:" + s.prefix
+}
+
+// dateSelector matches film rolls whose name starts with a date in the (inclusive) range
+// A zero from or until leaves that end of the range open
+type dateSelector struct {
+	from  time.Time
+	until time.Time
+}
+
+func (s dateSelector) Matches(relativeDir string) bool {
+	date, ok := RollDate(relativeDir)
+	if !ok {
+		return false
+	}
+	if !s.from.IsZero() && date.Before(s.from) {
+		return false
+	}
+	if !s.until.IsZero() && date.After(s.until) {
+		return false
+	}
+	return true
+}
+
+func (s dateSelector) String() string {
+	var from, until string
+	if !s.from.IsZero() {
+		from = s.from.Format(dateLayout)
+	}
+	if !s.until.IsZero() {
+		until = s.until.Format(dateLayout)
+	}
+	return fmt.Sprintf("date:%s..%s", from, until)
+}
+
+// RollDate parses the date at the start of a film roll's directory name
+func RollDate(relativeDir string) (time.Time, bool) {
+	matches := rollDateExp.FindStringSubmatch(filepath.Base(relativeDir))
+	if matches == nil {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(dateLayout, fmt.Sprintf("%s-%s-%s", matches[1], matches[2], matches[3]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// Parse reads a selector in one of the forms
+// name:<glob> (or just <glob>), e.g. "name:2024-05-1*"
+// path:<prefix>, e.g. "path:2024/weekend"
+// date:<from>..<until>, either of which may be omitted, or date:<day>, e.g. "date:2024-05-17..2024-05-19"
+func Parse(s string) (Selector, error) {
+	kind, value := "name", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, value = s[:i], s[i+1:]
+	}
+	switch kind {
+	case "name":
+		if _, err := path.Match(value, ""); err != nil || value == "" {
+			return nil, fmt.Errorf("Invalid film roll name pattern '%s'", value)
+		}
+		return nameSelector{pattern: value}, nil
+	case "path":
+		prefix := strings.Trim(filepath.ToSlash(filepath.Clean(value)), "/")
+		if prefix == "" || prefix == "." || prefix == ".." || strings.HasPrefix(prefix, "../") {
+			return nil, fmt.Errorf("Invalid film roll path '%s', expected a directory relative to the source dir", value)
+		}
+		return pathSelector{prefix: prefix}, nil
+	case "date":
+		from, until := value, value
+		if i := strings.Index(value, ".."); i >= 0 {
+			from, until = value[:i], value[i+2:]
+		}
+		var s dateSelector
+		var err error
+		if from != "" {
+			if s.from, err = time.Parse(dateLayout, from); err != nil {
+				return nil, fmt.Errorf("Invalid film roll start date '%s', expected YYYY-MM-DD", from)
+			}
+		}
+		if until != "" {
+			if s.until, err = time.Parse(dateLayout, until); err != nil {
+				return nil, fmt.Errorf("Invalid film roll end date '%s', expected YYYY-MM-DD", until)
+			}
+		}
+		if s.from.IsZero() && s.until.IsZero() {
+			return nil, fmt.Errorf("Film roll date range '%s' needs a start or end date", value)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("Unknown film roll selector '%s', expected name:, path: or date:", kind)
+	}
+}
+
+// Selection matches a film roll if any of its selectors do
+// An empty selection matches everything
+type Selection []Selector
+
+func ParseSelection(values []string) (Selection, error) {
+	var selection Selection
+	for _, v := range values {
+		s, err := Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		selection = append(selection, s)
+	}
+	return selection, nil
+}
+
+func (s Selection) Matches(relativeDir string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, selector := range s {
+		if selector.Matches(relativeDir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package filmroll
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectorMatches(t *testing.T) {
+	var tests = []struct {
+		selector    string
+		relativeDir string
+		want        bool
+	}{
+		{"name:2024-05-1*", "2024/2024-05-18 Weekend", true},
+		{"name:2024-05-1*", "2024/2024-06-18 Weekend", false},
+		{"2024-05-18 Weekend", "2024/2024-05-18 Weekend", true},
+		{"*Weekend", "2024/2024-05-18 Weekend/selects", false},
+		{"name:*", ".", false},
+		{"path:2024", "2024", true},
+		{"path:2024/", "2024/2024-05-18 Weekend", true},
+		{"path:2024", "2024-05-18", false},
+		{"path:2024/2024-05-18 Weekend", "2024/2024-05-18 Weekend/selects", true},
+		{"path:2024/2024-05-18 Weekend", "2024/2024-05-19", false},
+		{"path:./2024", "2024/a", true},
+		{"date:2024-05-17..2024-05-19", "2024/2024-05-18 Weekend", true},
+		{"date:2024-05-17..2024-05-19", "2024/20240519_weekend", true},
+		{"date:2024-05-17..2024-05-19", "2024/2024-05-20", false},
+		{"date:2024-05-17..", "2025-01-01", true},
+		{"date:..2024-05-17", "2025-01-01", false},
+		{"date:2024-05-18", "2024-05-18", true},
+		{"date:2024-05-18", "2024-05-19", false},
+		{"date:2024-05-17..2024-05-19", "Weekend", false},
+		{"date:2024-05-17..2024-05-19", "2024-13-45", false},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s:%s", tt.selector, tt.relativeDir)
+		t.Run(testname, func(t *testing.T) {
+			s, err := Parse(tt.selector)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := s.Matches(tt.relativeDir); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, selector := range []string{"", "name:", "name:[", "path:", "path:/", "path:..", "path:../other", "date:", "date:..", "date:2024-5-1", "date:2024-05-01..tomorrow", "month:05"} {
+		t.Run(selector, func(t *testing.T) {
+			if _, err := Parse(selector); err == nil {
+				t.Errorf("Expected error parsing '%s'", selector)
+			}
+		})
+	}
+}
+
+func TestSelection(t *testing.T) {
+	selection, err := ParseSelection([]string{"path:2023", "date:2024-05-18"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		relativeDir string
+		want        bool
+	}{
+		{"2023/anything", true},
+		{"2024/2024-05-18", true},
+		{"2024/2024-05-19", false},
+		{".", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.relativeDir, func(t *testing.T) {
+			if got := selection.Matches(tt.relativeDir); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !(Selection{}).Matches("anything") {
+		t.Errorf("Empty selection should match everything")
+	}
+}
@@ -0,0 +1,268 @@
+// Package ignore matches paths against gitignore style patterns
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileName is the name of ignore files read from any scanned directory
+const FileName = ".daeignore"
+
+// DefaultExcludes skips Synology's recycle bin and thumbnails, in both the input and output trees
+// "#" starts a comment, so it is escaped like in a .gitignore
+var DefaultExcludes = []string{`\#recycle`, "@eaDir"}
+
+// InputExcludes skips the files staged by clean, which are only in the input tree. They
+// come before other excludes, so they can be negated
+var InputExcludes = []string{"/delete/"}
+
+type pattern struct {
+	exp     *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	base    string // Directory the pattern is relative to, "." for the root
+	source  string
+}
+
+// Matcher decides which paths, relative to the root of a scanned tree, are skipped
+// Like gitignore, the last matching exclude pattern wins, and "!" re-includes a path.
+// If there are include patterns, files must also be in an included directory
+type Matcher struct {
+	excludes []pattern
+	includes []pattern
+}
+
+// New creates a matcher from root level include and exclude patterns
+func New(includes, excludes []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, line := range excludes {
+		if err := m.addExclude(".", line); err != nil {
+			return nil, err
+		}
+	}
+	for _, line := range includes {
+		p, ok, err := parse(".", line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.includes = append(m.includes, p)
+		}
+	}
+	return m, nil
+}
+
+// Default creates a matcher for the input tree with just the default excludes
+func Default() *Matcher {
+	m, err := New(nil, append(append([]string{}, InputExcludes...), DefaultExcludes...))
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// DefaultExports creates a matcher for the output tree with just the default excludes
+func DefaultExports() *Matcher {
+	m, err := New(nil, DefaultExcludes)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Matcher) addExclude(base, line string) error {
+	p, ok, err := parse(base, line)
+	if err != nil {
+		return err
+	}
+	if ok {
+		m.excludes = append(m.excludes, p)
+	}
+	return nil
+}
+
+// ReadIgnoreFile adds the patterns of the .daeignore file in dir, if any
+// dir is the full path, and relativeDir its path relative to the root of the tree
+func (m *Matcher) ReadIgnoreFile(dir, relativeDir string) error {
+	f, err := os.Open(filepath.Join(dir, FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := m.addExclude(relativeDir, scanner.Text()); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Join(dir, FileName), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Clone copies the matcher, so ignore files of one tree don't apply to another
+func (m *Matcher) Clone() *Matcher {
+	return &Matcher{
+		excludes: append([]pattern(nil), m.excludes...),
+		includes: append([]pattern(nil), m.includes...),
+	}
+}
+
+// Excluded checks whether a path, relative to the root, is excluded
+// Directories are checked as they are walked, so a path inside an excluded
+// directory is never checked
+func (m *Matcher) Excluded(relativePath string, isDir bool) bool {
+	relativePath = filepath.ToSlash(relativePath)
+	excluded := false
+	for _, p := range m.excludes {
+		if p.matches(relativePath, isDir) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// Included checks a file against the include patterns
+// Include patterns select directories, so the same patterns work for the source
+// tree and the mirrored export tree. A file is included if one of its parent
+// directories matches, e.g. "/2024/" or "*Weekend*". Files at the root have no parent
+// directory, so they are matched themselves, e.g. by "/IMG_*" but not by "/2024/"
+func (m *Matcher) Included(relativePath string) bool {
+	if len(m.includes) == 0 {
+		return true
+	}
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	included := false
+	if len(parts) == 1 {
+		for _, p := range m.includes {
+			if p.matches(parts[0], false) {
+				included = !p.negate
+			}
+		}
+		return included
+	}
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		for _, p := range m.includes {
+			if p.matches(dir, true) {
+				included = !p.negate
+			}
+		}
+	}
+	return included
+}
+
+// Skip checks whether a file should be left out of a scan
+func (m *Matcher) Skip(relativePath string) bool {
+	return m.Excluded(relativePath, false) || !m.Included(relativePath)
+}
+
+// SkipPath checks a file and each of its parent directories, for paths that
+// weren't found by walking the tree
+func (m *Matcher) SkipPath(relativePath string) bool {
+	relativePath = filepath.ToSlash(relativePath)
+	parts := strings.Split(relativePath, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.Excluded(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.Skip(relativePath)
+}
+
+func (p pattern) matches(relativePath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "." {
+		if !strings.HasPrefix(relativePath, p.base+"/") {
+			return false
+		}
+		relativePath = strings.TrimPrefix(relativePath, p.base+"/")
+	}
+	return p.exp.MatchString(relativePath)
+}
+
+// parse converts a gitignore style line to a pattern. ok is false for blank lines and comments
+func parse(base, line string) (p pattern, ok bool, err error) {
+	p = pattern{base: filepath.ToSlash(base), source: line}
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false, fmt.Errorf("Invalid pattern '%s'", p.source)
+	}
+	// Patterns without a slash match at any depth, others are relative to base
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if _, err := path.Match(line, ""); err != nil {
+		return p, false, fmt.Errorf("Invalid pattern '%s': %w", p.source, err)
+	}
+	expression := globToRegexp(line)
+	if !anchored {
+		expression = "(.*/)?" + expression
+	}
+	p.exp, err = regexp.Compile("^" + expression + "$")
+	if err != nil {
+		return p, false, fmt.Errorf("Invalid pattern '%s': %w", p.source, err)
+	}
+	return p, true, nil
+}
+
+// globToRegexp translates a glob, where "**" spans directories and "*" doesn't
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// Zero or more directories
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			// Everything inside
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.IndexByte(glob[i+1:], ']') >= 0:
+			end := strings.IndexByte(glob[i+1:], ']')
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,206 @@
+package ignore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"#recycle", "#recycle", true, false},
+		{`\#recycle`, "#recycle", true, true},
+		{`\#recycle`, "2024/#recycle", true, true},
+		{"@eaDir", "2024/trip/@eaDir", true, true},
+		{"@eaDir", "2024/trip/@eaDir.jpg", false, false},
+		{"/delete/", "delete", true, true},
+		{"/delete/", "2024/delete", true, false},
+		{"/delete/", "delete", false, false},
+		{"delete/", "2024/delete", true, true},
+		{"*.tmp.jpg", "2024/_DSC1234.jpg.tmp.jpg", false, true},
+		{"*.tmp.jpg", "2024/_DSC1234.jpg", false, false},
+		{"2024/*.ARW", "2024/_DSC1234.ARW", false, true},
+		{"2024/*.ARW", "2024/trip/_DSC1234.ARW", false, false},
+		{"2024/**/*.ARW", "2024/trip/day1/_DSC1234.ARW", false, true},
+		{"2024/**/*.ARW", "2024/_DSC1234.ARW", false, true},
+		{"**/rejects", "2024/trip/rejects", true, true},
+		{"**/rejects", "rejects", true, true},
+		{"2024/**", "2024/trip/_DSC1234.ARW", false, true},
+		{"2024/**", "2023/trip/_DSC1234.ARW", false, false},
+		{"a**b", "a/x/b", false, true},
+		{"_DSC123?.ARW", "x/_DSC1234.ARW", false, true},
+		{"_DSC123[0-3].ARW", "x/_DSC1234.ARW", false, false},
+		{"_DSC123[!0-3].ARW", "x/_DSC1234.ARW", false, true},
+		{"# comment", "# comment", false, false},
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s:%s", tt.pattern, tt.path)
+		t.Run(testname, func(t *testing.T) {
+			m, err := New(nil, []string{tt.pattern})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := m.Excluded(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegation(t *testing.T) {
+	m, err := New(nil, []string{"*.jpg", "!keep*.jpg", "keep-not.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		path string
+		want bool
+	}{
+		{"a.jpg", true},
+		{"keep.jpg", false},
+		{"keep-not.jpg", true},
+		{"a.ARW", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := m.Excluded(tt.path, false); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	m, err := New([]string{"/2024/", "!/2024/rejects/", "*Weekend*", "/IMG_*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		path string
+		want bool
+	}{
+		{"2024/a.ARW", true},
+		{"2024/trip/a.ARW", true},
+		{"2024/trip/a.jpg", true},
+		{"2024/rejects/a.ARW", false},
+		{"2023/trip/a.ARW", false},
+		{"2023/2023-05-18 Weekend/a.ARW", true},
+		{"2024.ARW", false},
+		// Files at the root match the patterns themselves
+		{"IMG_0001.ARW", true},
+		{"Weekend.ARW", true},
+		{"_DSC1234.ARW", false},
+		{"IMG_0001/a.ARW", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := m.Included(tt.path); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !Default().Included("anything") {
+		t.Errorf("No include patterns should include everything")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	m := Default()
+	for _, dir := range []string{"#recycle", "2024/#recycle", "2024/trip/@eaDir", "delete"} {
+		if !m.Excluded(dir, true) {
+			t.Errorf("Expected %s to be excluded by default", dir)
+		}
+	}
+	if m.Excluded("2024/delete", true) {
+		t.Errorf("Only the staging directory at the root should be excluded")
+	}
+	exports := DefaultExports()
+	if !exports.Excluded("2024/trip/@eaDir", true) || exports.Excluded("delete", true) {
+		t.Errorf("The output tree should only skip the shared default excludes")
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "2024", "trip")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "# Rejected on import\n/rejects/\n*.DNG\n\n!keep.DNG\n"
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := Default()
+	if err := m.ReadIgnoreFile(dir, "2024/trip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReadIgnoreFile(root, "."); err != nil {
+		t.Fatalf("Missing ignore file should not be an error: %v", err)
+	}
+	var tests = []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"2024/trip/rejects", true, true},
+		{"2024/trip/day1/rejects", true, false},
+		{"rejects", true, false},
+		{"2024/trip/a.DNG", false, true},
+		{"2024/trip/day1/a.DNG", false, true},
+		{"2024/trip/keep.DNG", false, false},
+		{"2024/a.DNG", false, false},
+		{"2024/trip/@eaDir", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := m.Excluded(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Clones don't share patterns added later
+	clone := Default().Clone()
+	if clone.Excluded("2024/trip/a.DNG", false) {
+		t.Errorf("Clone should not see ignore files read into another matcher")
+	}
+}
+
+func TestSkipPath(t *testing.T) {
+	m, err := New([]string{"/2024/"}, append(append([]string{}, InputExcludes...), append(DefaultExcludes, "*.CR3")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		path string
+		want bool
+	}{
+		{"2024/trip/a.ARW", false},
+		{"2024/trip/a.CR3", true},
+		{"2023/trip/a.ARW", true},
+		{"delete/2024/trip/a.ARW", true},
+		{"2024/@eaDir/a.ARW", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := m.SkipPath(tt.path); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	for _, p := range []string{"/", "!", "[a-"} {
+		t.Run(p, func(t *testing.T) {
+			if _, err := New(nil, []string{p}); err == nil {
+				t.Errorf("Expected error for pattern '%s'", p)
+			}
+		})
+	}
+}
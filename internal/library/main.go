@@ -0,0 +1,129 @@
+// Package library reads darktable's library.db
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Pure go sqlite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// darktable stores timestamps as microseconds since 0001-01-01 (GTimeSpan)
+const unixEpochOffset = 62135596800
+
+type Library struct {
+	db   *sql.DB
+	path string
+}
+
+// FilmRoll is a directory imported into darktable
+type FilmRoll struct {
+	ID     int
+	Folder string
+}
+
+// Image is a single version (the original or a virtual copy) of an image
+type Image struct {
+	ID       int
+	FilmRoll FilmRoll
+	Filename string    // Raw filename, without directory
+	Version  int       // 0 for the original, 1+ for virtual copies
+	Changed  time.Time // Last time the history was changed in darktable, zero if never
+}
+
+// Open opens a library.db read-only
+func Open(path string) (*Library, error) {
+	return open(path, "ro")
+}
+
+func open(path, mode string) (*Library, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dsn := (&url.URL{Scheme: "file", Path: abs, RawQuery: "mode=" + mode}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open darktable library '%s': %w", path, err)
+	}
+	// Fail early, and with a clear error, when the file is missing or not a db
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to open darktable library '%s': %w", path, err)
+	}
+	return &Library{db: db, path: path}, nil
+}
+
+func (l *Library) Close() error {
+	return l.db.Close()
+}
+
+// FilmRolls lists all film rolls, ordered by folder
+func (l *Library) FilmRolls() ([]FilmRoll, error) {
+	rows, err := l.db.Query(`SELECT id, folder FROM film_rolls ORDER BY folder`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read film rolls from '%s': %w", l.path, err)
+	}
+	defer rows.Close()
+	var rolls []FilmRoll
+	for rows.Next() {
+		var roll FilmRoll
+		if err := rows.Scan(&roll.ID, &roll.Folder); err != nil {
+			return nil, err
+		}
+		rolls = append(rolls, roll)
+	}
+	return rolls, rows.Err()
+}
+
+// Images lists every image version in the library, ordered by path and version
+func (l *Library) Images() ([]Image, error) {
+	rows, err := l.db.Query(`
+		SELECT i.id, f.id, f.folder, i.filename, i.version, i.change_timestamp
+		FROM images i JOIN film_rolls f ON i.film_id = f.id
+		ORDER BY f.folder, i.filename, i.version`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read images from '%s': %w", l.path, err)
+	}
+	defer rows.Close()
+	var images []Image
+	for rows.Next() {
+		var image Image
+		var changed sql.NullInt64
+		err := rows.Scan(&image.ID, &image.FilmRoll.ID, &image.FilmRoll.Folder, &image.Filename, &image.Version, &changed)
+		if err != nil {
+			return nil, err
+		}
+		if changed.Valid && changed.Int64 > 0 {
+			image.Changed = FromTimeSpan(changed.Int64)
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// FromTimeSpan converts a darktable timestamp to a time
+func FromTimeSpan(ts int64) time.Time {
+	return time.Unix(ts/1e6-unixEpochOffset, (ts%1e6)*1e3).UTC()
+}
+
+// RawPath is the full path to the image's raw file
+func (i Image) RawPath() string {
+	return filepath.Join(i.FilmRoll.Folder, i.Filename)
+}
+
+// XmpPath is the full path to the sidecar darktable writes for this version
+// _DSC1234.ARW version 0 => _DSC1234.ARW.xmp, version 1 => _DSC1234_01.ARW.xmp
+func (i Image) XmpPath() string {
+	name := i.Filename
+	if i.Version > 0 {
+		ext := filepath.Ext(name)
+		name = fmt.Sprintf("%s_%02d%s", strings.TrimSuffix(name, ext), i.Version, ext)
+	}
+	return filepath.Join(i.FilmRoll.Folder, name+".xmp")
+}
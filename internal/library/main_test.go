@@ -0,0 +1,133 @@
+package library
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// createTestLibrary creates a library.db with the subset of darktable's schema used here
+func createTestLibrary(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "library.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	statements := []string{
+		`CREATE TABLE film_rolls (id INTEGER PRIMARY KEY, access_timestamp INTEGER, folder VARCHAR(1024) NOT NULL)`,
+		`CREATE TABLE images (id INTEGER PRIMARY KEY AUTOINCREMENT, group_id INTEGER, film_id INTEGER, filename VARCHAR,
+			version INTEGER, flags INTEGER, change_timestamp INTEGER DEFAULT -1)`,
+		`INSERT INTO film_rolls (id, folder) VALUES (1, '/photos/2022-05-14'), (2, '/photos/2021-01-01 New Year')`,
+		`INSERT INTO images (id, group_id, film_id, filename, version, change_timestamp) VALUES
+			(1, 1, 1, '_DSC1234.ARW', 0, 63788119872000000),
+			(2, 1, 1, '_DSC1234.ARW', 1, -1),
+			(3, 3, 1, '_DSC1235.ARW', 0, NULL),
+			(4, 4, 2, 'IMG_0001.CR3', 0, -1)`,
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestImages(t *testing.T) {
+	lib, err := Open(createTestLibrary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+	images, err := lib.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roll1 := FilmRoll{ID: 1, Folder: "/photos/2022-05-14"}
+	roll2 := FilmRoll{ID: 2, Folder: "/photos/2021-01-01 New Year"}
+	want := []Image{
+		{ID: 4, FilmRoll: roll2, Filename: "IMG_0001.CR3", Version: 0},
+		{ID: 1, FilmRoll: roll1, Filename: "_DSC1234.ARW", Version: 0, Changed: time.Date(2022, 5, 14, 10, 11, 12, 0, time.UTC)},
+		{ID: 2, FilmRoll: roll1, Filename: "_DSC1234.ARW", Version: 1},
+		{ID: 3, FilmRoll: roll1, Filename: "_DSC1235.ARW", Version: 0},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("got %+v, want %+v", images, want)
+	}
+}
+
+func TestFromTimeSpan(t *testing.T) {
+	var tests = []struct {
+		ts   int64
+		want time.Time
+	}{
+		{62135596800000000, time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{63788119872000000, time.Date(2022, 5, 14, 10, 11, 12, 0, time.UTC)},
+		{63788119872123456, time.Date(2022, 5, 14, 10, 11, 12, 123456000, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want.String(), func(t *testing.T) {
+			if got := FromTimeSpan(tt.ts); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilmRolls(t *testing.T) {
+	lib, err := Open(createTestLibrary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+	rolls, err := lib.FilmRolls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FilmRoll{{ID: 2, Folder: "/photos/2021-01-01 New Year"}, {ID: 1, Folder: "/photos/2022-05-14"}}
+	if !reflect.DeepEqual(rolls, want) {
+		t.Errorf("got %v, want %v", rolls, want)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	lib, err := Open(createTestLibrary(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+	if _, err := lib.db.Exec(`DELETE FROM images`); err == nil {
+		t.Errorf("Expected write to read-only library to fail")
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Errorf("Expected error opening missing library")
+	}
+}
+
+func TestImagePaths(t *testing.T) {
+	var tests = []struct {
+		image   Image
+		rawPath string
+		xmpPath string
+	}{
+		{Image{FilmRoll: FilmRoll{Folder: "/photos/a"}, Filename: "_DSC1234.ARW"}, "/photos/a/_DSC1234.ARW", "/photos/a/_DSC1234.ARW.xmp"},
+		{Image{FilmRoll: FilmRoll{Folder: "/photos/a"}, Filename: "_DSC1234.ARW", Version: 1}, "/photos/a/_DSC1234.ARW", "/photos/a/_DSC1234_01.ARW.xmp"},
+		{Image{FilmRoll: FilmRoll{Folder: "/photos/a"}, Filename: "_DSC1234.ARW", Version: 123}, "/photos/a/_DSC1234.ARW", "/photos/a/_DSC1234_123.ARW.xmp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.xmpPath, func(t *testing.T) {
+			if got := tt.image.RawPath(); got != tt.rawPath {
+				t.Errorf("got %s, want %s", got, tt.rawPath)
+			}
+			if got := tt.image.XmpPath(); got != tt.xmpPath {
+				t.Errorf("got %s, want %s", got, tt.xmpPath)
+			}
+		})
+	}
+}
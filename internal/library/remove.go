@@ -0,0 +1,128 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LockFiles are created by darktable in its config directory while it runs
+var LockFiles = []string{"data.db.lock", "library.db.lock"}
+
+// Locked lists the darktable lock files in lockDir. darktable may still be running, or
+// have crashed without removing them, while there are any
+func Locked(lockDir string) ([]string, error) {
+	var locks []string
+	for _, name := range LockFiles {
+		path := filepath.Join(lockDir, name)
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, path)
+	}
+	return locks, nil
+}
+
+// OpenReadWrite opens a library.db to change it. darktable must be closed
+func OpenReadWrite(path string) (*Library, error) {
+	return open(path, "rw")
+}
+
+// Backup copies the library next to it, named after the time of the backup, and returns the
+// path of the copy. The copy is made through the open connection, so it includes changes
+// still in the -wal file
+func (l *Library) Backup(now time.Time) (string, error) {
+	backup := fmt.Sprintf("%s.%s.bak", l.path, now.Format("20060102-150405"))
+	if _, err := os.Lstat(backup); err == nil {
+		return "", fmt.Errorf("%s already exists", backup)
+	}
+	if _, err := l.db.Exec(`VACUUM INTO ?`, backup); err != nil {
+		os.Remove(backup)
+		return "", err
+	}
+	return backup, nil
+}
+
+// imageTables are the tables holding an image's history, tags and other metadata, with the
+// column referring to the image. Tables missing from older libraries are skipped
+var imageTables = []struct{ table, column string }{
+	{"history", "imgid"},
+	{"masks_history", "imgid"},
+	{"history_hash", "imgid"},
+	{"module_order", "imgid"},
+	{"tagged_images", "imgid"},
+	{"color_labels", "imgid"},
+	{"meta_data", "id"},
+	{"selected_images", "imgid"},
+}
+
+// RemoveImages deletes the image versions whose raw or xmp is one of paths, along with
+// their history and tags, in a single transaction. Paths must be absolute. It returns the
+// versions removed, or that would be with dryRun
+func (l *Library) RemoveImages(paths []string, dryRun bool) ([]Image, error) {
+	remove := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		remove[filepath.Clean(path)] = true
+	}
+	images, err := l.Images()
+	if err != nil {
+		return nil, err
+	}
+	var removed []Image
+	for _, image := range images {
+		if remove[image.RawPath()] || remove[image.XmpPath()] {
+			removed = append(removed, image)
+		}
+	}
+	if dryRun || len(removed) == 0 {
+		return removed, nil
+	}
+
+	existing := make(map[string]bool)
+	rows, err := l.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range removed {
+		for _, t := range imageTables {
+			if !existing[t.table] {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, t.table, t.column), image.ID); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("Unable to remove %s from %s: %w", image.XmpPath(), t.table, err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM images WHERE id = ?`, image.ID); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Unable to remove %s: %w", image.XmpPath(), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Unable to remove images from '%s': %w", l.path, err)
+	}
+	return removed, nil
+}
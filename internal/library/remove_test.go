@@ -0,0 +1,152 @@
+package library
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addImageTables adds history and tags to the test library, for every image but the last
+func addImageTables(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	statements := []string{
+		`CREATE TABLE history (imgid INTEGER, num INTEGER, operation VARCHAR(256))`,
+		`CREATE TABLE tagged_images (imgid INTEGER, tagid INTEGER, position INTEGER)`,
+		`INSERT INTO history (imgid, num, operation) VALUES (1, 0, 'exposure'), (2, 0, 'crop'), (3, 0, 'exposure')`,
+		`INSERT INTO tagged_images (imgid, tagid) VALUES (1, 10), (2, 10), (3, 11)`,
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func count(t *testing.T, lib *Library, table string) int {
+	t.Helper()
+	var n int
+	if err := lib.db.QueryRow(`SELECT count(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRemoveImages(t *testing.T) {
+	var tests = []struct {
+		name    string
+		paths   []string
+		dryRun  bool
+		removed []int
+		images  int
+		history int
+		tags    int
+	}{
+		{"raw removes every version", []string{"/photos/2022-05-14/_DSC1234.ARW"}, false, []int{1, 2}, 2, 1, 1},
+		{"xmp of a virtual copy", []string{"/photos/2022-05-14/_DSC1234_01.ARW.xmp"}, false, []int{2}, 3, 2, 2},
+		{"unknown path", []string{"/photos/other/_DSC1234.ARW"}, false, nil, 4, 3, 3},
+		{"dry run", []string{"/photos/2022-05-14/_DSC1235.ARW"}, true, []int{3}, 4, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := createTestLibrary(t)
+			addImageTables(t, path)
+			lib, err := OpenReadWrite(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lib.Close()
+			removed, err := lib.RemoveImages(tt.paths, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, image := range removed {
+				ids = append(ids, image.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.removed) {
+				t.Errorf("got removed %v, want %v", ids, tt.removed)
+			}
+			if got := count(t, lib, "images"); got != tt.images {
+				t.Errorf("got %d images, want %d", got, tt.images)
+			}
+			if got := count(t, lib, "history"); got != tt.history {
+				t.Errorf("got %d history items, want %d", got, tt.history)
+			}
+			if got := count(t, lib, "tagged_images"); got != tt.tags {
+				t.Errorf("got %d tags, want %d", got, tt.tags)
+			}
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	path := createTestLibrary(t)
+	// Leave a change in the -wal file, as darktable does while it runs
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	statements := []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA wal_autocheckpoint = 0`,
+		`INSERT INTO images (id, group_id, film_id, filename, version) VALUES (5, 5, 2, 'IMG_0002.CR3', 0)`,
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + "-wal"); err != nil {
+		t.Fatalf("Expected a -wal file: %v", err)
+	}
+
+	lib, err := OpenReadWrite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	backup, err := lib.Backup(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := path + ".20240501-123000.bak"; backup != want {
+		t.Errorf("got %s, want %s", backup, want)
+	}
+	copied, err := Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if images, err := copied.Images(); err != nil || len(images) != 5 {
+		t.Errorf("Backup should have every image, including the one in the -wal file, got %d, %v", len(images), err)
+	}
+	if _, err := lib.Backup(now); err == nil {
+		t.Errorf("Expected error overwriting a backup")
+	}
+}
+
+func TestLocked(t *testing.T) {
+	dir := t.TempDir()
+	locks, err := Locked(dir)
+	if err != nil || len(locks) != 0 {
+		t.Errorf("got locks %v, %v", locks, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "library.db.lock"), []byte("1234"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locks, err = Locked(dir)
+	if err != nil || !reflect.DeepEqual(locks, []string{filepath.Join(dir, "library.db.lock")}) {
+		t.Errorf("got locks %v, %v", locks, err)
+	}
+}
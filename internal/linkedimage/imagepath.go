@@ -5,8 +5,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 )
 
 // ImagePath provides convenience methods to access various properties of an image file's path
@@ -56,25 +56,40 @@ func (i *ImagePath) GetBasename() string {
 // GetImageBase gets the base image name, without extensions or virtual copy sequences
 // _DSc1234_01.ARW.xmp => _DSC1234
 func (i *ImagePath) GetImageBase() string {
-	basename := i.GetBasename()
-	exp := regexp.MustCompile(`(.*)_\d\d$`)
-	imageBase := exp.ReplaceAllString(basename, "${1}")
+	imageBase, _ := splitVSequence(i.GetBasename())
 	return imageBase
 }
 
 // Get the base image name, without extensions or virtual copy sequences
 // _DSc1234_01.ARW.xmp => _DSC1234
 func (i *ImagePath) GetVSequence() string {
-	basename := i.GetBasename()
-	exp := regexp.MustCompile(`.*_(\d\d)$`)
-	matches := exp.FindStringSubmatch(basename)
-	var sequence string
-	if len(matches) >= 1 {
-		sequence = matches[1]
-	}
+	_, sequence := splitVSequence(i.GetBasename())
 	return sequence
 }
 
+// splitVSequence splits the virtual copy sequence off a basename
+// darktable names version 0 <base>.<ext>.xmp and version N <base>_<N>.<ext>.xmp, with N
+// formatted as %02d, so a sequence is at least 2 digits, and only has a leading zero when
+// it is exactly 2 digits. Anything else is part of the image base
+// _DSC1234_01 => _DSC1234, 01. _DSC1234_100 => _DSC1234, 100. _DSC1234_012 => _DSC1234_012, ""
+// A camera name like DSC_1234 also parses as a sequence, linking checks against existing raws
+func splitVSequence(basename string) (imageBase, sequence string) {
+	i := strings.LastIndexByte(basename, '_')
+	if i < 1 {
+		return basename, ""
+	}
+	sequence = basename[i+1:]
+	if len(sequence) < 2 || (len(sequence) > 2 && sequence[0] == '0') || strings.Trim(sequence, "0") == "" {
+		return basename, ""
+	}
+	for _, c := range sequence {
+		if c < '0' || c > '9' {
+			return basename, ""
+		}
+	}
+	return basename[:i], sequence
+}
+
 // GetRelativeDir returns the directory of fullPath relative to baseDir
 // E.g. GetRelativeDir("/mnt/some/dir/filename.txt", "/mnt") -> "some/dir"
 func (i *ImagePath) GetRelativeDir() string {
@@ -104,3 +119,12 @@ func (i *ImagePath) Exists() bool {
 		return false
 	}
 }
+
+// ModTime returns the modification time of the file
+func (i *ImagePath) ModTime() (time.Time, error) {
+	info, err := os.Stat(i.fullPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -160,6 +160,39 @@ func TestImagePathVSequence(t *testing.T) {
 	}
 }
 
+func TestSplitVSequence(t *testing.T) {
+	var tests = []struct {
+		basename     string
+		wantBase     string
+		wantSequence string
+	}{
+		{"_DSC1234", "_DSC1234", ""},
+		{"_DSC1234_01", "_DSC1234", "01"},
+		{"_DSC1234_12", "_DSC1234", "12"},
+		{"_DSC1234_99", "_DSC1234", "99"},
+		{"_DSC1234_100", "_DSC1234", "100"},
+		{"_DSC1234_1234", "_DSC1234", "1234"},
+		// Not written by darktable, which formats versions as %02d and leaves version 0 unsuffixed
+		{"_DSC1234_012", "_DSC1234_012", ""},
+		{"_DSC1234_1", "_DSC1234_1", ""},
+		{"_DSC1234_00", "_DSC1234_00", ""},
+		{"_DSC1234_", "_DSC1234_", ""},
+		{"_DSC1234_1a", "_DSC1234_1a", ""},
+		{"_12", "_12", ""},
+		// Ambiguous with a camera name, resolved against existing raws when linking
+		{"DSC_1234", "DSC", "1234"},
+		{"IMG_0012", "IMG_0012", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.basename, func(t *testing.T) {
+			base, sequence := splitVSequence(tt.basename)
+			if base != tt.wantBase || sequence != tt.wantSequence {
+				t.Errorf("got %s, %s, want %s, %s", base, sequence, tt.wantBase, tt.wantSequence)
+			}
+		})
+	}
+}
+
 func TestImagePathRelativePath(t *testing.T) {
 	var tests = []struct {
 		path ImagePath
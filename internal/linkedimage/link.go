@@ -0,0 +1,246 @@
+package linkedimage
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// imageKey identifies the files of one image in a directory
+// dir is relative to the source or export dir, name is a basename without extensions, e.g. _DSC1234_01
+type imageKey struct {
+	dir  string
+	name string
+}
+
+// linkName is a sidecar or export file name split into the parts used for linking
+// _DSC1234_01.ARW.xmp => base _DSC1234_01, middle .ARW
+type linkName struct {
+	key    imageKey
+	middle string // Raw extension between the basename and the final extension, "" for _DSC1234_01.xmp
+}
+
+// splitLinkName splits a relative path ending in ext (matched case sensitively)
+// ok is false if the path has another extension
+func splitLinkName(relativePath, ext string) (name linkName, ok bool) {
+	if !strings.HasSuffix(relativePath, ext) {
+		return linkName{}, false
+	}
+	dir, file := filepath.Split(strings.TrimSuffix(relativePath, ext))
+	base := file
+	for filepath.Ext(base) != "" {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return linkName{
+		key:    imageKey{dir: filepath.Clean(dir), name: base},
+		middle: strings.TrimPrefix(file, base),
+	}, true
+}
+
+// rawKey gets the key for a raw's own basename, e.g. _DSC1234.ARW => _DSC1234
+func rawKey(raw *Raw) imageKey {
+	return imageKey{dir: raw.Path.GetRelativeDir(), name: raw.Path.GetBasename()}
+}
+
+// candidateRawKeys lists the raw keys a sidecar or export may belong to, most specific first
+// _DSC1234_01 may be the original of a raw named _DSC1234_01, or version 01 of _DSC1234
+func candidateRawKeys(key imageKey) []imageKey {
+	keys := []imageKey{key}
+	if imageBase, sequence := splitVSequence(key.name); sequence != "" {
+		keys = append(keys, imageKey{dir: key.dir, name: imageBase})
+	}
+	return keys
+}
+
+// matchesRawExt checks the optional raw extension in a sidecar name
+func (n linkName) matchesRawExt(raw *Raw) bool {
+	return n.middle == "" || strings.EqualFold(n.middle, raw.GetRawExt())
+}
+
+// matchesExport checks the optional part between the basename and .jpg in an export name
+// Raws sharing their basename with another raw only match exports with their own suffix
+func (n linkName) matchesExport(raw *Raw) bool {
+	if raw.jpgSuffix != "" {
+		return strings.EqualFold(n.middle, raw.jpgSuffix)
+	}
+	return n.matchesRawExt(raw)
+}
+
+// rawIndex finds raws by directory and basename
+type rawIndex map[imageKey][]*Raw
+
+func newRawIndex(raws []*Raw) rawIndex {
+	index := make(rawIndex, len(raws))
+	for _, raw := range raws {
+		key := rawKey(raw)
+		index[key] = append(index[key], raw)
+	}
+	return index
+}
+
+// find lists the raws a sidecar or export belongs to
+// A raw whose basename is the whole name wins over a version suffix, so DSC_1234.NEF.xmp
+// belongs to DSC_1234.NEF rather than being version 1234 of DSC.NEF
+func (index rawIndex) find(name linkName, matches func(linkName, *Raw) bool) []*Raw {
+	for _, key := range candidateRawKeys(name.key) {
+		var found []*Raw
+		for _, raw := range index[key] {
+			if matches(name, raw) {
+				found = append(found, raw)
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+	}
+	return nil
+}
+
+// ambiguous lists the raws an export without a suffix may belong to, when they share a basename
+func (index rawIndex) ambiguous(name linkName) []*Raw {
+	if name.middle != "" {
+		return nil
+	}
+	for _, key := range candidateRawKeys(name.key) {
+		if group := index[key]; len(group) > 1 && group[0].jpgSuffix != "" {
+			return group
+		}
+	}
+	return nil
+}
+
+// For each raw, find corresponding xmps and jpgs
+// For each xmp, find corresponding jpgs and raws
+// For each jpg, find corresponding xmps and raws
+// Files are indexed by (relative dir, basename), so linking is linear in the number of files
+// Raws sharing a basename are given export suffixes by naming, and returned as collisions
+// Of an Adobe and a darktable style sidecar for the same version, only the one preferred
+// by the sidecars option is linked. Sidecars matching several raws aren't linked at all
+func linkImages(raws []*Raw, xmps []*Xmp, jpgs []*Jpg, o Options) []Collision {
+	index := newRawIndex(raws)
+	xmpsByRaw := make(map[*Raw][]*Xmp)
+	xmpNames := make(map[*Xmp]linkName, len(xmps))
+	for _, xmp := range xmps {
+		name, ok := splitLinkName(xmp.Path.GetRelativePath(), ".xmp")
+		if !ok {
+			continue
+		}
+		found := index.find(name, linkName.matchesRawExt)
+		// Without a raw extension, the sidecar can't tell raws sharing its basename apart
+		if len(found) > 1 {
+			xmp.AmbiguousRaws = found
+			for _, raw := range found {
+				raw.AmbiguousXmps = append(raw.AmbiguousXmps, xmp)
+			}
+			continue
+		}
+		for _, raw := range found {
+			xmpsByRaw[raw] = append(xmpsByRaw[raw], xmp)
+		}
+		xmpNames[xmp] = name
+	}
+	for _, raw := range raws {
+		for _, xmp := range xmpsByRaw[raw] {
+			raw.AddXmp(xmp)
+		}
+		raw.preferSidecars(o.sidecars())
+	}
+	xmpsByKey := make(map[imageKey][]*Xmp, len(xmps))
+	for _, xmp := range xmps {
+		if name, ok := xmpNames[xmp]; ok && xmp.IgnoredFor == nil {
+			xmpsByKey[name.key] = append(xmpsByKey[name.key], xmp)
+		}
+	}
+	// Export names depend on the collisions, which may depend on the models in the xmps
+	collisions := disambiguate(raws, o.naming())
+
+	jpgsByRaw := make(map[*Raw][]*Jpg)
+	jpgRaws := make(map[*Jpg][]*Raw, len(jpgs))
+	jpgNames := make(map[*Jpg]linkName, len(jpgs))
+	for _, jpg := range jpgs {
+		name, ok := splitLinkName(jpg.Path.GetRelativePath(), ".jpg")
+		if !ok {
+			continue
+		}
+		jpgNames[jpg] = name
+		found := index.find(name, linkName.matchesExport)
+		for _, raw := range found {
+			jpgsByRaw[raw] = append(jpgsByRaw[raw], jpg)
+			jpgRaws[jpg] = append(jpgRaws[jpg], raw)
+		}
+		if len(found) == 0 {
+			jpg.AmbiguousRaws = index.ambiguous(name)
+			for _, raw := range jpg.AmbiguousRaws {
+				raw.AmbiguousJpgs = append(raw.AmbiguousJpgs, jpg)
+			}
+		}
+	}
+	for _, raw := range raws {
+		for _, jpg := range jpgsByRaw[raw] {
+			raw.AddJpg(jpg)
+		}
+	}
+	for _, jpg := range jpgs {
+		name, ok := jpgNames[jpg]
+		if !ok {
+			continue
+		}
+		for _, xmp := range xmpsByKey[name.key] {
+			if jpgMatchesXmp(jpg, xmp) {
+				xmp.LinkJpg(jpg)
+			}
+		}
+	}
+	for _, jpg := range jpgs {
+		for _, raw := range jpgRaws[jpg] {
+			jpg.LinkRaw(raw)
+		}
+	}
+	return collisions
+}
+
+// jpgMatchesXmp checks whether the jpg is named like the xmp's export
+func jpgMatchesXmp(jpg *Jpg, xmp *Xmp) bool {
+	jpgName, ok := splitLinkName(jpg.Path.GetRelativePath(), ".jpg")
+	if !ok {
+		return false
+	}
+	var suffix string
+	if xmp.Raw != nil {
+		suffix = xmp.Raw.jpgSuffix
+	}
+	if !strings.EqualFold(jpgName.middle, suffix) {
+		return false
+	}
+	xmpName, ok := splitLinkName(xmp.Path.GetRelativePath(), ".xmp")
+	return ok && jpgName.key == xmpName.key
+}
+
+func xmpMatchesRaw(xmp *Xmp, raw *Raw) bool {
+	if xmp.Path.GetFullDir() != raw.Path.GetFullDir() {
+		return false
+	}
+	name, ok := splitLinkName(filepath.Base(xmp.GetPath()), ".xmp")
+	if !ok {
+		return false
+	}
+	return nameMatchesRaw(name, imageKey{dir: ".", name: raw.Path.GetBasename()}, raw, linkName.matchesRawExt)
+}
+
+func jpgMatchesRaw(jpg *Jpg, raw *Raw) bool {
+	name, ok := splitLinkName(jpg.Path.GetRelativePath(), ".jpg")
+	if !ok {
+		return false
+	}
+	return nameMatchesRaw(name, rawKey(raw), raw, linkName.matchesExport)
+}
+
+// nameMatchesRaw compares against a single raw, so it can't prefer an exact basename
+// match over a version suffix like linkImages does
+func nameMatchesRaw(name linkName, key imageKey, raw *Raw, matches func(linkName, *Raw) bool) bool {
+	for _, candidate := range candidateRawKeys(name.key) {
+		if candidate == key && matches(name, raw) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package linkedimage
+
+import (
+	"fmt"
+	"testing"
+)
+
+// syntheticTree builds in-memory paths for count raws spread over directories of 100 raws
+// Every raw has an xmp and a jpg, every third raw also has a virtual copy, and
+// every tenth raw has an orphaned jpg for a deleted virtual copy
+func syntheticTree(count int) ([]ImagePath, []ImagePath, []ImagePath) {
+	var raws, xmps, jpgs []ImagePath
+	for i := 0; i < count; i++ {
+		dir := fmt.Sprintf("%d/%02d-roll", 2000+i/10000, (i/100)%100)
+		base := fmt.Sprintf("_DSC%04d", i%10000)
+		raws = append(raws, ImagePath{fullPath: fmt.Sprintf("/src/%s/%s.ARW", dir, base), basePath: "/src"})
+		xmps = append(xmps, ImagePath{fullPath: fmt.Sprintf("/src/%s/%s.ARW.xmp", dir, base), basePath: "/src"})
+		jpgs = append(jpgs, ImagePath{fullPath: fmt.Sprintf("/dst/%s/%s.jpg", dir, base), basePath: "/dst"})
+		if i%3 == 0 {
+			xmps = append(xmps, ImagePath{fullPath: fmt.Sprintf("/src/%s/%s_01.ARW.xmp", dir, base), basePath: "/src"})
+			jpgs = append(jpgs, ImagePath{fullPath: fmt.Sprintf("/dst/%s/%s_01.jpg", dir, base), basePath: "/dst"})
+		}
+		if i%10 == 0 {
+			jpgs = append(jpgs, ImagePath{fullPath: fmt.Sprintf("/dst/%s/%s_02.jpg", dir, base), basePath: "/dst"})
+		}
+	}
+	return raws, xmps, jpgs
+}
+
+func newImages(rawPaths, xmpPaths, jpgPaths []ImagePath) ([]*Raw, []*Xmp, []*Jpg) {
+	var raws []*Raw
+	for _, p := range rawPaths {
+		raws = append(raws, NewRaw(p))
+	}
+	var xmps []*Xmp
+	for _, p := range xmpPaths {
+		xmps = append(xmps, NewXmp(p))
+	}
+	var jpgs []*Jpg
+	for _, p := range jpgPaths {
+		jpgs = append(jpgs, NewJpg(p))
+	}
+	return raws, xmps, jpgs
+}
+
+// linkImagesPairwise compares every file against every other file, as a reference for linkImages
+func linkImagesPairwise(raws []*Raw, xmps []*Xmp, jpgs []*Jpg) {
+	xmpMatches := func(xmp *Xmp, raw *Raw) bool {
+		return xmpMatchesRaw(xmp, raw) && !shadowedByExactRaw(xmp.Path.GetRelativePath(), ".xmp", raw, raws)
+	}
+	for _, raw := range raws {
+		for _, xmp := range xmps {
+			if !xmpMatches(xmp, raw) {
+				continue
+			}
+			// Sidecars shared by raws with the same basename aren't linked
+			shared := false
+			for _, other := range raws {
+				if other != raw && xmpMatches(xmp, other) {
+					shared = true
+				}
+			}
+			if !shared {
+				raw.AddXmp(xmp)
+			}
+		}
+		raw.preferSidecars(SidecarsDarktable)
+	}
+	disambiguate(raws, NamingExtension)
+	for _, raw := range raws {
+		for _, jpg := range jpgs {
+			if jpgMatchesRaw(jpg, raw) && !shadowedByExactRaw(jpg.Path.GetRelativePath(), ".jpg", raw, raws) {
+				raw.AddJpg(jpg)
+			}
+		}
+	}
+	for _, xmp := range xmps {
+		for _, jpg := range jpgs {
+			if xmp.IgnoredFor == nil && jpgMatchesXmp(jpg, xmp) {
+				xmp.LinkJpg(jpg)
+			}
+		}
+	}
+	for _, jpg := range jpgs {
+		for _, raw := range raws {
+			if jpgMatchesRaw(jpg, raw) && !shadowedByExactRaw(jpg.Path.GetRelativePath(), ".jpg", raw, raws) {
+				jpg.LinkRaw(raw)
+			}
+		}
+	}
+}
+
+// shadowedByExactRaw checks whether a file matched to raw by its version suffix has
+// another raw with exactly its basename, which it belongs to instead
+func shadowedByExactRaw(relativePath, ext string, raw *Raw, raws []*Raw) bool {
+	name, ok := splitLinkName(relativePath, ext)
+	if !ok || rawKey(raw) == name.key {
+		return false
+	}
+	for _, other := range raws {
+		if rawKey(other) == name.key && name.matchesRawExt(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLinkImagesMatchesPairwise(t *testing.T) {
+	rawPaths, xmpPaths, jpgPaths := syntheticTree(300)
+	// Names that are ambiguous, or only differ by extension
+	rawPaths = append(rawPaths,
+		ImagePath{fullPath: "/src/x/IMG_01.ARW", basePath: "/src"},
+		ImagePath{fullPath: "/src/x/IMG.ARW", basePath: "/src"},
+		ImagePath{fullPath: "/src/x/IMG.dng", basePath: "/src"},
+		ImagePath{fullPath: "/src/n/DSC.NEF", basePath: "/src"},
+		ImagePath{fullPath: "/src/n/DSC_1234.NEF", basePath: "/src"},
+	)
+	xmpPaths = append(xmpPaths,
+		ImagePath{fullPath: "/src/x/IMG_01.ARW.xmp", basePath: "/src"},
+		ImagePath{fullPath: "/src/x/IMG.DNG.xmp", basePath: "/src"},
+		ImagePath{fullPath: "/src/x/IMG.xmp", basePath: "/src"},
+		ImagePath{fullPath: "/src/y/IMG.xmp", basePath: "/src"},
+		ImagePath{fullPath: "/src/n/DSC_1234.NEF.xmp", basePath: "/src"},
+		ImagePath{fullPath: "/src/n/DSC_100.NEF.xmp", basePath: "/src"},
+	)
+	jpgPaths = append(jpgPaths,
+		ImagePath{fullPath: "/dst/x/IMG_01.jpg", basePath: "/dst"},
+		ImagePath{fullPath: "/dst/x/IMG.ARW.jpg", basePath: "/dst"},
+		ImagePath{fullPath: "/dst/x/IMG.JPG", basePath: "/dst"},
+		ImagePath{fullPath: "/dst/IMG.jpg", basePath: "/dst"},
+		ImagePath{fullPath: "/dst/n/DSC_1234.jpg", basePath: "/dst"},
+		ImagePath{fullPath: "/dst/n/DSC_100.jpg", basePath: "/dst"},
+	)
+	raws, xmps, jpgs := newImages(rawPaths, xmpPaths, jpgPaths)
+	linkImages(raws, xmps, jpgs, Options{})
+	wantRaws, wantXmps, wantJpgs := newImages(rawPaths, xmpPaths, jpgPaths)
+	linkImagesPairwise(wantRaws, wantXmps, wantJpgs)
+	for i := range raws {
+		if raws[i].String() != wantRaws[i].String() {
+			t.Errorf("Raw wanted \n%s\nbut got \n%s", wantRaws[i], raws[i])
+		}
+	}
+	for i := range xmps {
+		if xmps[i].String() != wantXmps[i].String() {
+			t.Errorf("Xmp wanted \n%s\nbut got \n%s", wantXmps[i], xmps[i])
+		}
+	}
+	for i := range jpgs {
+		if jpgs[i].String() != wantJpgs[i].String() {
+			t.Errorf("Jpg wanted \n%s\nbut got \n%s", wantJpgs[i], jpgs[i])
+		}
+	}
+}
+
+// Camera names ending in digits belong to the raw with that exact name, not a shorter one
+func TestLinkPrefersExactRaw(t *testing.T) {
+	raws, xmps, jpgs := newImages(
+		[]ImagePath{
+			{fullPath: "/src/DSC.NEF", basePath: "/src"},
+			{fullPath: "/src/DSC_1234.NEF", basePath: "/src"},
+			{fullPath: "/src/DSC_5678.NEF", basePath: "/src"},
+		},
+		[]ImagePath{
+			{fullPath: "/src/DSC_1234.NEF.xmp", basePath: "/src"},
+			{fullPath: "/src/DSC_1234_101.NEF.xmp", basePath: "/src"},
+			{fullPath: "/src/DSC_100.NEF.xmp", basePath: "/src"},
+		},
+		[]ImagePath{
+			{fullPath: "/dst/DSC_1234.jpg", basePath: "/dst"},
+			{fullPath: "/dst/DSC_5678.jpg", basePath: "/dst"},
+			{fullPath: "/dst/DSC_100.jpg", basePath: "/dst"},
+		},
+	)
+	linkImages(raws, xmps, jpgs, Options{})
+	var tests = []struct {
+		name        string
+		got         *Raw
+		want        *Raw
+		virtualCopy bool
+	}{
+		{"DSC_1234.NEF.xmp", xmps[0].Raw, raws[1], xmps[0].IsVirtualCopy()},
+		{"DSC_1234_101.NEF.xmp", xmps[1].Raw, raws[1], xmps[1].IsVirtualCopy()},
+		{"DSC_100.NEF.xmp", xmps[2].Raw, raws[0], xmps[2].IsVirtualCopy()},
+		{"DSC_1234.jpg", jpgs[0].Raw, raws[1], jpgs[0].IsVirtualCopy()},
+		{"DSC_5678.jpg", jpgs[1].Raw, raws[2], jpgs[1].IsVirtualCopy()},
+		{"DSC_100.jpg", jpgs[2].Raw, raws[0], jpgs[2].IsVirtualCopy()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("Linked to %v, want %s", tt.got, tt.want.GetPath())
+			}
+			wantVirtualCopy := tt.want == raws[0] || tt.name == "DSC_1234_101.NEF.xmp"
+			if tt.virtualCopy != wantVirtualCopy {
+				t.Errorf("Virtual copy %v, want %v", tt.virtualCopy, wantVirtualCopy)
+			}
+		})
+	}
+}
+
+func TestSplitLinkName(t *testing.T) {
+	var tests = []struct {
+		path   string
+		ext    string
+		want   linkName
+		wantOk bool
+	}{
+		{"a/b/_DSC1234_01.ARW.xmp", ".xmp", linkName{imageKey{"a/b", "_DSC1234_01"}, ".ARW"}, true},
+		{"_DSC1234.xmp", ".xmp", linkName{imageKey{".", "_DSC1234"}, ""}, true},
+		{"a/_DSC1234.jpg", ".jpg", linkName{imageKey{"a", "_DSC1234"}, ""}, true},
+		{"a/_DSC1234.JPG", ".jpg", linkName{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := splitLinkName(tt.path, tt.ext)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("got %v %v, want %v %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func BenchmarkLinkImages(b *testing.B) {
+	for _, count := range []int{1000, 10000, 100000} {
+		rawPaths, xmpPaths, jpgPaths := syntheticTree(count)
+		b.Run(fmt.Sprintf("%d raws", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				raws, xmps, jpgs := newImages(rawPaths, xmpPaths, jpgPaths)
+				b.StartTimer()
+				linkImages(raws, xmps, jpgs, Options{})
+			}
+		})
+	}
+}
+
+// Reference for the speedup of linkImages, kept small as it is quadratic
+func BenchmarkLinkImagesPairwise(b *testing.B) {
+	for _, count := range []int{1000} {
+		rawPaths, xmpPaths, jpgPaths := syntheticTree(count)
+		b.Run(fmt.Sprintf("%d raws", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				raws, xmps, jpgs := newImages(rawPaths, xmpPaths, jpgPaths)
+				b.StartTimer()
+				linkImagesPairwise(raws, xmps, jpgs)
+			}
+		})
+	}
+}
@@ -1,16 +1,21 @@
 package linkedimage
 
 import (
+	"errors"
 	"fmt"
-	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/figadore/darktable-auto-export/internal/archive"
 	"github.com/figadore/darktable-auto-export/internal/darktable"
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/staging"
+	"github.com/figadore/darktable-auto-export/internal/xmpmeta"
 )
 
 type LinkedImage interface {
@@ -24,6 +29,16 @@ type Raw struct {
 	Jpgs   map[string]*Jpg
 	srcDir string // Base directory where source files are found
 	dstDir string // Base directory where exported image files are found
+	// Exports named without a suffix, from before this raw shared its basename with another raw
+	// They may belong to any raw of the collision, so they aren't linked
+	AmbiguousJpgs []*Jpg
+	// Sidecars of the other convention, for versions that also have one of the preferred convention
+	IgnoredXmps []*Xmp
+	// Sidecars named without a raw extension, e.g. IMG.xmp for IMG.CR2 and IMG.ARW
+	// They may belong to any raw sharing the basename, so they aren't linked
+	AmbiguousXmps []*Xmp
+	jpgSuffix     string  // See JpgSuffix
+	layout        *layout // Names exports from a template, and records their sources. May be nil
 }
 
 func (i *Raw) GetPath() string {
@@ -116,9 +131,12 @@ func (raw *Raw) AddJpg(jpg *Jpg) {
 
 // GetJpgPath gets the jpg filename for a raw file
 func (raw *Raw) GetJpgPath(jpgDir string) string {
+	if raw.layout.templated() {
+		return raw.outputPath(jpgDir, nil)
+	}
 	base := raw.Path.GetBasename()           //e.g. _DSC1234_01
 	relativeDir := raw.Path.GetRelativeDir() //e.g. src
-	jpgRelativePath := fmt.Sprintf("%s.jpg", filepath.Join(relativeDir, base))
+	jpgRelativePath := fmt.Sprintf("%s%s.jpg", filepath.Join(relativeDir, base), raw.jpgSuffix)
 	return filepath.Join(jpgDir, jpgRelativePath)
 }
 
@@ -143,23 +161,29 @@ func (raw *Raw) Sync(exportParams darktable.ExportParams, dstDir string) error {
 		if err != nil {
 			return err
 		}
+		raw.recordOutput(dstDir, exportParams.OutputPath, nil, true, exportParams.DryRun)
 	}
 	return nil
 }
 
-func (raw *Raw) StageForDeletion(dryRun bool) error {
-	newPath := filepath.Join(raw.srcDir, "delete", raw.Path.GetRelativeDir(), filepath.Base(raw.GetPath()))
-	if dryRun {
-		fmt.Println("Move", raw.GetPath(), "to", newPath)
-		return nil
+// StageForDeletion moves the raw into the staging directory, recording it in m so it can be restored
+func (raw *Raw) StageForDeletion(m *staging.Manifest, reason string, dryRun bool) error {
+	newPath, err := m.Stage(raw.GetPath(), reason, dryRun)
+	if err != nil || dryRun {
+		return err
 	}
-	err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
-	if err != nil {
+	raw.Path.fullPath = newPath
+	return nil
+}
+
+// MoveToArchive moves the raw into the archive a, recording it so it can be found later
+func (raw *Raw) MoveToArchive(a *archive.Archive, reason string, dryRun bool) error {
+	newPath, err := a.Move(raw.GetPath(), reason, dryRun)
+	if err != nil || dryRun {
 		return err
 	}
-	err = os.Rename(raw.GetPath(), newPath)
 	raw.Path.fullPath = newPath
-	return err
+	return nil
 }
 
 func (raw *Raw) Delete(dryRun bool) error {
@@ -185,6 +209,13 @@ type Xmp struct {
 	Path ImagePath
 	Raw  *Raw
 	Jpg  *Jpg
+	meta *xmpmeta.Metadata // Parsed on first use
+	// Sidecar of the preferred convention used instead of this one, see Sidecars
+	IgnoredFor *Xmp
+	// Raws sharing a basename that this sidecar, named without a raw extension, may belong to
+	AmbiguousRaws []*Raw
+	// Last time darktable changed the history, when read from its library, zero if unknown
+	Changed time.Time
 }
 
 func (i *Xmp) GetPath() string {
@@ -227,19 +258,39 @@ func (xmp *Xmp) LinkJpg(jpg *Jpg) {
 	}
 }
 
+// Metadata reads the xmp file, caching the result
+func (xmp *Xmp) Metadata() (*xmpmeta.Metadata, error) {
+	if xmp.meta != nil {
+		return xmp.meta, nil
+	}
+	meta, err := xmpmeta.Read(xmp.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	xmp.meta = meta
+	return meta, nil
+}
+
+// IsVirtualCopy checks whether the xmp is a version other than the raw's original
+// Once linked, the raw's basename decides, as it may itself end in something like _1234
 func (xmp *Xmp) IsVirtualCopy() bool {
+	if xmp.Raw != nil {
+		return xmp.Path.GetBasename() != xmp.Raw.Path.GetBasename()
+	}
 	vSeq := xmp.Path.GetVSequence()
 	return vSeq != ""
 }
 
+// rawExtExp matches the raw extension in a darktable style xmp path, e.g. _DSC1234.ARW.xmp
+var rawExtExp = regexp.MustCompile(`^.+(\.[^.]+)\.[^.]+$`)
+
 // GetRawExt gets the extension of the linked raw file
 // Does not work for Adobe style xmps where raw extension is missing
 func (xmp *Xmp) GetRawExt() string {
 	if xmp.Raw != nil {
 		return xmp.Raw.GetRawExt()
 	}
-	exp := regexp.MustCompile(`^.+(\.[^.]+)\.[^.]+$`)
-	matches := exp.FindStringSubmatch(xmp.GetPath())
+	matches := rawExtExp.FindStringSubmatch(xmp.GetPath())
 	var rawExt string
 	if len(matches) >= 1 {
 		rawExt = matches[1]
@@ -258,10 +309,18 @@ func (xmp *Xmp) GetBasename() string {
 
 // GetJpgPath gets the jpg filename for an xmp file
 // This implementation assumes the only thing after the first "." is 'xmp' or '<raw-ext>.xmp'
+// The linked raw's suffix is added if it shares its basename with another raw
 func (xmp *Xmp) GetJpgPath(jpgDir string) string {
+	if xmp.Raw != nil && xmp.Raw.layout.templated() {
+		return xmp.Raw.outputPath(jpgDir, xmp)
+	}
 	base := xmp.Path.GetBasename()           //e.g. _DSC1234_01
 	relativeDir := xmp.Path.GetRelativeDir() //e.g. src
-	jpgRelativePath := fmt.Sprintf("%s.jpg", filepath.Join(relativeDir, base))
+	var suffix string
+	if xmp.Raw != nil {
+		suffix = xmp.Raw.jpgSuffix
+	}
+	jpgRelativePath := fmt.Sprintf("%s%s.jpg", filepath.Join(relativeDir, base), suffix)
 	return filepath.Join(jpgDir, jpgRelativePath)
 }
 
@@ -286,26 +345,35 @@ func (xmp *Xmp) GetJpgPath(jpgDir string) string {
 func (xmp *Xmp) Sync(exportParams darktable.ExportParams, dstDir string) error {
 	exportParams.OutputPath = xmp.GetJpgPath(dstDir)
 	exportParams.RawPath = xmp.Raw.GetPath()
+	// An existing jpg is kept with OnlyNew
+	_, statErr := os.Stat(exportParams.OutputPath)
+	exported := !exportParams.OnlyNew || statErr != nil
 	err := darktable.Export(exportParams)
 	if err != nil {
 		return err
 	}
+	xmp.Raw.recordOutput(dstDir, exportParams.OutputPath, xmp, exported, exportParams.DryRun)
 	return nil
 }
 
-func (xmp *Xmp) StageForDeletion(dryRun bool) error {
-	newPath := filepath.Join(xmp.Path.GetBaseDir(), "delete", xmp.Path.GetRelativeDir(), filepath.Base(xmp.GetPath()))
-	if dryRun {
-		fmt.Println("Move", xmp.GetPath(), "to", newPath)
-		return nil
+// StageForDeletion moves the xmp into the staging directory, recording it in m so it can be restored
+func (xmp *Xmp) StageForDeletion(m *staging.Manifest, reason string, dryRun bool) error {
+	newPath, err := m.Stage(xmp.GetPath(), reason, dryRun)
+	if err != nil || dryRun {
+		return err
 	}
-	err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
-	if err != nil {
+	xmp.Path.fullPath = newPath
+	return nil
+}
+
+// MoveToArchive moves the xmp into the archive a, recording it so it can be found later
+func (xmp *Xmp) MoveToArchive(a *archive.Archive, reason string, dryRun bool) error {
+	newPath, err := a.Move(xmp.GetPath(), reason, dryRun)
+	if err != nil || dryRun {
 		return err
 	}
-	err = os.Rename(xmp.GetPath(), newPath)
 	xmp.Path.fullPath = newPath
-	return err
+	return nil
 }
 
 func (xmp *Xmp) Delete(dryRun bool) error {
@@ -334,6 +402,12 @@ type Jpg struct {
 	Path ImagePath
 	Raw  *Raw
 	Xmp  *Xmp
+	// Raws sharing a basename that this export, named without a suffix, may belong to
+	AmbiguousRaws []*Raw
+	// Named from metadata that has since changed, e.g. the rating, so it was linked through
+	// the outputs map. The next export of its source replaces it
+	Outdated bool
+	layout   *layout
 }
 
 func (i *Jpg) GetPath() string {
@@ -365,7 +439,16 @@ func (jpg *Jpg) LinkXmp(xmp *Xmp) {
 	}
 }
 
+// IsVirtualCopy checks whether the jpg is an export of a version other than the raw's original
+// Once linked, the raw's basename decides, as it may itself end in something like _1234
+// Names from a template may not include the version, so only the linked xmp decides
 func (jpg *Jpg) IsVirtualCopy() bool {
+	if jpg.layout.templated() {
+		return jpg.Xmp != nil && jpg.Xmp.IsVirtualCopy()
+	}
+	if jpg.Raw != nil {
+		return jpg.Path.GetBasename() != jpg.Raw.Path.GetBasename()
+	}
 	vSeq := jpg.Path.GetVSequence()
 	return vSeq != ""
 }
@@ -401,6 +484,9 @@ func (jpg *Jpg) Delete(dryRun bool) error {
 	if err != nil {
 		return err
 	}
+	if jpg.layout != nil && jpg.layout.outputs != nil {
+		jpg.layout.outputs.Delete(jpg.Path.GetRelativePath())
+	}
 	// Unlink
 	if jpg.Xmp != nil {
 		jpg.Xmp.Jpg = nil
@@ -414,40 +500,76 @@ func (jpg *Jpg) Delete(dryRun bool) error {
 	return nil
 }
 
+// Options control how the source and export directories are scanned
+type Options struct {
+	Ignore       *ignore.Matcher   // Paths to skip, relative to the scanned directory. Defaults to ignore.Default()
+	ExportIgnore *ignore.Matcher   // Paths to skip in the exports dir. Defaults to Ignore, or ignore.DefaultExports()
+	Parallelism  int               // Directories read at once. Defaults to DefaultParallelism
+	CacheDir     string            // Where directory listings are cached between runs, "" to disable
+	Rescan       bool              // Read every directory, refreshing the cache
+	Naming       Naming            // How exports of raws sharing a basename are named. Defaults to NamingExtension
+	Template     *outputs.Template // Names exports instead of mirroring the source tree, nil for the default names
+	Outputs      *outputs.Map      // Sources of exports, updated as images are exported. Required with Template
+	DetectMoves  bool              // Record the size and hash of raws in Outputs, including those of existing exports, see DetectMoves
+	Sidecars     Sidecars          // Convention preferred when a raw has both. Defaults to SidecarsDarktable
+}
+
+// FindFilesWithExt recursively scans a directory for files with the specified extension,
+// skipping paths excluded by default
+func FindFilesWithExt(folder, extension string) ([]string, error) {
+	return Options{}.FindFilesWithExt(folder, extension)
+}
+
 // FindFilesWithExt recursively scans a directory for files with the specified extension
-func FindFilesWithExt(folder, extension string) []string {
-	var raws []string
-	err := filepath.WalkDir(folder, func(path string, info fs.DirEntry, e error) error {
-		if e != nil {
-			return e
-		}
-		// #recycle is for synology
-		// FIXME make ignore paths configurable
-		if strings.Contains(path, "#recycle") {
-			return nil
-		}
-		if strings.EqualFold(filepath.Ext(path), extension) {
-			raws = append(raws, path)
-		}
-		return nil
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	return raws
+// Paths excluded by the ignore patterns, or by .daeignore files found along the way, are skipped
+// Directories that can't be read, or with an invalid .daeignore, fail the scan once it's done
+func (o Options) FindFilesWithExt(folder, extension string) ([]string, error) {
+	l, err := merge(o.scan(folder, []string{extension}))
+	return l.files[strings.ToLower(extension)], err
 }
 
 // List all raws, xmps, and jpgs found in the sources and exports dir
 // Each returned object includes any linked objects that were detected
-func FindImages(sourcesDir, exportsDir string, extensions []string) ([]*Raw, []*Xmp, []*Jpg) {
+// The error lists the directories that couldn't be scanned
+func FindImages(sourcesDir, exportsDir string, extensions []string, opts Options) ([]*Raw, []*Xmp, []*Jpg, error) {
 	var raws []*Raw
-	var rawPaths []string
-	// Find all files with any of the given extensions
-	for _, ext := range extensions {
-		rawPaths = append(rawPaths, FindFilesWithExt(sourcesDir, ext)...)
+	var xmps []*Xmp
+	var jpgs []*Jpg
+	var errs []error
+	for batch := range StreamImages(sourcesDir, exportsDir, extensions, opts) {
+		if batch.Err != nil {
+			errs = append(errs, batch.Err)
+			continue
+		}
+		raws = append(raws, batch.Raws...)
+		xmps = append(xmps, batch.Xmps...)
+		jpgs = append(jpgs, batch.Jpgs...)
 	}
-	xmpPaths := FindFilesWithExt(sourcesDir, ".xmp")
-	jpgPaths := FindFilesWithExt(exportsDir, ".jpg")
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, nil, err
+	}
+	sortImages(raws, xmps, jpgs)
+	return raws, xmps, jpgs, nil
+}
+
+// NewImages creates and links raws, xmps, and jpgs from lists of paths found by
+// some other means than scanning the directories, e.g. from darktable's library
+// Raws sharing a basename are named with NamingExtension
+func NewImages(sourcesDir, exportsDir string, rawPaths, xmpPaths, jpgPaths []string) ([]*Raw, []*Xmp, []*Jpg) {
+	batch := NewBatch(sourcesDir, exportsDir, rawPaths, xmpPaths, jpgPaths, NamingExtension)
+	return batch.Raws, batch.Xmps, batch.Jpgs
+}
+
+// NewBatch creates and links raws, xmps, and jpgs like NewImages, naming raws sharing
+// a basename with naming, and reporting them as collisions
+func NewBatch(sourcesDir, exportsDir string, rawPaths, xmpPaths, jpgPaths []string, naming Naming) Batch {
+	return Options{Naming: naming}.NewBatch(sourcesDir, exportsDir, rawPaths, xmpPaths, jpgPaths)
+}
+
+// NewBatch creates and links raws, xmps, and jpgs like NewImages, naming exports by the
+// template if there is one. Exports given the same name by the template are reported as conflicts
+func (o Options) NewBatch(sourcesDir, exportsDir string, rawPaths, xmpPaths, jpgPaths []string) Batch {
+	var raws []*Raw
 	// Create a new Raw object for each found path
 	for _, rawPath := range rawPaths {
 		raw := NewRaw(ImagePath{fullPath: rawPath, basePath: sourcesDir})
@@ -463,13 +585,51 @@ func FindImages(sourcesDir, exportsDir string, extensions []string) ([]*Raw, []*
 		jpg := NewJpg(ImagePath{fullPath: jpgPath, basePath: exportsDir})
 		jpgs = append(jpgs, jpg)
 	}
-	linkImages(raws, xmps, jpgs)
-	return raws, xmps, jpgs
+	l := o.layout()
+	if l.templated() {
+		jpgs, conflicts := linkOutputs(sourcesDir, raws, xmps, jpgs, o)
+		l.backfill(jpgs)
+		return Batch{Raws: raws, Xmps: xmps, Jpgs: jpgs, Conflicts: conflicts, DuplicateSidecars: duplicateSidecars(raws), AmbiguousSidecars: ambiguousSidecars(xmps)}
+	}
+	collisions := linkImages(raws, xmps, jpgs, o)
+	l.apply(raws, jpgs)
+	l.backfill(jpgs)
+	return Batch{Raws: raws, Xmps: xmps, Jpgs: jpgs, Collisions: collisions, DuplicateSidecars: duplicateSidecars(raws), AmbiguousSidecars: ambiguousSidecars(xmps)}
+}
+
+// CheckConflicts fails if the template gives exports of different images the same name
+func CheckConflicts(conflicts []Conflict) error {
+	if len(conflicts) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, c := range conflicts {
+		lines = append(lines, c.String())
+	}
+	return fmt.Errorf("Exports would overwrite each other, add variables to the output template to tell them apart:\n%s", strings.Join(lines, "\n"))
+}
+
+// CheckCollisions fails if raws share a basename and naming is NamingFail
+func CheckCollisions(collisions []Collision, naming Naming) error {
+	if naming != NamingFail || len(collisions) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, c := range collisions {
+		lines = append(lines, c.String())
+	}
+	return fmt.Errorf("Exports of raws with the same basename would overwrite each other, set naming to '%s' or '%s' to tell them apart:\n%s",
+		NamingExtension, NamingModel, strings.Join(lines, "\n"))
 }
 
 // FindXmp looks for an xmp file at the specified path
 // The returned object includes any linked objects that were detected
-func FindXmp(path, sourcesDir, exportsDir string, extensions []string) (*Xmp, error) {
+func FindXmp(path, sourcesDir, exportsDir string, extensions []string, naming Naming) (*Xmp, error) {
+	return Options{Naming: naming}.FindXmp(path, sourcesDir, exportsDir, extensions)
+}
+
+// FindXmp looks for an xmp file at the specified path, naming its export by the template if there is one
+func (o Options) FindXmp(path, sourcesDir, exportsDir string, extensions []string) (*Xmp, error) {
 	xmp := NewXmp(ImagePath{fullPath: path, basePath: sourcesDir})
 	if !xmp.Path.Exists() {
 		return nil, fmt.Errorf("Unable to find xmp at '%x'", path)
@@ -478,7 +638,11 @@ func FindXmp(path, sourcesDir, exportsDir string, extensions []string) (*Xmp, er
 	rawDir := xmp.Path.GetFullDir()
 	var rawPaths []string
 	for _, ext := range extensions {
-		rawPaths = append(rawPaths, FindFilesWithExt(rawDir, ext)...)
+		paths, err := o.findInDir(sourcesDir, rawDir, ext)
+		if err != nil {
+			return nil, err
+		}
+		rawPaths = append(rawPaths, paths...)
 	}
 	var raws []*Raw
 	// TODO search for limited number of raws like GetJpgPath ?
@@ -486,149 +650,100 @@ func FindXmp(path, sourcesDir, exportsDir string, extensions []string) (*Xmp, er
 		raw := NewRaw(ImagePath{fullPath: rawPath, basePath: sourcesDir})
 		raws = append(raws, raw)
 	}
+	xmps := []*Xmp{xmp}
+	l := o.layout()
+	if l.templated() {
+		linkOutputs(sourcesDir, raws, xmps, nil, o)
+		jpg := NewJpg(ImagePath{fullPath: xmp.GetJpgPath(exportsDir), basePath: exportsDir})
+		if jpg.Path.Exists() {
+			linkOutput(jpg, xmp.Raw, xmp)
+		}
+		return xmp, nil
+	}
+	collisions := linkImages(raws, xmps, nil, o)
+	if err := CheckCollisions(collisions, o.naming()); err != nil {
+		return nil, err
+	}
+	l.apply(raws, nil)
+	// The jpg name depends on the linked raw, if it shares its basename with another raw
 	jpgDir := filepath.Join(exportsDir, xmp.Path.GetRelativeDir())
 	jpg := NewJpg(ImagePath{fullPath: xmp.GetJpgPath(jpgDir), basePath: exportsDir})
-	var jpgs []*Jpg
 	if jpg.Path.Exists() {
-		jpg := NewJpg(ImagePath{fullPath: jpg.GetPath(), basePath: exportsDir})
-		jpgs = []*Jpg{jpg}
+		xmp.LinkJpg(jpg)
 	}
-	xmps := []*Xmp{xmp}
-	linkImages(raws, xmps, jpgs)
 	return xmp, nil
 }
 
 // FindRaw looks for a raw file at the specified path
+// Raws with the same basename and one of the extensions are also found, so the
+// raw's exports are named as in a full sync
 // The returned object includes any linked objects that were detected
-func FindRaw(path, sourcesDir, exportsDir string) (*Raw, error) {
+func FindRaw(path, sourcesDir, exportsDir string, extensions []string, naming Naming) (*Raw, error) {
+	return Options{Naming: naming}.FindRaw(path, sourcesDir, exportsDir, extensions)
+}
+
+// FindRaw looks for a raw file at the specified path, naming its exports by the template if there is one
+// Exports named by a template may be anywhere in the exports dir, so they aren't linked
+func (o Options) FindRaw(path, sourcesDir, exportsDir string, extensions []string) (*Raw, error) {
 	raw := NewRaw(ImagePath{fullPath: path, basePath: sourcesDir})
 	if !raw.Path.Exists() {
 		return nil, fmt.Errorf("Unable to find raw at '%x'", path)
 	}
+	raws := []*Raw{raw}
+	for _, rawExt := range extensions {
+		paths, err := o.findInDir(sourcesDir, raw.Path.GetFullDir(), rawExt)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range paths {
+			name := filepath.Base(other)
+			if name == filepath.Base(path) || strings.TrimSuffix(name, filepath.Ext(name)) != raw.Path.GetBasename() {
+				continue
+			}
+			raws = append(raws, NewRaw(ImagePath{fullPath: other, basePath: sourcesDir}))
+		}
+	}
 
 	// optimization compared to FindImages, look only in relativeDir
 	xmpDir := raw.Path.GetFullDir()
-	xmpPaths := FindFilesWithExt(xmpDir, ".xmp")
+	xmpPaths, err := o.findInDir(sourcesDir, xmpDir, ".xmp")
+	if err != nil {
+		return nil, err
+	}
 	var xmps []*Xmp
 	for _, xmpPath := range xmpPaths {
 		xmp := NewXmp(ImagePath{fullPath: xmpPath, basePath: sourcesDir})
 		xmps = append(xmps, xmp)
 	}
+	l := o.layout()
+	if l.templated() {
+		linkOutputs(sourcesDir, raws, xmps, nil, o)
+		return raw, nil
+	}
 	jpgDir := filepath.Join(exportsDir, raw.Path.GetRelativeDir())
 	var jpgs []*Jpg
-	jpgPaths := FindFilesWithExt(jpgDir, ".jpg")
+	jpgPaths, err := o.ForExports().findInDir(exportsDir, jpgDir, ".jpg")
+	if err != nil {
+		return nil, err
+	}
 	for _, jpgPath := range jpgPaths {
 		jpg := NewJpg(ImagePath{fullPath: jpgPath, basePath: exportsDir})
 		jpgs = append(jpgs, jpg)
 	}
-	linkImages([]*Raw{raw}, xmps, jpgs)
-	return raw, nil
-}
-
-// For each raw, find corresponding xmps and jpgs
-// For each xmp, find corresponding jpgs and raws
-// For each jpg, find corresponding xmps and raws
-func linkImages(raws []*Raw, xmps []*Xmp, jpgs []*Jpg) {
-	for i, raw := range raws {
-		for j, xmp := range xmps {
-			if xmpMatchesRaw(xmp, raw) {
-				raws[i].AddXmp(xmps[j])
-			}
-		}
-		for j, jpg := range jpgs {
-			if jpgMatchesRaw(jpg, raw) {
-				raws[i].AddJpg(jpgs[j])
-			}
-		}
+	collisions := linkImages(raws, xmps, jpgs, o)
+	if err := CheckCollisions(collisions, o.naming()); err != nil {
+		return nil, err
 	}
-	for i, xmp := range xmps {
-		for j, jpg := range jpgs {
-			if jpgMatchesXmp(jpg, xmp) {
-				xmps[i].LinkJpg(jpgs[j])
-			}
-		}
-	}
-	for i, jpg := range jpgs {
-		for j, raw := range raws {
-			if jpgMatchesRaw(jpg, raw) {
-				jpgs[i].LinkRaw(raws[j])
-			}
-		}
-	}
-}
-
-func jpgMatchesXmp(jpg *Jpg, xmp *Xmp) bool {
-	jpgRelativePath := jpg.Path.GetRelativePath()
-	base := xmp.Path.GetBasename()
-	relativeDir := xmp.Path.GetRelativeDir()
-	exp := regexp.MustCompile(fmt.Sprintf(`^(%s/)?%s\.jpg$`, relativeDir, base))
-	if exp.Match([]byte(jpgRelativePath)) {
-		return true
-	}
-	return false
-}
-
-func xmpMatchesRaw(xmp *Xmp, raw *Raw) bool {
-	xmpPath := xmp.GetPath()
-	base := raw.Path.GetBasename()
-	ext := filepath.Ext(raw.GetPath())
-	dir := raw.Path.GetFullDir()
-	// basename.xmp
-	exp := regexp.MustCompile(fmt.Sprintf(`^%s/%s\.xmp$`, dir, base))
-	if exp.Match([]byte(xmpPath)) {
-		return true
-	}
-	// basename.ext.xmp
-	exp = regexp.MustCompile(fmt.Sprintf(`^%s/%s(?i)%s(?-i)\.xmp$`, dir, base, ext))
-	if exp.Match([]byte(xmpPath)) {
-		return true
-	}
-	// basename_XX.xmp
-	exp = regexp.MustCompile(fmt.Sprintf(`^%s/%s_\d\d\.xmp$`, dir, base))
-	if exp.Match([]byte(xmpPath)) {
-		return true
-	}
-	// basename_XX.ext.xmp
-	exp = regexp.MustCompile(fmt.Sprintf(`^%s/%s_\d\d(?i)%s(?-i)\.xmp$`, dir, base, ext))
-	if exp.Match([]byte(xmpPath)) {
-		return true
-	}
-	return false
+	l.apply(raws, jpgs)
+	return raw, nil
 }
 
-func jpgMatchesRaw(jpg *Jpg, raw *Raw) bool {
-	jpgPath := jpg.Path.GetRelativePath()
-	base := raw.Path.GetBasename()
-	ext := filepath.Ext(raw.GetPath())
-	dir := raw.Path.GetRelativeDir()
-	// basename.jpg
-	exp := regexp.MustCompile(fmt.Sprintf(`^(%s/)?%s\.jpg$`, dir, base))
-	if exp.Match([]byte(jpgPath)) {
-		return true
-	}
-	// basename.ext.jpg
-	exp = regexp.MustCompile(fmt.Sprintf(`^(%s/)?%s(?i)%s(?-i)\.jpg$`, dir, base, ext))
-	if exp.Match([]byte(jpgPath)) {
-		return true
-	}
-	// basename_XX.jpg
-	exp = regexp.MustCompile(fmt.Sprintf(`^(%s/)?%s_\d\d\.jpg$`, dir, base))
-	if exp.Match([]byte(jpgPath)) {
-		return true
-	}
-	// basename_XX.ext.jpg
-	exp = regexp.MustCompile(fmt.Sprintf(`^(%s/)?%s_\d\d(?i)%s(?-i)\.jpg$`, dir, base, ext))
-	if exp.Match([]byte(jpgPath)) {
-		return true
-	}
-	return false
-}
+var fileExp = regexp.MustCompile(`^.+\..+$`)
 
 // IsDir checks whether a path is a directory
 // This implementation is naive, assuming anything not matching  "*.*" is a directory
 func IsDir(path string) (bool, error) {
-	exp := regexp.MustCompile(`^.+\..+$`)
-	isFile := exp.Match([]byte(path))
+	isFile := fileExp.Match([]byte(path))
 	return !isFile, nil
 }
 
@@ -9,7 +9,10 @@ import (
 // TODO set up in-memory file system to make tests less brittle over time
 func TestFindFilesWithExt(t *testing.T) {
 	want := []string{"test/src/_DSC1234.ARW"}
-	raws := FindFilesWithExt("./test/src", ".arw")
+	raws, err := FindFilesWithExt("./test/src", ".arw")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(want, raws) {
 		t.Fatalf(`Wanted %s, got %s`, want, raws)
 	}
@@ -81,6 +84,8 @@ func TestXmpIsVirtualCopy(t *testing.T) {
 		{"/some/dir/_DSC1234_01.xmp", true},
 		{"/some/dir/_DSC1234_01.ARW.xmp", true},
 		{"/some/dir/_DSC1234.dng.xmp", false},
+		{"/some/dir/_DSC1234_100.ARW.xmp", true},
+		{"/some/dir/_DSC1234_012.ARW.xmp", false},
 	}
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt.xmpPath)
@@ -256,7 +261,7 @@ func TestLinkImages(t *testing.T) {
 			for _, jpg := range tt.jpgs {
 				jpgs = append(jpgs, NewJpg(jpg))
 			}
-			linkImages(raws, xmps, jpgs)
+			linkImages(raws, xmps, jpgs, Options{})
 			wantRaw, wantXmp, wantJpg := tt.setup()
 			for i, want := range wantRaw {
 				if want.String() != raws[i].String() {
@@ -344,9 +349,9 @@ func TestFindXmp(t *testing.T) {
 			for _, jpg := range tt.jpgs {
 				jpgs = append(jpgs, NewJpg(jpg))
 			}
-			linkImages(raws, xmps, jpgs)
+			linkImages(raws, xmps, jpgs, Options{})
 			_, wantXmp, _ := tt.setup()
-			xmp, err := FindXmp(tt.xmpPath, sourcesDir, exportsDir, extensions)
+			xmp, err := FindXmp(tt.xmpPath, sourcesDir, exportsDir, extensions, NamingExtension)
 			if err != nil {
 				t.Errorf("Failed to find xmp: %v", err)
 			}
@@ -413,9 +418,9 @@ func TestFindRaw(t *testing.T) {
 			for _, jpg := range tt.jpgs {
 				jpgs = append(jpgs, NewJpg(jpg))
 			}
-			linkImages(raws, xmps, jpgs)
+			linkImages(raws, xmps, jpgs, Options{})
 			wantRaw, _, _ := tt.setup()
-			raw, err := FindRaw(tt.rawPath, sourcesDir, exportsDir)
+			raw, err := FindRaw(tt.rawPath, sourcesDir, exportsDir, []string{".ARW"}, NamingExtension)
 			if err != nil {
 				t.Errorf("Failed to find raw: %v", err)
 			}
@@ -439,6 +444,8 @@ func TestXmpMatchesRaw(t *testing.T) {
 		{"/some/dir/_DSC1234.ARW.xmp", "/some/dir/_DSC1234.ARW", true},
 		{"/some/dir/_DSC1234.xmp", "/some/dir/_DSC1234.ARW", true},
 		{"/some/dir/_DSC1234_012.arw.xmp", "/some/dir/_DSC1234.ARW", false},
+		{"/some/dir/_DSC1234_100.arw.xmp", "/some/dir/_DSC1234.ARW", true},
+		{"/some/dir/_DSC1234_100.arw.xmp", "/some/dir/_DSC1234_100.ARW", true},
 		{"/some/dir/_DSC0234.xmp", "/some/dir/_DSC1234.ARW", false},
 	}
 	for _, tt := range tests {
@@ -0,0 +1,165 @@
+package linkedimage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+)
+
+// Move is an export whose raw was moved, and the path it is exported to now
+type Move struct {
+	Jpg *Jpg
+	Raw *Raw
+	Xmp *Xmp // nil if exported from the raw alone
+	To  string
+
+	source outputs.Source // What the jpg was recorded as exported from
+}
+
+func (m Move) String() string {
+	return fmt.Sprintf("Move %s to %s, following %s", m.Jpg.GetPath(), m.To, m.Raw.GetPath())
+}
+
+// moveTarget is an image without an export, that a moved jpg may belong to
+type moveTarget struct {
+	raw *Raw
+	xmp *Xmp
+}
+
+// xmpName is the file name of the target's xmp, "" without one
+func (t moveTarget) xmpName() string {
+	if t.xmp == nil {
+		return ""
+	}
+	return filepath.Base(t.xmp.GetPath())
+}
+
+// DetectMoves finds jpgs without a raw whose recorded source raw, by size and hash, is now
+// one of the raws without an export, e.g. after reorganising the source folders
+// The xmp must have the same name as the one the jpg was exported from, so versions keep
+// their exports. Only sources recorded with DetectMoves have a hash
+func DetectMoves(raws []*Raw, jpgs []*Jpg, exportsDir string, m *outputs.Map) []Move {
+	if m == nil {
+		return nil
+	}
+	// Orphaned exports, by the size of their raw
+	orphans := make(map[int64][]*Jpg)
+	sources := make(map[*Jpg]outputs.Source)
+	for _, jpg := range jpgs {
+		if jpg.Raw != nil {
+			continue
+		}
+		s, ok := m.Get(jpg.Path.GetRelativePath())
+		if !ok || s.Hash == "" {
+			continue
+		}
+		orphans[s.Size] = append(orphans[s.Size], jpg)
+		sources[jpg] = s
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	var moves []Move
+	moved := make(map[*Jpg]bool)
+	for _, raw := range raws {
+		info, err := os.Stat(raw.GetPath())
+		if err != nil || len(orphans[info.Size()]) == 0 {
+			continue
+		}
+		var targets []moveTarget
+		if len(raw.Xmps) == 0 {
+			targets = append(targets, moveTarget{raw: raw})
+		}
+		for _, xmp := range raw.Xmps {
+			targets = append(targets, moveTarget{raw: raw, xmp: xmp})
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i].xmpName() < targets[j].xmpName() })
+		// Hashed on first use, as most raws with the same size as an orphan's still have their exports
+		var hash string
+		for _, target := range targets {
+			to := target.exportPath(exportsDir)
+			if _, err := os.Stat(to); err == nil {
+				continue
+			}
+			if hash == "" {
+				if _, hash, err = outputs.HashFile(raw.GetPath()); err != nil {
+					fmt.Println("Unable to hash raw to look for moved exports:", err)
+					break
+				}
+			}
+			for _, jpg := range orphans[info.Size()] {
+				s := sources[jpg]
+				if moved[jpg] || s.Hash != hash || xmpName(s) != target.xmpName() {
+					continue
+				}
+				moved[jpg] = true
+				moves = append(moves, Move{Jpg: jpg, Raw: raw, Xmp: target.xmp, To: to, source: s})
+				break
+			}
+		}
+	}
+	return moves
+}
+
+// xmpName is the file name of the xmp a jpg was exported from, "" without one
+func xmpName(s outputs.Source) string {
+	if s.Xmp == "" {
+		return ""
+	}
+	return path.Base(s.Xmp)
+}
+
+// exportPath is where the target is exported to
+func (t moveTarget) exportPath(exportsDir string) string {
+	if t.xmp != nil {
+		return t.xmp.GetJpgPath(exportsDir)
+	}
+	return t.raw.GetJpgPath(exportsDir)
+}
+
+// Stale checks whether the xmp changed since the jpg was exported from it, so the jpg
+// should be exported again once moved. The jpg's mtime can't tell, as exports keep the
+// mtime of the jpg they replace. Jpgs recorded without the xmp's hash are always stale
+func (m Move) Stale() bool {
+	if m.Xmp == nil {
+		return false
+	}
+	if m.source.XmpHash == "" {
+		return true
+	}
+	_, hash, err := outputs.HashFile(m.Xmp.GetPath())
+	return err != nil || hash != m.source.XmpHash
+}
+
+// Apply moves the jpg and links it to its raw, recording its new path in the outputs map
+func (m Move) Apply(dryRun bool) error {
+	fmt.Println(m)
+	if dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.To), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(m.Jpg.GetPath(), m.To); err != nil {
+		return err
+	}
+	l := m.Raw.layout
+	if l != nil && l.outputs != nil {
+		l.outputs.Delete(m.Jpg.Path.GetRelativePath())
+		source := m.Raw.source(m.Xmp)
+		source.Size, source.Hash, source.XmpHash = m.source.Size, m.source.Hash, m.source.XmpHash
+		rel, err := filepath.Rel(m.Jpg.Path.GetBaseDir(), m.To)
+		if err == nil {
+			l.outputs.Set(rel, source)
+		}
+	}
+	m.Jpg.Path.fullPath = m.To
+	m.Jpg.Outdated = false
+	linkOutput(m.Jpg, m.Raw, m.Xmp)
+	return nil
+}
@@ -0,0 +1,173 @@
+package linkedimage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/darktable"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+func TestDetectMoves(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "new/A.ARW.xmp", "new/A_01.ARW.xmp", "new/C.ARW.xmp", "kept/D.ARW")
+	testutil.WriteTree(t, dst, "old/A.jpg", "old/A_01.jpg", "old/B.jpg", "old/C.jpg", "kept/D.jpg")
+	for name, content := range map[string]string{"new/A.ARW": "raw A", "new/C.ARW": "raw C", "kept/D.ARW": "raw A"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, hash, err := outputs.HashFile(filepath.Join(src, "new", "A.ARW"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmpHashes := make(map[string]string)
+	for _, name := range []string{"A.ARW.xmp", "A_01.ARW.xmp"} {
+		if _, xmpHashes[name], err = outputs.HashFile(filepath.Join(src, "new", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := outputs.LoadMap(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set("old/A.jpg", outputs.Source{Raw: "old/A.ARW", Xmp: "old/A.ARW.xmp", Size: size, Hash: hash, XmpHash: xmpHashes["A.ARW.xmp"]})
+	m.Set("old/A_01.jpg", outputs.Source{Raw: "old/A.ARW", Xmp: "old/A_01.ARW.xmp", Size: size, Hash: hash, XmpHash: xmpHashes["A_01.ARW.xmp"]})
+	// Same size as A, but a different raw
+	m.Set("old/B.jpg", outputs.Source{Raw: "old/B.ARW", Xmp: "old/B.ARW.xmp", Size: size, Hash: "0123"})
+	// Moved before hashes were recorded
+	m.Set("old/C.jpg", outputs.Source{Raw: "old/C.ARW", Xmp: "old/C.ARW.xmp"})
+
+	opts := Options{Outputs: m, DetectMoves: true}
+	raws, _, jpgs, err := FindImages(src, dst, []string{".ARW"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves := DetectMoves(raws, jpgs, dst, m)
+	if len(moves) != 2 {
+		t.Fatalf("Wanted 2 moves, got %v", moves)
+	}
+	// Exports found next to their raw are recorded with its hash, so they can follow it later
+	if s, ok := m.Get("kept/D.jpg"); !ok || s.Raw != "kept/D.ARW" || s.Hash != hash {
+		t.Errorf("got backfilled source %v %v", s, ok)
+	}
+	// The virtual copy was edited after its jpg was exported
+	if err := os.WriteFile(filepath.Join(src, "new", "A_01.ARW.xmp"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		from  string
+		to    string
+		stale bool
+	}{
+		{"old/A.jpg", "new/A.jpg", false},
+		{"old/A_01.jpg", "new/A_01.jpg", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			move := moves[i]
+			if got := filepath.ToSlash(move.Jpg.Path.GetRelativePath()); got != tt.from {
+				t.Errorf("got move from %s, want %s", got, tt.from)
+			}
+			if got := move.To; got != filepath.Join(dst, filepath.FromSlash(tt.to)) {
+				t.Errorf("got move to %s, want %s", got, tt.to)
+			}
+			if err := move.Apply(false); err != nil {
+				t.Fatal(err)
+			}
+			if got := move.Stale(); got != tt.stale {
+				t.Errorf("got stale %v, want %v", got, tt.stale)
+			}
+			if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(tt.to))); err != nil {
+				t.Errorf("Jpg should have been moved: %v", err)
+			}
+			if move.Jpg.Raw != move.Raw || move.Jpg.Xmp == nil || move.Jpg.Xmp.Jpg != move.Jpg {
+				t.Errorf("Moved jpg should be linked to its raw and xmp")
+			}
+			if _, ok := m.Get(tt.from); ok {
+				t.Errorf("Old path should be removed from the map")
+			}
+			if s, ok := m.Get(tt.to); !ok || s.Raw != "new/A.ARW" || s.Hash != hash {
+				t.Errorf("got new source %v %v", s, ok)
+			}
+		})
+	}
+}
+
+func TestStaleAfterReexport(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "old/A.ARW", "old/A.ARW.xmp")
+	// darktable-cli creates the jpg's directory
+	if err := os.MkdirAll(filepath.Join(dst, "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m, err := outputs.LoadMap(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Outputs: m, DetectMoves: true}
+	// Exports the xmp itself, so the jpg shows which edit it was exported from
+	command, err := darktable.ParseCommand([]string{"sh", "-c", `cat "$2" > "$3"`, "sh", "{raw}", "{xmp}", "{out}"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func() {
+		t.Helper()
+		raws, _, _, err := FindImages(src, dst, []string{".ARW"}, opts)
+		if err != nil || len(raws) != 1 {
+			t.Fatalf("got raws %v, %v", raws, err)
+		}
+		if err := raws[0].Sync(darktable.ExportParams{Command: command}, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jpg := filepath.Join(dst, "old", "A.jpg")
+	export()
+	exported := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(jpg, exported, exported); err != nil {
+		t.Fatal(err)
+	}
+	// Edited and exported again, which keeps the jpg's mtime
+	if err := os.WriteFile(filepath.Join(src, "old", "A.ARW.xmp"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	export()
+	if info, err := os.Stat(jpg); err != nil || !info.ModTime().Equal(exported) {
+		t.Fatalf("Expected the export to keep the jpg's mtime, got %v", err)
+	}
+	if content, err := os.ReadFile(jpg); err != nil || string(content) != "edited" {
+		t.Fatalf("got jpg %q, %v", content, err)
+	}
+
+	if err := os.Rename(filepath.Join(src, "old"), filepath.Join(src, "new")); err != nil {
+		t.Fatal(err)
+	}
+	raws, _, jpgs, err := FindImages(src, dst, []string{".ARW"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves := DetectMoves(raws, jpgs, dst, m)
+	if len(moves) != 1 {
+		t.Fatalf("Wanted 1 move, got %v", moves)
+	}
+	if err := moves[0].Apply(false); err != nil {
+		t.Fatal(err)
+	}
+	if moves[0].Stale() {
+		t.Errorf("Jpg exported from the current xmp shouldn't be stale")
+	}
+	// Edited after the move, before it is exported again
+	if err := os.WriteFile(filepath.Join(src, "new", "A.ARW.xmp"), []byte("edited twice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !moves[0].Stale() {
+		t.Errorf("Jpg should be stale after the xmp was edited")
+	}
+}
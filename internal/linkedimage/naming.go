@@ -0,0 +1,141 @@
+package linkedimage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/figadore/darktable-auto-export/internal/xmpmeta"
+)
+
+// Naming is how exports of raws sharing a basename in one directory, e.g. IMG_0001.CR3
+// and IMG_0001.ARW from two bodies, are told apart
+type Naming string
+
+const (
+	NamingExtension Naming = "extension" // IMG_0001.CR3.jpg and IMG_0001.ARW.jpg
+	NamingModel     Naming = "model"     // IMG_0001.EOS-R5.jpg, from tiff:Model in the xmp
+	NamingFail      Naming = "fail"      // Refuse to export, the names are only used for linking
+)
+
+// ParseNaming checks a naming strategy, defaulting to NamingExtension
+func ParseNaming(value string) (Naming, error) {
+	switch n := Naming(value); n {
+	case "":
+		return NamingExtension, nil
+	case NamingExtension, NamingModel, NamingFail:
+		return n, nil
+	}
+	return "", fmt.Errorf("Unknown naming '%s', expected '%s', '%s' or '%s'", value, NamingExtension, NamingModel, NamingFail)
+}
+
+// Collision is a set of raws in one directory sharing a basename
+type Collision struct {
+	Raws   []*Raw
+	Naming Naming // Strategy used, NamingExtension if models couldn't tell the raws apart
+}
+
+func (c Collision) String() string {
+	var names []string
+	for _, raw := range c.Raws {
+		if c.Naming == NamingFail {
+			names = append(names, filepath.Base(raw.GetPath()))
+		} else {
+			names = append(names, fmt.Sprintf("%s => %s%s.jpg", filepath.Base(raw.GetPath()), raw.Path.GetBasename(), raw.jpgSuffix))
+		}
+	}
+	return fmt.Sprintf("Raws in '%s' share a basename: %s", c.Raws[0].Path.GetRelativeDir(), strings.Join(names, ", "))
+}
+
+// disambiguate gives each raw that shares its directory and basename with another raw a suffix
+// for its exports. Xmps must already be linked, as the model is read from them
+func disambiguate(raws []*Raw, naming Naming) []Collision {
+	groups := make(map[imageKey][]*Raw)
+	var keys []imageKey
+	for _, raw := range raws {
+		key := rawKey(raw)
+		if len(groups[key]) == 0 {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], raw)
+	}
+	var collisions []Collision
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		collision := Collision{Raws: group, Naming: naming}
+		if naming == NamingModel && setModelSuffixes(group) {
+			collisions = append(collisions, collision)
+			continue
+		}
+		if naming == NamingModel {
+			collision.Naming = NamingExtension
+		}
+		for _, raw := range group {
+			raw.jpgSuffix = raw.GetRawExt()
+		}
+		collisions = append(collisions, collision)
+	}
+	return collisions
+}
+
+// setModelSuffixes uses the camera model as the suffix, if every raw has a distinct one
+func setModelSuffixes(group []*Raw) bool {
+	models := make(map[string]bool)
+	var suffixes []string
+	for _, raw := range group {
+		model := modelSuffix(raw.model())
+		if model == "" || models[strings.ToLower(model)] {
+			return false
+		}
+		models[strings.ToLower(model)] = true
+		suffixes = append(suffixes, "."+model)
+	}
+	for i, raw := range group {
+		raw.jpgSuffix = suffixes[i]
+	}
+	return true
+}
+
+// model reads the camera model from the raw's xmps, preferring the original's
+func (raw *Raw) model() string {
+	var paths []string
+	for path := range raw.Xmps {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		meta, err := raw.Xmps[path].Metadata()
+		if err != nil {
+			continue
+		}
+		if model := meta.Get(xmpmeta.NsTiff, "Model"); model != "" {
+			return model
+		}
+	}
+	return ""
+}
+
+// modelSuffix makes a camera model safe to use in a file name, without extra dots or version suffixes
+// "Canon EOS R5" => "Canon-EOS-R5"
+func modelSuffix(model string) string {
+	var b strings.Builder
+	for _, c := range strings.TrimSpace(model) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			b.WriteRune(c)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// JpgSuffix is added to the basename of the raw's exports to tell it apart from other
+// raws with the same basename, e.g. ".CR3" for IMG_0001.CR3.jpg. Empty if there are none
+func (raw *Raw) JpgSuffix() string {
+	return raw.jpgSuffix
+}
@@ -0,0 +1,161 @@
+package linkedimage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseNaming(t *testing.T) {
+	var tests = []struct {
+		value   string
+		want    Naming
+		wantErr bool
+	}{
+		{"", NamingExtension, false},
+		{"extension", NamingExtension, false},
+		{"model", NamingModel, false},
+		{"fail", NamingFail, false},
+		{"Extension", "", true},
+		{"counter", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseNaming(tt.value)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("got %v %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtensionNaming(t *testing.T) {
+	batch := NewBatch("/src", "/dst",
+		[]string{"/src/trip/IMG_0001.CR3", "/src/trip/IMG_0001.ARW", "/src/trip/IMG_0002.ARW"},
+		[]string{"/src/trip/IMG_0001.CR3.xmp", "/src/trip/IMG_0001_01.ARW.xmp", "/src/trip/IMG_0002.ARW.xmp"},
+		[]string{"/dst/trip/IMG_0001.jpg", "/dst/trip/IMG_0001.CR3.jpg", "/dst/trip/IMG_0001_01.ARW.jpg", "/dst/trip/IMG_0002.jpg"},
+		NamingExtension,
+	)
+	cr3, arw, other := batch.Raws[0], batch.Raws[1], batch.Raws[2]
+	legacy, cr3Jpg, arwJpg, otherJpg := batch.Jpgs[0], batch.Jpgs[1], batch.Jpgs[2], batch.Jpgs[3]
+	if len(batch.Collisions) != 1 || len(batch.Collisions[0].Raws) != 2 {
+		t.Fatalf("Wanted one collision of 2 raws, got %v", batch.Collisions)
+	}
+
+	var paths = []struct {
+		got  string
+		want string
+	}{
+		{cr3.GetJpgPath("/dst"), "/dst/trip/IMG_0001.CR3.jpg"},
+		{arw.GetJpgPath("/dst"), "/dst/trip/IMG_0001.ARW.jpg"},
+		{other.GetJpgPath("/dst"), "/dst/trip/IMG_0002.jpg"},
+		{batch.Xmps[0].GetJpgPath("/dst"), "/dst/trip/IMG_0001.CR3.jpg"},
+		{batch.Xmps[1].GetJpgPath("/dst"), "/dst/trip/IMG_0001_01.ARW.jpg"},
+		{batch.Xmps[2].GetJpgPath("/dst"), "/dst/trip/IMG_0002.jpg"},
+	}
+	for _, p := range paths {
+		if p.got != p.want {
+			t.Errorf("Jpg path %s, want %s", p.got, p.want)
+		}
+	}
+
+	if cr3Jpg.Raw != cr3 || cr3Jpg.Xmp != batch.Xmps[0] {
+		t.Errorf("CR3 export linked to %v and %v", cr3Jpg.Raw, cr3Jpg.Xmp)
+	}
+	if arwJpg.Raw != arw || arwJpg.Xmp != batch.Xmps[1] || !arwJpg.IsVirtualCopy() {
+		t.Errorf("ARW virtual copy export linked to %v and %v", arwJpg.Raw, arwJpg.Xmp)
+	}
+	if otherJpg.Raw != other || otherJpg.Xmp != batch.Xmps[2] {
+		t.Errorf("Unrelated raws should be named as before, got %v and %v", otherJpg.Raw, otherJpg.Xmp)
+	}
+	// The export from before the collision isn't linked to either raw
+	if legacy.Raw != nil || len(legacy.AmbiguousRaws) != 2 {
+		t.Errorf("Legacy export linked to %v, ambiguous %v", legacy.Raw, legacy.AmbiguousRaws)
+	}
+	if len(cr3.AmbiguousJpgs) != 1 || len(arw.AmbiguousJpgs) != 1 || len(cr3.Jpgs) != 1 || len(arw.Jpgs) != 1 {
+		t.Errorf("Wanted 1 linked and 1 ambiguous jpg per raw, got\n%s\n%s", cr3, arw)
+	}
+
+	if err := CheckCollisions(batch.Collisions, NamingExtension); err != nil {
+		t.Errorf("Only fail naming should fail, got %v", err)
+	}
+	if err := CheckCollisions(batch.Collisions, NamingFail); err == nil {
+		t.Errorf("Fail naming should fail on collisions")
+	}
+	if err := CheckCollisions(nil, NamingFail); err != nil {
+		t.Errorf("Fail naming without collisions should not fail, got %v", err)
+	}
+}
+
+// writeXmpModel writes a minimal sidecar with a camera model
+func writeXmpModel(t *testing.T, path, model string) {
+	t.Helper()
+	content := fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:tiff="http://ns.adobe.com/tiff/1.0/" tiff:Model="%s"/>
+ </rdf:RDF>
+</x:xmpmeta>`, model)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModelNaming(t *testing.T) {
+	src := t.TempDir()
+	var tests = []struct {
+		name        string
+		models      []string
+		wantSuffix  []string
+		wantNaming  Naming
+		writeSecond bool
+	}{
+		{"distinct models", []string{"Canon EOS R5", "ILCE-7M3"}, []string{".Canon-EOS-R5", ".ILCE-7M3"}, NamingModel, true},
+		{"same model", []string{"ILCE-7M3", "ilce-7m3"}, []string{".CR3", ".ARW"}, NamingExtension, true},
+		{"missing sidecar", []string{"ILCE-7M3", ""}, []string{".CR3", ".ARW"}, NamingExtension, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(src, fmt.Sprint(i))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			rawPaths := []string{filepath.Join(dir, "IMG_0001.CR3"), filepath.Join(dir, "IMG_0001.ARW")}
+			xmpPaths := []string{rawPaths[0] + ".xmp"}
+			writeXmpModel(t, xmpPaths[0], tt.models[0])
+			if tt.writeSecond {
+				xmpPaths = append(xmpPaths, rawPaths[1]+".xmp")
+				writeXmpModel(t, xmpPaths[1], tt.models[1])
+			}
+			batch := NewBatch(src, "/dst", rawPaths, xmpPaths, nil, NamingModel)
+			if len(batch.Collisions) != 1 || batch.Collisions[0].Naming != tt.wantNaming {
+				t.Fatalf("Wanted one collision named by %s, got %v", tt.wantNaming, batch.Collisions)
+			}
+			for j, raw := range batch.Raws {
+				if raw.JpgSuffix() != tt.wantSuffix[j] {
+					t.Errorf("Suffix %s, want %s", raw.JpgSuffix(), tt.wantSuffix[j])
+				}
+			}
+		})
+	}
+}
+
+func TestModelSuffix(t *testing.T) {
+	var tests = []struct {
+		model string
+		want  string
+	}{
+		{"ILCE-7M3", "ILCE-7M3"},
+		{"Canon EOS R5", "Canon-EOS-R5"},
+		{" E-M1MarkII ", "E-M1MarkII"},
+		{"X100V.", "X100V"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := modelSuffix(tt.model); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package linkedimage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+)
+
+// layout names exports from a template instead of mirroring the source tree, and
+// records the source of each export
+type layout struct {
+	template *outputs.Template // nil to mirror the source tree
+	outputs  *outputs.Map      // Sources of existing exports, may be nil
+	hashes   bool              // Record the size and hash of raws
+}
+
+func (o Options) layout() *layout {
+	if o.Template == nil && o.Outputs == nil {
+		return nil
+	}
+	return &layout{template: o.Template, outputs: o.Outputs, hashes: o.DetectMoves}
+}
+
+// templated checks whether exports are named by a template
+func (l *layout) templated() bool {
+	return l != nil && l.template != nil
+}
+
+// apply sets the layout of images linked by their names, so their exports are recorded
+func (l *layout) apply(raws []*Raw, jpgs []*Jpg) {
+	if l == nil {
+		return
+	}
+	for _, raw := range raws {
+		raw.layout = l
+	}
+	for _, jpg := range jpgs {
+		jpg.layout = l
+	}
+}
+
+// Conflict is a set of images whose exports the template gives the same name
+type Conflict struct {
+	Path    string // Relative to the exports dir
+	Sources []string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s would be exported from each of %s", c.Path, strings.Join(c.Sources, ", "))
+}
+
+// outputPath expands the template for the raw, or one of its xmps
+func (raw *Raw) outputPath(jpgDir string, xmp *Xmp) string {
+	return filepath.Join(jpgDir, filepath.FromSlash(raw.layout.template.Expand(raw.templateValues(xmp))))
+}
+
+// templateValues resolves the template variables from the raw's path and the xmp's metadata
+// Without an xmp, the raw's modification time is used as the date and the rating is 0
+func (raw *Raw) templateValues(xmp *Xmp) map[string]string {
+	values := map[string]string{
+		outputs.FileFolder:    filepath.ToSlash(raw.Path.GetRelativeDir()),
+		outputs.FileName:      raw.Path.GetBasename(),
+		outputs.FileExtension: strings.TrimPrefix(raw.GetRawExt(), "."),
+		outputs.Version:       "0",
+		outputs.Rating:        "0",
+	}
+	var date time.Time
+	if xmp != nil {
+		if xmp.IsVirtualCopy() {
+			_, sequence := splitVSequence(xmp.Path.GetBasename())
+			if version, err := strconv.Atoi(sequence); err == nil {
+				values[outputs.Version] = strconv.Itoa(version)
+				values[outputs.VersionSuffix] = "_" + sequence
+			}
+		}
+		if meta, err := xmp.Metadata(); err == nil {
+			date, _ = meta.DateTimeOriginal()
+			if rating, ok := meta.Rating(); ok {
+				values[outputs.Rating] = strconv.Itoa(rating)
+			}
+			values[outputs.Title] = meta.Title()
+			values[outputs.Labels] = strings.Join(meta.ColorLabels(), ",")
+		}
+	}
+	if date.IsZero() {
+		date, _ = raw.Path.ModTime()
+	}
+	values[outputs.ExifYear] = date.Format("2006")
+	values[outputs.ExifMonth] = date.Format("01")
+	values[outputs.ExifDay] = date.Format("02")
+	values[outputs.ExifHour] = date.Format("15")
+	values[outputs.ExifMinute] = date.Format("04")
+	values[outputs.ExifSecond] = date.Format("05")
+	return values
+}
+
+// source identifies the raw, and xmp if any, an export is made from
+func (raw *Raw) source(xmp *Xmp) outputs.Source {
+	s := outputs.Source{Raw: filepath.ToSlash(raw.Path.GetRelativePath())}
+	if xmp != nil {
+		s.Xmp = filepath.ToSlash(xmp.Path.GetRelativePath())
+	}
+	return s
+}
+
+// recordOutput remembers the source of an export, so it can be linked after its name changes
+// Unless exported, the jpg was kept as it was, so the hash of the xmp it was exported from
+// is carried over
+func (raw *Raw) recordOutput(jpgDir, outputPath string, xmp *Xmp, exported, dryRun bool) {
+	if raw.layout == nil || raw.layout.outputs == nil || dryRun {
+		return
+	}
+	rel, err := filepath.Rel(jpgDir, outputPath)
+	if err != nil {
+		return
+	}
+	s := raw.source(xmp)
+	if raw.layout.hashes {
+		s.Size, s.Hash, err = outputs.HashFile(raw.GetPath())
+		if err != nil {
+			fmt.Println("Unable to hash raw, its exports won't follow it if it moves:", err)
+		}
+		if xmp != nil && exported {
+			if _, s.XmpHash, err = outputs.HashFile(xmp.GetPath()); err != nil {
+				fmt.Println("Unable to hash xmp, its exports will be exported again if they move:", err)
+			}
+		} else if existing, ok := raw.layout.outputs.Get(rel); ok && existing.Xmp == s.Xmp {
+			s.XmpHash = existing.XmpHash
+		}
+	}
+	raw.layout.outputs.Set(rel, s)
+}
+
+// backfill records the size and hash of the raws of linked exports that have none, so
+// exports made before DetectMoves was enabled can follow their raws too
+// Jpgs of a raw with xmps, but not linked to one, are left out as their xmp is unknown
+func (l *layout) backfill(jpgs []*Jpg) {
+	if l == nil || l.outputs == nil || !l.hashes {
+		return
+	}
+	type hashed struct {
+		size int64
+		hash string
+		err  error
+	}
+	hashes := make(map[*Raw]hashed)
+	for _, jpg := range jpgs {
+		if jpg.Raw == nil || jpg.Outdated || (jpg.Xmp == nil && len(jpg.Raw.Xmps) > 0) {
+			continue
+		}
+		rel := jpg.Path.GetRelativePath()
+		if s, ok := l.outputs.Get(rel); ok && s.Hash != "" {
+			continue
+		}
+		h, ok := hashes[jpg.Raw]
+		if !ok {
+			h.size, h.hash, h.err = outputs.HashFile(jpg.Raw.GetPath())
+			hashes[jpg.Raw] = h
+			if h.err != nil {
+				fmt.Println("Unable to hash raw, its exports won't follow it if it moves:", h.err)
+			}
+		}
+		if h.err != nil {
+			continue
+		}
+		s := jpg.Raw.source(jpg.Xmp)
+		s.Size, s.Hash = h.size, h.hash
+		l.outputs.Set(rel, s)
+	}
+}
+
+// linkOutputs links xmps to raws like linkImages, then links jpgs named by the template
+// Jpgs at the path the template gives an image are linked to it. Other jpgs are linked
+// through the outputs map, as Outdated, if the raw and xmp they were exported from remain
+// The exports dir doesn't mirror the sources dir, so it is scanned whole. Jpgs recorded as
+// exports of raws that weren't scanned, e.g. outside the include patterns, are left out of
+// the returned jpgs as long as the raw exists
+func linkOutputs(sourcesDir string, raws []*Raw, xmps []*Xmp, jpgs []*Jpg, o Options) ([]*Jpg, []Conflict) {
+	l := o.layout()
+	// Suffixes for raws sharing a basename aren't used, the template decides the names
+	o.Naming = NamingExtension
+	linkImages(raws, xmps, nil, o)
+	type owner struct {
+		raw *Raw
+		xmp *Xmp
+	}
+	expected := make(map[string][]owner)
+	rawsByPath := make(map[string]*Raw, len(raws))
+	for _, raw := range raws {
+		raw.layout = l
+		rawsByPath[filepath.ToSlash(raw.Path.GetRelativePath())] = raw
+		if len(raw.Xmps) == 0 {
+			rel := l.template.Expand(raw.templateValues(nil))
+			expected[rel] = append(expected[rel], owner{raw: raw})
+		}
+	}
+	xmpsByPath := make(map[string]*Xmp, len(xmps))
+	for _, xmp := range xmps {
+		xmpsByPath[filepath.ToSlash(xmp.Path.GetRelativePath())] = xmp
+		if xmp.Raw != nil && xmp.IgnoredFor == nil {
+			rel := l.template.Expand(xmp.Raw.templateValues(xmp))
+			expected[rel] = append(expected[rel], owner{raw: xmp.Raw, xmp: xmp})
+		}
+	}
+
+	var conflicts []Conflict
+	for rel, owners := range expected {
+		if len(owners) < 2 {
+			continue
+		}
+		c := Conflict{Path: rel}
+		for _, o := range owners {
+			if o.xmp != nil {
+				c.Sources = append(c.Sources, o.xmp.GetPath())
+			} else {
+				c.Sources = append(c.Sources, o.raw.GetPath())
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+
+	var kept, outdated []*Jpg
+	for _, jpg := range jpgs {
+		jpg.layout = l
+		rel := filepath.ToSlash(jpg.Path.GetRelativePath())
+		if owners := expected[rel]; len(owners) == 1 {
+			linkOutput(jpg, owners[0].raw, owners[0].xmp)
+			kept = append(kept, jpg)
+			continue
+		}
+		var s outputs.Source
+		var ok bool
+		if l.outputs != nil {
+			s, ok = l.outputs.Get(rel)
+		}
+		raw := rawsByPath[s.Raw]
+		if ok && raw == nil {
+			if _, err := os.Stat(filepath.Join(sourcesDir, filepath.FromSlash(s.Raw))); err == nil {
+				continue
+			}
+		}
+		kept = append(kept, jpg)
+		if raw == nil {
+			continue
+		}
+		if s.Xmp == "" && len(raw.Xmps) == 0 {
+			jpg.Outdated = true
+			outdated = append(outdated, jpg)
+			linkOutput(jpg, raw, nil)
+		} else if xmp := xmpsByPath[s.Xmp]; xmp != nil && xmp.Raw == raw {
+			jpg.Outdated = true
+			outdated = append(outdated, jpg)
+			linkOutput(jpg, raw, xmp)
+		}
+	}
+	// An outdated export only stands in for its xmp's jpg until the new one exists
+	for _, jpg := range outdated {
+		if jpg.Xmp != nil && jpg.Xmp.Jpg == nil {
+			jpg.Xmp.Jpg = jpg
+		}
+	}
+	return kept, conflicts
+}
+
+// linkOutput links a jpg found by its path or the outputs map, without the name
+// based matching of LinkRaw and LinkXmp
+func linkOutput(jpg *Jpg, raw *Raw, xmp *Xmp) {
+	jpg.Raw = raw
+	raw.Jpgs[jpg.GetPath()] = jpg
+	raw.dstDir = jpg.Path.GetBaseDir()
+	if xmp != nil {
+		jpg.Xmp = xmp
+		if !jpg.Outdated {
+			xmp.Jpg = jpg
+		}
+	}
+}
+
+// Replacement is the path the jpg's source is exported to now, for an Outdated jpg
+// Empty if the jpg isn't linked to a source
+func (jpg *Jpg) Replacement(jpgDir string) string {
+	switch {
+	case jpg.Xmp != nil && jpg.Xmp.Raw != nil:
+		return jpg.Xmp.GetJpgPath(jpgDir)
+	case jpg.Raw != nil:
+		return jpg.Raw.GetJpgPath(jpgDir)
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package linkedimage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+// writeXmpRating writes a sidecar with a capture date and rating
+func writeXmpRating(t *testing.T, path, date string, rating int) {
+	t.Helper()
+	content := fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+   exif:DateTimeOriginal="%s" xmp:Rating="%d"/>
+ </rdf:RDF>
+</x:xmpmeta>`, date, rating)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutputTemplate(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "card1/_DSC0001.ARW", "card1/_DSC0002.ARW")
+	writeXmpRating(t, filepath.Join(src, "card1", "_DSC0001.ARW.xmp"), "2024:05:18 10:11:12", 3)
+	writeXmpRating(t, filepath.Join(src, "card1", "_DSC0001_01.ARW.xmp"), "2024:05:18 10:11:12", 5)
+	writeXmpRating(t, filepath.Join(src, "card1", "_DSC0002.ARW.xmp"), "2024:06:01 08:00:00", 2)
+	testutil.WriteTree(t, dst,
+		"2024/05/_DSC0001_0_3.jpg", // Current name
+		"2024/05/_DSC0001_1_4.jpg", // Rated 4 when exported
+		"2024/06/_DSC0002_0_1.jpg", // Rated 1 when exported, not in the map
+		"2023/_DSC0009_0_1.jpg",    // Recorded source is gone
+	)
+	outputMap, err := outputs.LoadMap(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputMap.Set("2024/05/_DSC0001_1_4.jpg", outputs.Source{Raw: "card1/_DSC0001.ARW", Xmp: "card1/_DSC0001_01.ARW.xmp"})
+	outputMap.Set("2023/_DSC0009_0_1.jpg", outputs.Source{Raw: "card1/_DSC0009.ARW", Xmp: "card1/_DSC0009.ARW.xmp"})
+	template, err := outputs.ParseTemplate("$(EXIF.DATE.YEAR)/$(EXIF.DATE.MONTH)/$(FILE_NAME)_$(VERSION)_$(RATING)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Template: template, Outputs: outputMap}
+
+	batches := 0
+	var jpgs []*Jpg
+	var xmps []*Xmp
+	for batch := range StreamImages(src, dst, []string{".ARW"}, opts) {
+		batches++
+		if len(batch.Conflicts) > 0 {
+			t.Errorf("Unexpected conflicts %v", batch.Conflicts)
+		}
+		jpgs = append(jpgs, batch.Jpgs...)
+		xmps = append(xmps, batch.Xmps...)
+	}
+	if batches != 1 {
+		t.Errorf("Wanted a single batch with an output template, got %d", batches)
+	}
+	sortImages(nil, xmps, jpgs)
+
+	var tests = []struct {
+		jpg          string
+		wantXmp      string
+		wantOutdated bool
+		wantVirtual  bool
+	}{
+		{"2023/_DSC0009_0_1.jpg", "", false, false},
+		{"2024/05/_DSC0001_0_3.jpg", "card1/_DSC0001.ARW.xmp", false, false},
+		{"2024/05/_DSC0001_1_4.jpg", "card1/_DSC0001_01.ARW.xmp", true, true},
+		{"2024/06/_DSC0002_0_1.jpg", "", false, false},
+	}
+	if len(jpgs) != len(tests) {
+		t.Fatalf("Wanted %d jpgs, got %d", len(tests), len(jpgs))
+	}
+	for i, tt := range tests {
+		t.Run(tt.jpg, func(t *testing.T) {
+			jpg := jpgs[i]
+			if got := filepath.ToSlash(jpg.Path.GetRelativePath()); got != tt.jpg {
+				t.Fatalf("got jpg %s, want %s", got, tt.jpg)
+			}
+			var gotXmp string
+			if jpg.Xmp != nil {
+				gotXmp = filepath.ToSlash(jpg.Xmp.Path.GetRelativePath())
+			}
+			if gotXmp != tt.wantXmp {
+				t.Errorf("got xmp '%s', want '%s'", gotXmp, tt.wantXmp)
+			}
+			if (jpg.Raw != nil) != (tt.wantXmp != "") {
+				t.Errorf("got raw %v, want linked %v", jpg.Raw, tt.wantXmp != "")
+			}
+			if jpg.Outdated != tt.wantOutdated {
+				t.Errorf("got outdated %v, want %v", jpg.Outdated, tt.wantOutdated)
+			}
+			if got := jpg.IsVirtualCopy(); got != tt.wantVirtual {
+				t.Errorf("got virtual copy %v, want %v", got, tt.wantVirtual)
+			}
+		})
+	}
+
+	// Outdated jpgs stand in for their xmp's export, and are replaced by the current name
+	outdated := jpgs[2]
+	if outdated.Xmp.Jpg != outdated {
+		t.Errorf("Outdated jpg should be linked from its xmp until re-exported")
+	}
+	if got, want := outdated.Replacement(dst), filepath.Join(dst, "2024", "05", "_DSC0001_1_5.jpg"); got != want {
+		t.Errorf("got replacement %s, want %s", got, want)
+	}
+	for _, xmp := range xmps {
+		if filepath.Base(xmp.GetPath()) != "_DSC0002.ARW.xmp" {
+			continue
+		}
+		if xmp.Jpg != nil {
+			t.Errorf("Jpg with an unknown name should not be linked to %s", xmp.GetPath())
+		}
+		xmp.Raw.recordOutput(dst, xmp.GetJpgPath(dst), xmp, true, false)
+	}
+	s, ok := outputMap.Get("2024/06/_DSC0002_0_2.jpg")
+	if !ok || s.Xmp != "card1/_DSC0002.ARW.xmp" {
+		t.Errorf("Export should be recorded in the map, got %v %v", s, ok)
+	}
+}
+
+func TestOutputTemplateConflicts(t *testing.T) {
+	src := t.TempDir()
+	testutil.WriteTree(t, src, "a/_DSC0001.ARW", "b/_DSC0001.ARW", "b/_DSC0002.ARW")
+	template, err := outputs.ParseTemplate("all/$(FILE_NAME)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawPaths := []string{
+		filepath.Join(src, "a", "_DSC0001.ARW"),
+		filepath.Join(src, "b", "_DSC0001.ARW"),
+		filepath.Join(src, "b", "_DSC0002.ARW"),
+	}
+	batch := Options{Template: template}.NewBatch(src, "/dst", rawPaths, nil, nil)
+	if len(batch.Conflicts) != 1 {
+		t.Fatalf("Wanted 1 conflict, got %v", batch.Conflicts)
+	}
+	if c := batch.Conflicts[0]; c.Path != "all/_DSC0001.jpg" || len(c.Sources) != 2 {
+		t.Errorf("Unexpected conflict %v", c)
+	}
+	if err := CheckConflicts(batch.Conflicts); err == nil {
+		t.Errorf("Expected an error for conflicting exports")
+	}
+}
+
+func TestDateLayout(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	writeXmpRating(t, filepath.Join(src, "card1", "_DSC0001.ARW.xmp"), "2024:05:18 10:11:12", 1)
+	writeXmpRating(t, filepath.Join(src, "card1", "_DSC0001_01.ARW.xmp"), "2024:05:18 10:11:12", 1)
+	writeXmpRating(t, filepath.Join(src, "card2", "_DSC0002.ARW.xmp"), "2024:05:19 09:00:00", 1)
+	testutil.WriteTree(t, src, "card1/_DSC0001.ARW", "card2/_DSC0002.ARW")
+	testutil.WriteTree(t, dst,
+		"2024/2024-05-18/_DSC0001.jpg",
+		"2024/2024-05-18/_DSC0001_01.jpg",
+		"2024/2024-05-19/_DSC0002.jpg", // Outside the include patterns
+		"2023/2023-01-01/_DSC0003.jpg", // Raw deleted since it was exported
+	)
+	outputMap, err := outputs.LoadMap(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputMap.Set("2024/2024-05-19/_DSC0002.jpg", outputs.Source{Raw: "card2/_DSC0002.ARW", Xmp: "card2/_DSC0002.ARW.xmp"})
+	outputMap.Set("2023/2023-01-01/_DSC0003.jpg", outputs.Source{Raw: "card2/_DSC0003.ARW"})
+	template, err := outputs.ParseLayout(outputs.LayoutDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := ignore.New([]string{"/card1/"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exports, err := ignore.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Ignore: sources, ExportIgnore: exports, Template: template, Outputs: outputMap}
+	raws, _, jpgs, err := FindImages(src, dst, []string{".ARW"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raws) != 1 {
+		t.Fatalf("Wanted only the included raw, got %v", raws)
+	}
+	var tests = []struct {
+		jpg     string
+		wantRaw bool
+	}{
+		{"2023/2023-01-01/_DSC0003.jpg", false},
+		{"2024/2024-05-18/_DSC0001.jpg", true},
+		{"2024/2024-05-18/_DSC0001_01.jpg", true},
+	}
+	if len(jpgs) != len(tests) {
+		t.Fatalf("Wanted %d jpgs, got %v", len(tests), jpgs)
+	}
+	for i, tt := range tests {
+		t.Run(tt.jpg, func(t *testing.T) {
+			if got := filepath.ToSlash(jpgs[i].Path.GetRelativePath()); got != tt.jpg {
+				t.Fatalf("got jpg %s, want %s", got, tt.jpg)
+			}
+			if (jpgs[i].Raw != nil) != tt.wantRaw {
+				t.Errorf("got raw %v, want linked %v", jpgs[i].Raw, tt.wantRaw)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package linkedimage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/scancache"
+)
+
+// DefaultParallelism is the number of directories read at once when not configured
+const DefaultParallelism = 4
+
+// listing is the files of a single directory, by lower case extension
+type listing struct {
+	relativeDir string
+	files       map[string][]string // Full paths
+	err         error               // Why the directory couldn't be read, its subdirectories are skipped
+}
+
+// Batch is the linked images of one directory
+type Batch struct {
+	Raws       []*Raw
+	Xmps       []*Xmp
+	Jpgs       []*Jpg
+	Collisions []Collision // Raws sharing a basename
+	Conflicts  []Conflict  // Images the output template gives the same name
+	// Sidecars not used because the raw has one of the preferred convention for the same version
+	DuplicateSidecars []DuplicateSidecar
+	// Sidecars not used because several raws share their basename
+	AmbiguousSidecars []AmbiguousSidecar
+	// A directory that couldn't be scanned. The batch has no images, and as the scan is
+	// incomplete, nothing should be deleted
+	Err error
+}
+
+func (o Options) parallelism() int {
+	if o.Parallelism < 1 {
+		return DefaultParallelism
+	}
+	return o.Parallelism
+}
+
+func (o Options) naming() Naming {
+	if o.Naming == "" {
+		return NamingExtension
+	}
+	return o.Naming
+}
+
+// ForExports gets the options for scanning the exports dir
+func (o Options) ForExports() Options {
+	if o.ExportIgnore != nil {
+		o.Ignore = o.ExportIgnore
+	} else if o.Ignore == nil {
+		o.Ignore = ignore.DefaultExports()
+	}
+	return o
+}
+
+func (o Options) matcher() *ignore.Matcher {
+	if o.Ignore == nil {
+		return ignore.Default()
+	}
+	return o.Ignore
+}
+
+// scan walks root once, reading up to Parallelism directories at a time, and
+// sends a listing of the files with any of the extensions for each directory that has some
+// Directories that can't be read are sent as a listing with an error
+func (o Options) scan(root string, extensions []string) <-chan listing {
+	wanted := make(map[string]bool)
+	for _, ext := range extensions {
+		wanted[strings.ToLower(ext)] = true
+	}
+	cache := o.openCache(root)
+	out := make(chan listing)
+	sem := make(chan struct{}, o.parallelism())
+	var wg sync.WaitGroup
+	var walk func(dir, relativeDir string, matcher *ignore.Matcher)
+	walk = func(dir, relativeDir string, matcher *ignore.Matcher) {
+		defer wg.Done()
+		sem <- struct{}{}
+		names, err := o.readDir(cache, dir, relativeDir)
+		if err == nil {
+			err = readIgnoreFile(&matcher, names.Files, dir, relativeDir)
+		}
+		<-sem
+		if err != nil {
+			out <- listing{relativeDir: relativeDir, err: fmt.Errorf("Unable to scan %s: %w", dir, err)}
+			return
+		}
+		for _, name := range names.Dirs {
+			relativePath := filepath.Join(relativeDir, name)
+			if !matcher.Excluded(relativePath, true) {
+				wg.Add(1)
+				go walk(filepath.Join(dir, name), relativePath, matcher)
+			}
+		}
+		l := listing{relativeDir: relativeDir, files: make(map[string][]string)}
+		for _, name := range names.Files {
+			ext := strings.ToLower(filepath.Ext(name))
+			if !wanted[ext] || matcher.Skip(filepath.Join(relativeDir, name)) {
+				continue
+			}
+			l.files[ext] = append(l.files[ext], filepath.Join(dir, name))
+		}
+		if len(l.files) > 0 {
+			out <- l
+		}
+	}
+	wg.Add(1)
+	go walk(root, ".", o.matcher())
+	go func() {
+		wg.Wait()
+		if cache != nil {
+			if err := cache.Save(); err != nil {
+				fmt.Println("Unable to save scan cache:", err)
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// openCache loads the listings cached for root, or returns nil if caching is disabled
+func (o Options) openCache(root string) *scancache.Cache {
+	if o.CacheDir == "" {
+		return nil
+	}
+	cache, err := scancache.Open(o.CacheDir, root)
+	if err != nil {
+		fmt.Println("Not using scan cache:", err)
+		return nil
+	}
+	return cache
+}
+
+// readDir lists the subdirectories and files in dir, from the cache if dir hasn't changed since
+func (o Options) readDir(cache *scancache.Cache, dir, relativeDir string) (scancache.Listing, error) {
+	if cache == nil {
+		return listDir(dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return scancache.Listing{}, err
+	}
+	if !o.Rescan {
+		if names, ok := cache.Get(relativeDir, info.ModTime()); ok {
+			return names, nil
+		}
+	}
+	// Taken before reading, so changes made while reading invalidate the listing next time
+	listedAt := time.Now()
+	names, err := listDir(dir)
+	if err != nil {
+		return names, err
+	}
+	names.ModTime = info.ModTime()
+	names.ListedAt = listedAt
+	cache.Put(relativeDir, names)
+	return names, nil
+}
+
+// listDir reads the names in dir, split into directories and everything else
+func listDir(dir string) (scancache.Listing, error) {
+	var names scancache.Listing
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return names, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names.Dirs = append(names.Dirs, entry.Name())
+		} else {
+			names.Files = append(names.Files, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// readIgnoreFile replaces matcher with a copy including the directory's .daeignore, if it has one
+// Matchers are shared with subdirectories, so they are never modified in place
+// The file itself is always read, as editing it doesn't change the directory's mtime
+func readIgnoreFile(matcher **ignore.Matcher, files []string, dir, relativeDir string) error {
+	for _, name := range files {
+		if name == ignore.FileName {
+			*matcher = (*matcher).Clone()
+			return (*matcher).ReadIgnoreFile(dir, relativeDir)
+		}
+	}
+	return nil
+}
+
+// findInDir lists the files in dir with the extension, for looking up a single image
+// without scanning the whole tree at root. Like a scan, files excluded by the patterns or
+// the .daeignore files of dir and its parents are skipped, and so is everything in an
+// excluded directory. A missing dir has no files
+func (o Options) findInDir(root, dir, extension string) ([]string, error) {
+	relativeDir, err := filepath.Rel(root, dir)
+	if err != nil || relativeDir == ".." || strings.HasPrefix(relativeDir, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is outside %s", dir, root)
+	}
+	matcher := o.matcher().Clone()
+	if err := matcher.ReadIgnoreFile(root, "."); err != nil {
+		return nil, err
+	}
+	current := "."
+	if relativeDir != "." {
+		for _, part := range strings.Split(relativeDir, string(filepath.Separator)) {
+			current = filepath.Join(current, part)
+			if matcher.Excluded(current, true) {
+				return nil, nil
+			}
+			if err := matcher.ReadIgnoreFile(filepath.Join(root, current), current); err != nil {
+				return nil, err
+			}
+		}
+	}
+	names, err := listDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range names.Files {
+		if !strings.EqualFold(filepath.Ext(name), extension) || matcher.Skip(filepath.Join(relativeDir, name)) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// StreamImages scans the sources and exports dir concurrently, in a single pass each,
+// and sends the linked images of each source directory as soon as the matching export
+// directory has been read, so they can be synced before the scan finishes.
+// Jpgs in export directories without a matching source directory are sent last
+// With an output template, exports may be in any directory, so everything is sent as one batch
+func StreamImages(sourcesDir, exportsDir string, extensions []string, opts Options) <-chan Batch {
+	sourceExts := append([]string{".xmp"}, extensions...)
+	sources := opts.scan(sourcesDir, sourceExts)
+	exports := opts.ForExports().scan(exportsDir, []string{".jpg"})
+	out := make(chan Batch)
+	if opts.Template != nil {
+		go func() {
+			defer close(out)
+			source, sourceErr := merge(sources)
+			export, exportErr := merge(exports)
+			if sourceErr != nil || exportErr != nil {
+				out <- Batch{Err: errors.Join(sourceErr, exportErr)}
+				return
+			}
+			out <- newBatch(sourcesDir, exportsDir, extensions, opts, source, export)
+		}()
+		return out
+	}
+	go func() {
+		defer close(out)
+		// Listings waiting for the other tree's listing of the same relative dir
+		pendingSources := make(map[string]listing)
+		pendingExports := make(map[string]listing)
+		// Batches are queued so scanning continues while the receiver is busy
+		var queue []Batch
+		for sources != nil || exports != nil || len(queue) > 0 {
+			var send chan<- Batch
+			var next Batch
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+			select {
+			case send <- next:
+				queue = queue[1:]
+			case l, ok := <-sources:
+				if !ok {
+					sources = nil
+					// Export directories without sources only have orphaned jpgs
+					for relativeDir, e := range pendingExports {
+						queue = append(queue, newBatch(sourcesDir, exportsDir, extensions, opts, listing{}, e))
+						delete(pendingExports, relativeDir)
+					}
+					continue
+				}
+				if l.err != nil {
+					queue = append(queue, Batch{Err: l.err})
+					continue
+				}
+				if e, found := pendingExports[l.relativeDir]; found || exports == nil {
+					delete(pendingExports, l.relativeDir)
+					queue = append(queue, newBatch(sourcesDir, exportsDir, extensions, opts, l, e))
+				} else {
+					pendingSources[l.relativeDir] = l
+				}
+			case l, ok := <-exports:
+				if !ok {
+					exports = nil
+					// Source directories without exports have no jpgs
+					for relativeDir, s := range pendingSources {
+						queue = append(queue, newBatch(sourcesDir, exportsDir, extensions, opts, s, listing{}))
+						delete(pendingSources, relativeDir)
+					}
+					continue
+				}
+				if l.err != nil {
+					queue = append(queue, Batch{Err: l.err})
+					continue
+				}
+				if s, found := pendingSources[l.relativeDir]; found {
+					delete(pendingSources, l.relativeDir)
+					queue = append(queue, newBatch(sourcesDir, exportsDir, extensions, opts, s, l))
+				} else if sources == nil {
+					queue = append(queue, newBatch(sourcesDir, exportsDir, extensions, opts, listing{}, l))
+				} else {
+					pendingExports[l.relativeDir] = l
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// newBatch creates and links the images of a source directory and the matching export directory
+// Files are only linked within the same relative directory, so each batch can be linked on its own
+func newBatch(sourcesDir, exportsDir string, extensions []string, opts Options, source, export listing) Batch {
+	var rawPaths []string
+	for _, ext := range extensions {
+		rawPaths = append(rawPaths, source.files[strings.ToLower(ext)]...)
+	}
+	return opts.NewBatch(sourcesDir, exportsDir, rawPaths, source.files[".xmp"], export.files[".jpg"])
+}
+
+// merge combines the listings of every directory into one, failing if any of them couldn't be read
+func merge(listings <-chan listing) (listing, error) {
+	merged := listing{files: make(map[string][]string)}
+	var errs []error
+	for l := range listings {
+		if l.err != nil {
+			errs = append(errs, l.err)
+			continue
+		}
+		for ext, paths := range l.files {
+			merged.files[ext] = append(merged.files[ext], paths...)
+		}
+	}
+	for _, paths := range merged.files {
+		sort.Strings(paths)
+	}
+	return merged, errors.Join(errs...)
+}
+
+// sortImages orders images by path, as batches arrive in no particular order
+func sortImages(raws []*Raw, xmps []*Xmp, jpgs []*Jpg) {
+	sort.Slice(raws, func(i, j int) bool { return raws[i].GetPath() < raws[j].GetPath() })
+	sort.Slice(xmps, func(i, j int) bool { return xmps[i].GetPath() < xmps[j].GetPath() })
+	sort.Slice(jpgs, func(i, j int) bool { return jpgs[i].GetPath() < jpgs[j].GetPath() })
+}
@@ -0,0 +1,236 @@
+package linkedimage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/ignore"
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+func TestStreamImages(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src,
+		"a/_DSC0001.ARW", "a/_DSC0001.ARW.xmp", "a/_DSC0001_01.ARW.xmp",
+		"a/b/_DSC0002.ARW",
+		"c/_DSC0003.ARW", "c/_DSC0003.ARW.xmp",
+		"c/rejects/_DSC0004.ARW",
+		"#recycle/_DSC0005.ARW",
+		"d/notes.txt",
+	)
+	if err := os.WriteFile(filepath.Join(src, "c", ".daeignore"), []byte("/rejects/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteTree(t, dst,
+		"a/_DSC0001.jpg", "a/_DSC0001_01.jpg", "a/_DSC0001_02.jpg",
+		"gone/_DSC0009.jpg",
+	)
+
+	for _, parallelism := range []int{1, 4} {
+		var raws []*Raw
+		var jpgs []*Jpg
+		batches := 0
+		for batch := range StreamImages(src, dst, []string{".ARW"}, Options{Parallelism: parallelism}) {
+			batches++
+			raws = append(raws, batch.Raws...)
+			jpgs = append(jpgs, batch.Jpgs...)
+		}
+		// One batch per source directory with images, and one for the orphaned export directory
+		if batches != 4 {
+			t.Errorf("Parallelism %d: wanted 4 batches, got %d", parallelism, batches)
+		}
+		sortImages(raws, nil, jpgs)
+		var rawPaths []string
+		for _, raw := range raws {
+			rawPaths = append(rawPaths, raw.Path.GetRelativePath())
+		}
+		want := []string{"a/_DSC0001.ARW", "a/b/_DSC0002.ARW", "c/_DSC0003.ARW"}
+		if len(rawPaths) != len(want) {
+			t.Fatalf("Parallelism %d: wanted raws %v, got %v", parallelism, want, rawPaths)
+		}
+		for i := range want {
+			if rawPaths[i] != want[i] {
+				t.Errorf("Parallelism %d: wanted raws %v, got %v", parallelism, want, rawPaths)
+			}
+		}
+		if len(raws[0].Xmps) != 2 || len(raws[0].Jpgs) != 3 {
+			t.Errorf("Parallelism %d: wanted 2 xmps and 3 jpgs linked, got\n%s", parallelism, raws[0])
+		}
+		for _, jpg := range jpgs {
+			if jpg.Path.GetRelativePath() == "gone/_DSC0009.jpg" && jpg.Raw != nil {
+				t.Errorf("Parallelism %d: orphaned jpg was linked to %s", parallelism, jpg.Raw.GetPath())
+			}
+		}
+		if len(jpgs) != 4 {
+			t.Errorf("Parallelism %d: wanted 4 jpgs, got %d", parallelism, len(jpgs))
+		}
+	}
+}
+
+// Linking per directory gives the same result as linking the whole tree at once
+func TestFindImagesMatchesWholeTree(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	rawPaths, xmpPaths, jpgPaths := syntheticTree(500)
+	for _, paths := range [][]ImagePath{rawPaths, xmpPaths} {
+		for _, p := range paths {
+			testutil.WriteTree(t, src, p.GetRelativePath())
+		}
+	}
+	for _, p := range jpgPaths {
+		testutil.WriteTree(t, dst, p.GetRelativePath())
+	}
+	raws, xmps, jpgs, err := FindImages(src, dst, []string{".ARW"}, Options{Parallelism: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rawFiles, xmpFiles, jpgFiles []string
+	for _, p := range rawPaths {
+		rawFiles = append(rawFiles, filepath.Join(src, p.GetRelativePath()))
+	}
+	for _, p := range xmpPaths {
+		xmpFiles = append(xmpFiles, filepath.Join(src, p.GetRelativePath()))
+	}
+	for _, p := range jpgPaths {
+		jpgFiles = append(jpgFiles, filepath.Join(dst, p.GetRelativePath()))
+	}
+	wantRaws, wantXmps, wantJpgs := NewImages(src, dst, rawFiles, xmpFiles, jpgFiles)
+	sortImages(wantRaws, wantXmps, wantJpgs)
+	if len(raws) != len(wantRaws) || len(xmps) != len(wantXmps) || len(jpgs) != len(wantJpgs) {
+		t.Fatalf("Wanted %d raws, %d xmps, %d jpgs, got %d, %d, %d",
+			len(wantRaws), len(wantXmps), len(wantJpgs), len(raws), len(xmps), len(jpgs))
+	}
+	for i := range raws {
+		if raws[i].String() != wantRaws[i].String() {
+			t.Errorf("Raw wanted \n%s\nbut got \n%s", wantRaws[i], raws[i])
+		}
+	}
+	for i := range jpgs {
+		if jpgs[i].String() != wantJpgs[i].String() {
+			t.Errorf("Jpg wanted \n%s\nbut got \n%s", wantJpgs[i], jpgs[i])
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "a/_DSC0001.ARW", "b/_DSC0002.ARW", "b/c/_DSC0003.ARW")
+	testutil.WriteTree(t, dst, "a/_DSC0001.jpg")
+	if err := os.WriteFile(filepath.Join(src, "b", ".daeignore"), []byte("[a-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var raws []*Raw
+	var errs []error
+	for batch := range StreamImages(src, dst, []string{".ARW"}, Options{Parallelism: 2}) {
+		if batch.Err != nil {
+			errs = append(errs, batch.Err)
+		}
+		raws = append(raws, batch.Raws...)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), ".daeignore") {
+		t.Errorf("Wanted an error for the invalid .daeignore, got %v", errs)
+	}
+	// Readable directories are still sent, the invalid one and its subdirectories aren't
+	if len(raws) != 1 || raws[0].GetPath() != filepath.Join(src, "a", "_DSC0001.ARW") {
+		t.Errorf("Wanted only a/_DSC0001.ARW, got %v", raws)
+	}
+
+	if _, _, _, err := FindImages(src, dst, []string{".ARW"}, Options{}); err == nil {
+		t.Error("FindImages should fail when a directory can't be scanned")
+	}
+	if _, err := FindFilesWithExt(src, ".ARW"); err == nil {
+		t.Error("FindFilesWithExt should fail when a directory can't be scanned")
+	}
+}
+
+func TestFindRawFollowsIgnores(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	testutil.WriteTree(t, src, "a/b/IMG.ARW", "a/b/IMG.ARW.xmp", "a/b/IMG_01.ARW.xmp", "a/b/IMG.CR2")
+	testutil.WriteTree(t, dst, "a/b/IMG.jpg", "a/b/IMG_01.jpg")
+	// Found in a parent directory, as a scan would have read it on the way down
+	if err := os.WriteFile(filepath.Join(src, "a", ".daeignore"), []byte("IMG_01.ARW.xmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := ignore.New(nil, []string{"*.CR2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := Options{Ignore: matcher}.FindRaw(filepath.Join(src, "a", "b", "IMG.ARW"), src, dst, []string{".ARW", ".CR2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.Xmps) != 1 || raw.Xmps[filepath.Join(src, "a", "b", "IMG.ARW.xmp")] == nil {
+		t.Errorf("Ignored xmp should be left out, got %v", raw.Xmps)
+	}
+	// The excluded CR2 doesn't collide with the raw, so its export keeps its plain name
+	if raw.JpgSuffix() != "" || raw.Jpgs[filepath.Join(dst, "a", "b", "IMG.jpg")] == nil {
+		t.Errorf("got suffix %q and jpgs %v", raw.JpgSuffix(), raw.Jpgs)
+	}
+}
+
+func TestScanCache(t *testing.T) {
+	src := t.TempDir()
+	testutil.WriteTree(t, src, "a/_DSC0001.ARW")
+	// Old enough to be outside the racy window
+	old := time.Now().Add(-time.Hour)
+	for _, dir := range []string{src, filepath.Join(src, "a")} {
+		if err := os.Chtimes(dir, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{CacheDir: t.TempDir()}
+	find := func(o Options) []string {
+		paths, err := o.FindFilesWithExt(src, ".ARW")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	if got := find(opts); len(got) != 1 {
+		t.Fatalf("Wanted 1 raw, got %v", got)
+	}
+
+	// A file added without changing the directory's mtime is only seen when rescanning
+	testutil.WriteTree(t, src, "a/_DSC0002.ARW")
+	if err := os.Chtimes(filepath.Join(src, "a"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := find(opts); len(got) != 1 {
+		t.Errorf("Unchanged directory should be read from the cache, got %v", got)
+	}
+	rescan := opts
+	rescan.Rescan = true
+	if got := find(rescan); len(got) != 2 {
+		t.Errorf("Rescan should read every directory, got %v", got)
+	}
+
+	// Changing the directory invalidates its listing
+	testutil.WriteTree(t, src, "a/_DSC0003.ARW")
+	info, err := os.Stat(filepath.Join(src, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := find(opts); len(got) != 3 {
+		t.Errorf("Modified directory should be read again, got %v", got)
+	}
+	// That listing was read within the racy window, so a file added in the same mtime tick is still found
+	testutil.WriteTree(t, src, "a/_DSC0004.ARW")
+	if err := os.Chtimes(filepath.Join(src, "a"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if got := find(opts); len(got) != 4 {
+		t.Errorf("Recently modified directory should be read again, got %v", got)
+	}
+}
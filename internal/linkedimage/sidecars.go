@@ -0,0 +1,126 @@
+package linkedimage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sidecars is a naming convention for xmp sidecars, used to pick one when a raw has both
+type Sidecars string
+
+const (
+	SidecarsDarktable Sidecars = "darktable" // _DSC1234.ARW.xmp, and _DSC1234_01.ARW.xmp for versions
+	SidecarsAdobe     Sidecars = "adobe"     // _DSC1234.xmp, as written by Lightroom and others
+)
+
+// ParseSidecars checks a sidecar precedence, defaulting to SidecarsDarktable
+func ParseSidecars(value string) (Sidecars, error) {
+	switch s := Sidecars(value); s {
+	case "":
+		return SidecarsDarktable, nil
+	case SidecarsDarktable, SidecarsAdobe:
+		return s, nil
+	}
+	return "", fmt.Errorf("Unknown sidecar precedence '%s', expected '%s' or '%s'", value, SidecarsDarktable, SidecarsAdobe)
+}
+
+func (o Options) sidecars() Sidecars {
+	if o.Sidecars == "" {
+		return SidecarsDarktable
+	}
+	return o.Sidecars
+}
+
+// Convention detects the naming convention of the xmp from the raw extension in its name
+func (xmp *Xmp) Convention() Sidecars {
+	name := strings.TrimSuffix(filepath.Base(xmp.GetPath()), filepath.Ext(xmp.GetPath()))
+	if filepath.Ext(name) != "" {
+		return SidecarsDarktable
+	}
+	return SidecarsAdobe
+}
+
+// preferSidecars unlinks sidecars of the other convention, where the raw has xmps of both
+// conventions for one version, e.g. _DSC1234.xmp and _DSC1234.ARW.xmp, which would
+// otherwise both be exported to _DSC1234.jpg
+func (raw *Raw) preferSidecars(prefer Sidecars) {
+	byBasename := make(map[string][]*Xmp)
+	for _, xmp := range raw.Xmps {
+		basename := xmp.Path.GetBasename()
+		byBasename[basename] = append(byBasename[basename], xmp)
+	}
+	for _, group := range byBasename {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].GetPath() < group[j].GetPath() })
+		var used *Xmp
+		for _, xmp := range group {
+			if xmp.Convention() == prefer {
+				used = xmp
+				break
+			}
+		}
+		if used == nil {
+			continue
+		}
+		for _, xmp := range group {
+			if xmp == used {
+				continue
+			}
+			xmp.IgnoredFor = used
+			delete(raw.Xmps, xmp.GetPath())
+			raw.IgnoredXmps = append(raw.IgnoredXmps, xmp)
+		}
+	}
+	sort.Slice(raw.IgnoredXmps, func(i, j int) bool { return raw.IgnoredXmps[i].GetPath() < raw.IgnoredXmps[j].GetPath() })
+}
+
+// DuplicateSidecar is an xmp that isn't used, as the raw has one of the preferred convention
+type DuplicateSidecar struct {
+	Ignored *Xmp
+	Used    *Xmp
+}
+
+func (d DuplicateSidecar) String() string {
+	return fmt.Sprintf("Both %s and %s exist for %s, using %s (%s style)",
+		filepath.Base(d.Used.GetPath()), filepath.Base(d.Ignored.GetPath()), d.Used.Raw.GetPath(), filepath.Base(d.Used.GetPath()), d.Used.Convention())
+}
+
+// duplicateSidecars lists the sidecars ignored in favour of the other convention
+func duplicateSidecars(raws []*Raw) []DuplicateSidecar {
+	var duplicates []DuplicateSidecar
+	for _, raw := range raws {
+		for _, xmp := range raw.IgnoredXmps {
+			duplicates = append(duplicates, DuplicateSidecar{Ignored: xmp, Used: xmp.IgnoredFor})
+		}
+	}
+	return duplicates
+}
+
+// AmbiguousSidecar is an xmp without a raw extension, shared by raws with the same basename
+type AmbiguousSidecar struct {
+	Xmp *Xmp
+}
+
+func (a AmbiguousSidecar) String() string {
+	var raws []string
+	for _, raw := range a.Xmp.AmbiguousRaws {
+		raws = append(raws, filepath.Base(raw.GetPath()))
+	}
+	return fmt.Sprintf("%s may belong to any of %s, so it isn't used. Rename it after its raw, e.g. %s.xmp",
+		a.Xmp.GetPath(), strings.Join(raws, ", "), raws[0])
+}
+
+// ambiguousSidecars lists the sidecars not linked as several raws share their basename
+func ambiguousSidecars(xmps []*Xmp) []AmbiguousSidecar {
+	var ambiguous []AmbiguousSidecar
+	for _, xmp := range xmps {
+		if len(xmp.AmbiguousRaws) > 0 {
+			ambiguous = append(ambiguous, AmbiguousSidecar{Xmp: xmp})
+		}
+	}
+	return ambiguous
+}
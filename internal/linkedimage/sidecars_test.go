@@ -0,0 +1,96 @@
+package linkedimage
+
+import (
+	"testing"
+)
+
+func TestParseSidecars(t *testing.T) {
+	var tests = []struct {
+		value   string
+		want    Sidecars
+		wantErr bool
+	}{
+		{"", SidecarsDarktable, false},
+		{"darktable", SidecarsDarktable, false},
+		{"adobe", SidecarsAdobe, false},
+		{"lightroom", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSidecars(tt.value)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("got %v %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSidecarPrecedence(t *testing.T) {
+	var tests = []struct {
+		sidecars Sidecars
+		used     string
+		ignored  string
+	}{
+		{SidecarsDarktable, "/src/IMG_0001.ARW.xmp", "/src/IMG_0001.xmp"},
+		{SidecarsAdobe, "/src/IMG_0001.xmp", "/src/IMG_0001.ARW.xmp"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.sidecars), func(t *testing.T) {
+			batch := Options{Sidecars: tt.sidecars}.NewBatch("/src", "/dst",
+				[]string{"/src/IMG_0001.ARW", "/src/IMG_0002.ARW"},
+				[]string{"/src/IMG_0001.ARW.xmp", "/src/IMG_0001.xmp", "/src/IMG_0001_01.ARW.xmp", "/src/IMG_0002.xmp"},
+				[]string{"/dst/IMG_0001.jpg", "/dst/IMG_0001_01.jpg", "/dst/IMG_0002.jpg"},
+			)
+			raw := batch.Raws[0]
+			if len(raw.Xmps) != 2 || raw.Xmps[tt.used] == nil || raw.Xmps["/src/IMG_0001_01.ARW.xmp"] == nil {
+				t.Errorf("got xmps %v, want %s and the virtual copy", raw.Xmps, tt.used)
+			}
+			if len(batch.DuplicateSidecars) != 1 {
+				t.Fatalf("Wanted one duplicate sidecar, got %v", batch.DuplicateSidecars)
+			}
+			d := batch.DuplicateSidecars[0]
+			if d.Used.GetPath() != tt.used || d.Ignored.GetPath() != tt.ignored {
+				t.Errorf("got used %s, ignored %s", d.Used.GetPath(), d.Ignored.GetPath())
+			}
+			if d.Ignored.Raw != raw || d.Ignored.Jpg != nil || d.Used.Jpg != batch.Jpgs[0] {
+				t.Errorf("Only the used sidecar should be linked to the jpg")
+			}
+			if len(raw.IgnoredXmps) != 1 || raw.IgnoredXmps[0] != d.Ignored {
+				t.Errorf("Ignored sidecar should be kept with its raw, got %v", raw.IgnoredXmps)
+			}
+			// A single sidecar is used whatever its convention
+			if other := batch.Raws[1]; len(other.Xmps) != 1 || other.Xmps["/src/IMG_0002.xmp"] == nil {
+				t.Errorf("got xmps %v for a raw with only an Adobe style sidecar", other.Xmps)
+			}
+		})
+	}
+}
+
+func TestAmbiguousSidecars(t *testing.T) {
+	batch := Options{}.NewBatch("/src", "/dst",
+		[]string{"/src/IMG_0001.ARW", "/src/IMG_0001.CR2", "/src/IMG_0002.ARW"},
+		[]string{"/src/IMG_0001.xmp", "/src/IMG_0001.CR2.xmp", "/src/IMG_0002.xmp"},
+		nil,
+	)
+	arw, cr2 := batch.Raws[0], batch.Raws[1]
+	shared := batch.Xmps[0]
+	if shared.GetPath() != "/src/IMG_0001.xmp" {
+		t.Fatalf("got xmps %v", batch.Xmps)
+	}
+	if shared.Raw != nil || len(shared.AmbiguousRaws) != 2 {
+		t.Errorf("Shared sidecar should not be linked, got raw %v, ambiguous %v", shared.Raw, shared.AmbiguousRaws)
+	}
+	if len(arw.Xmps) != 0 || len(arw.AmbiguousXmps) != 1 {
+		t.Errorf("got xmps %v, ambiguous %v for the ARW", arw.Xmps, arw.AmbiguousXmps)
+	}
+	// The sidecar named after its raw is still used
+	if len(cr2.Xmps) != 1 || cr2.Xmps["/src/IMG_0001.CR2.xmp"] == nil || len(cr2.AmbiguousXmps) != 1 {
+		t.Errorf("got xmps %v, ambiguous %v for the CR2", cr2.Xmps, cr2.AmbiguousXmps)
+	}
+	if other := batch.Raws[2]; len(other.Xmps) != 1 || len(other.AmbiguousXmps) != 0 {
+		t.Errorf("A raw with its own basename should use its Adobe style sidecar, got %v", other.Xmps)
+	}
+	if len(batch.AmbiguousSidecars) != 1 || batch.AmbiguousSidecars[0].Xmp != shared {
+		t.Errorf("Wanted the shared sidecar reported, got %v", batch.AmbiguousSidecars)
+	}
+}
@@ -0,0 +1,120 @@
+package outputs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/figadore/darktable-auto-export/internal/fileutil"
+)
+
+// MapFileName is the file in the output directory recording the source of each export
+const MapFileName = ".dae-outputs.json"
+
+// Source is what a jpg was exported from, relative to the input directory with "/" separators
+type Source struct {
+	Raw  string `json:"raw"`
+	Xmp  string `json:"xmp,omitempty"`    // Empty if the raw was exported without an xmp
+	Size int64  `json:"size,omitempty"`   // Size of the raw, if hashed
+	Hash string `json:"sha256,omitempty"` // Hex sha256 of the raw, to find it after it moves
+	// Hex sha256 of the xmp when the jpg was exported, to tell whether it was edited since
+	XmpHash string `json:"xmp_sha256,omitempty"`
+}
+
+// HashFile gets the size and hex sha256 of a file
+func HashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Map records the source of each export, by jpg path relative to the output directory
+// Names from a template may depend on metadata that changes later, e.g. the rating, so
+// exports can't always be matched to their source from their name alone
+type Map struct {
+	path    string
+	mu      sync.Mutex
+	sources map[string]Source
+	dirty   bool
+}
+
+// LoadMap reads the map in outDir, or starts an empty one
+func LoadMap(outDir string) (*Map, error) {
+	m := &Map{path: filepath.Join(outDir, MapFileName), sources: make(map[string]Source)}
+	content, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &m.sources); err != nil {
+		return nil, err
+	}
+	if m.sources == nil {
+		m.sources = make(map[string]Source)
+	}
+	return m, nil
+}
+
+// Get finds the source of a jpg
+func (m *Map) Get(jpg string) (Source, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sources[filepath.ToSlash(jpg)]
+	return s, ok
+}
+
+// Set records the source of a jpg
+func (m *Map) Set(jpg string, s Source) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jpg = filepath.ToSlash(jpg)
+	if existing, ok := m.sources[jpg]; ok && existing == s {
+		return
+	}
+	m.sources[jpg] = s
+	m.dirty = true
+}
+
+// Delete forgets a jpg, e.g. after deleting it
+func (m *Map) Delete(jpg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jpg = filepath.ToSlash(jpg)
+	if _, ok := m.sources[jpg]; ok {
+		delete(m.sources, jpg)
+		m.dirty = true
+	}
+}
+
+// Save writes the map if it changed
+func (m *Map) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	content, err := json.MarshalIndent(m.sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(m.path, content); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,65 @@
+package outputs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	outDir := t.TempDir()
+	m, err := LoadMap(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Get("a.jpg"); ok {
+		t.Fatalf("New map should be empty")
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, MapFileName)); !os.IsNotExist(err) {
+		t.Errorf("Unchanged map should not be written")
+	}
+
+	m.Set("2024/a.jpg", Source{Raw: "trip/a.ARW", Xmp: "trip/a.ARW.xmp"})
+	m.Set("2024/b.jpg", Source{Raw: "trip/b.ARW"})
+	m.Set("2024/c.jpg", Source{Raw: "trip/c.ARW"})
+	m.Delete("2024/c.jpg")
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = LoadMap(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		jpg    string
+		want   Source
+		wantOk bool
+	}{
+		{"2024/a.jpg", Source{Raw: "trip/a.ARW", Xmp: "trip/a.ARW.xmp"}, true},
+		{"2024/b.jpg", Source{Raw: "trip/b.ARW"}, true},
+		{"2024/c.jpg", Source{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.jpg, func(t *testing.T) {
+			got, ok := m.Get(tt.jpg)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("got %v %v, want %v %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestLoadInvalidMap(t *testing.T) {
+	outDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outDir, MapFileName), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Unlike a cache, losing the map would orphan renamed exports, so it's an error
+	if _, err := LoadMap(outDir); err == nil {
+		t.Errorf("Expected error for invalid map")
+	}
+}
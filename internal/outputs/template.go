@@ -0,0 +1,153 @@
+// Package outputs names exported jpgs from darktable style templates, and remembers
+// which source each export was made from
+package outputs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Variables that may be used in a template as $(NAME)
+const (
+	FileFolder    = "FILE_FOLDER"    // Directory of the raw, relative to the input directory
+	FileName      = "FILE_NAME"      // Basename of the raw, without extension
+	FileExtension = "FILE_EXTENSION" // Extension of the raw, without the dot
+	Version       = "VERSION"        // darktable version, 0 for the original
+	VersionSuffix = "VERSION.SUFFIX" // Suffix of the version's xmp, e.g. _01, empty for the original
+	ExifYear      = "EXIF.DATE.YEAR"
+	ExifMonth     = "EXIF.DATE.MONTH"
+	ExifDay       = "EXIF.DATE.DAY"
+	ExifHour      = "EXIF.DATE.HOUR"
+	ExifMinute    = "EXIF.DATE.MINUTE"
+	ExifSecond    = "EXIF.DATE.SECOND"
+	Rating        = "RATING"
+	Title         = "TITLE"
+	Labels        = "LABELS" // Color labels, comma separated
+)
+
+// DateLayout places jpgs by capture date, keeping the names they'd have in the mirrored layout
+const DateLayout = "$(EXIF.DATE.YEAR)/$(EXIF.DATE.YEAR)-$(EXIF.DATE.MONTH)-$(EXIF.DATE.DAY)/$(FILE_NAME)$(VERSION.SUFFIX)"
+
+// Values for the layout setting
+const (
+	LayoutMirror = "mirror" // Jpgs mirror the input directory
+	LayoutDate   = "date"   // See DateLayout
+)
+
+// ParseLayout gets the template for a layout, nil for LayoutMirror
+func ParseLayout(layout string) (*Template, error) {
+	switch layout {
+	case LayoutMirror, "":
+		return nil, nil
+	case LayoutDate:
+		return ParseTemplate(DateLayout)
+	}
+	return nil, fmt.Errorf("Unknown layout '%s', expected '%s' or '%s'", layout, LayoutMirror, LayoutDate)
+}
+
+// Variables lists every supported variable
+var Variables = []string{
+	FileFolder, FileName, FileExtension, Version, VersionSuffix,
+	ExifYear, ExifMonth, ExifDay, ExifHour, ExifMinute, ExifSecond,
+	Rating, Title, Labels,
+}
+
+type part struct {
+	literal  string
+	variable string
+}
+
+// Template is a jpg path relative to the output directory, without the .jpg extension
+// e.g. $(FILE_FOLDER)/$(FILE_NAME)_$(VERSION)
+type Template struct {
+	source string
+	parts  []part
+}
+
+// ParseTemplate checks the variables in a template, and that it stays inside the output directory
+func ParseTemplate(source string) (*Template, error) {
+	if source == "" {
+		return nil, fmt.Errorf("Output template must not be empty")
+	}
+	t := &Template{source: source}
+	rest := source
+	for rest != "" {
+		start := strings.Index(rest, "$(")
+		if start < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, part{literal: rest[:start]})
+		}
+		end := strings.IndexByte(rest[start:], ')')
+		if end < 0 {
+			return nil, fmt.Errorf("Unterminated variable in output template '%s'", source)
+		}
+		name := rest[start+2 : start+end]
+		if !isVariable(name) {
+			return nil, fmt.Errorf("Unknown variable $(%s) in output template '%s', expected one of %s", name, source, strings.Join(Variables, ", "))
+		}
+		t.parts = append(t.parts, part{variable: name})
+		rest = rest[start+end+1:]
+	}
+	// Check the literal parts, with a placeholder for each value
+	shape := t.expand(func(string) string { return "x" })
+	if strings.HasPrefix(shape, "/") || strings.HasSuffix(shape, "/") {
+		return nil, fmt.Errorf("Output template '%s' must be a relative file path", source)
+	}
+	for _, segment := range strings.Split(shape, "/") {
+		if segment == ".." {
+			return nil, fmt.Errorf("Output template '%s' must stay inside the output directory", source)
+		}
+	}
+	return t, nil
+}
+
+func isVariable(name string) bool {
+	for _, v := range Variables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Template) String() string {
+	return t.source
+}
+
+// Expand resolves the template to a jpg path relative to the output directory, using "/" separators
+// Values other than FILE_FOLDER can't add directories, as separators are replaced
+func (t *Template) Expand(values map[string]string) string {
+	expanded := t.expand(func(name string) string {
+		value := values[name]
+		if name == FileFolder {
+			return path.Clean("/" + value)[1:]
+		}
+		return sanitize(value)
+	})
+	return strings.TrimPrefix(path.Clean("/"+expanded), "/") + ".jpg"
+}
+
+func (t *Template) expand(value func(string) string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.variable != "" {
+			b.WriteString(value(p.variable))
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String()
+}
+
+// sanitize keeps a value within a single path segment
+func sanitize(value string) string {
+	value = strings.NewReplacer("/", "-", "\\", "-").Replace(value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
@@ -0,0 +1,104 @@
+package outputs
+
+import (
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	var tests = []struct {
+		template string
+		wantErr  bool
+	}{
+		{"$(FILE_FOLDER)/$(FILE_NAME)", false},
+		{"$(EXIF.DATE.YEAR)/$(EXIF.DATE.MONTH)/$(FILE_NAME)_$(VERSION)", false},
+		{"albums/$(LABELS)/$(TITLE) $(RATING)", false},
+		{"plain", false},
+		{"$(FILE_NAME", true},
+		{"$(FILENAME)", true},
+		{"/$(FILE_NAME)", true},
+		{"$(FILE_FOLDER)/", true},
+		{"../$(FILE_NAME)", true},
+		{"a/../../$(FILE_NAME)", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			_, err := ParseTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	var tests = []struct {
+		layout       string
+		wantTemplate string
+		wantErr      bool
+	}{
+		{"", "", false},
+		{LayoutMirror, "", false},
+		{LayoutDate, DateLayout, false},
+		{"album", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			template, err := ParseLayout(tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var got string
+			if template != nil {
+				got = template.String()
+			}
+			if got != tt.wantTemplate {
+				t.Errorf("got template '%s', want '%s'", got, tt.wantTemplate)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	values := map[string]string{
+		FileFolder:    "2024/trip",
+		FileName:      "_DSC1234",
+		FileExtension: "ARW",
+		Version:       "1",
+		ExifYear:      "2024",
+		ExifMonth:     "05",
+		ExifDay:       "18",
+		Rating:        "3",
+		Title:         "Harbour/dawn",
+		Labels:        "red,green",
+	}
+	var tests = []struct {
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{"$(FILE_FOLDER)/$(FILE_NAME)", values, "2024/trip/_DSC1234.jpg"},
+		{"$(EXIF.DATE.YEAR)/$(EXIF.DATE.YEAR)-$(EXIF.DATE.MONTH)-$(EXIF.DATE.DAY)/$(FILE_NAME)_$(VERSION)", values, "2024/2024-05-18/_DSC1234_1.jpg"},
+		{"$(FILE_NAME).$(FILE_EXTENSION)", values, "_DSC1234.ARW.jpg"},
+		{DateLayout, map[string]string{FileName: "_DSC1234", VersionSuffix: "_01", ExifYear: "2024", ExifMonth: "05", ExifDay: "18"}, "2024/2024-05-18/_DSC1234_01.jpg"},
+		{DateLayout, map[string]string{FileName: "_DSC1234", ExifYear: "2024", ExifMonth: "05", ExifDay: "18"}, "2024/2024-05-18/_DSC1234.jpg"},
+		{"$(RATING) stars/$(TITLE)", values, "3 stars/Harbour-dawn.jpg"},
+		{"$(LABELS)/$(FILE_NAME)", values, "red,green/_DSC1234.jpg"},
+		// Images in the root of the input directory, and missing values
+		{"$(FILE_FOLDER)/$(FILE_NAME)", map[string]string{FileFolder: ".", FileName: "a"}, "a.jpg"},
+		{"$(TITLE)/$(FILE_NAME)", map[string]string{FileName: "a"}, "a.jpg"},
+		{"$(FILE_FOLDER)/$(FILE_NAME)", map[string]string{FileFolder: "../up", FileName: "a"}, "up/a.jpg"},
+		{"x/$(TITLE)/$(FILE_NAME)", map[string]string{Title: "..", FileName: "a"}, "x/_/a.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			template, err := ParseTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := template.Expand(tt.values); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package scancache remembers directory listings between runs, keyed by the directory's modification time
+package scancache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/fileutil"
+)
+
+// Version is bumped whenever the file format changes, discarding older caches
+const Version = 1
+
+// RacyWindow is how long after a directory's modification time a listing can't be trusted
+// A file added within the same mtime tick as the listing, e.g. on a 2 second FAT or SMB
+// timestamp, doesn't change the mtime, so such listings are never reused
+const RacyWindow = 2 * time.Second
+
+// Listing is the names in a directory, as of ListedAt
+type Listing struct {
+	ModTime  time.Time `json:"modTime"`  // Directory mtime when it was listed
+	ListedAt time.Time `json:"listedAt"` // Time just before the directory was read
+	Dirs     []string  `json:"dirs"`
+	Files    []string  `json:"files"`
+}
+
+// Valid checks whether the listing still describes a directory with the given mtime
+func (l Listing) Valid(modTime time.Time) bool {
+	if !l.ModTime.Equal(modTime) {
+		return false
+	}
+	return l.ListedAt.Sub(l.ModTime) > RacyWindow
+}
+
+type file struct {
+	Version int                `json:"version"`
+	Root    string             `json:"root"`
+	Dirs    map[string]Listing `json:"dirs"` // By directory relative to root
+}
+
+// Cache holds the listings of one scanned tree
+// Only directories looked up or stored during this run are saved, so removed
+// directories drop out of the cache
+type Cache struct {
+	path     string
+	root     string
+	mu       sync.Mutex
+	previous map[string]Listing
+	current  map[string]Listing
+}
+
+// Open loads the cache for the tree at root from cacheDir
+// A missing, outdated or unreadable cache file starts an empty cache
+func Open(cacheDir, root string) (*Cache, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(absRoot))
+	c := &Cache{
+		path:     filepath.Join(cacheDir, "scan-"+hex.EncodeToString(sum[:8])+".json"),
+		root:     absRoot,
+		previous: make(map[string]Listing),
+		current:  make(map[string]Listing),
+	}
+	content, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(content, &f); err != nil {
+		fmt.Printf("Ignoring unreadable scan cache %s: %v\n", c.path, err)
+		return c, nil
+	}
+	if f.Version == Version && f.Root == absRoot && f.Dirs != nil {
+		c.previous = f.Dirs
+	}
+	return c, nil
+}
+
+// Get finds a valid listing for a directory relative to the root
+func (c *Cache) Get(relativeDir string, modTime time.Time) (Listing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.previous[relativeDir]
+	if !ok || !l.Valid(modTime) {
+		return Listing{}, false
+	}
+	c.current[relativeDir] = l
+	return l, true
+}
+
+// Put stores a fresh listing for a directory relative to the root
+func (c *Cache) Put(relativeDir string, l Listing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current[relativeDir] = l
+}
+
+// Save writes the listings used during this run
+// The same tree may be scanned twice at once, e.g. when in and out are the same directory,
+// so the file is replaced atomically
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	content, err := json.Marshal(file{Version: Version, Root: c.root, Dirs: c.current})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(c.path, content)
+}
+
+// DefaultDir gets the per-user cache directory, or "" if there is none
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "darktable-auto-export")
+}
@@ -0,0 +1,123 @@
+package scancache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValid(t *testing.T) {
+	modTime := time.Date(2024, 5, 18, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name     string
+		listedAt time.Time
+		current  time.Time
+		want     bool
+	}{
+		{"unchanged", modTime.Add(time.Hour), modTime, true},
+		{"modified since", modTime.Add(time.Hour), modTime.Add(2 * time.Hour), false},
+		{"mtime went back", modTime.Add(time.Hour), modTime.Add(-time.Hour), false},
+		{"listed in the same tick", modTime.Add(time.Second), modTime, false},
+		{"listed at the end of the racy window", modTime.Add(RacyWindow), modTime, false},
+		{"listed after the racy window", modTime.Add(RacyWindow + time.Millisecond), modTime, true},
+		{"listed before the mtime", modTime.Add(-time.Hour), modTime, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := Listing{ModTime: modTime, ListedAt: tt.listedAt}
+			if got := l.Valid(tt.current); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveAndOpen(t *testing.T) {
+	cacheDir := t.TempDir()
+	root := t.TempDir()
+	modTime := time.Date(2024, 5, 18, 12, 0, 0, 0, time.UTC)
+	listing := Listing{ModTime: modTime, ListedAt: modTime.Add(time.Hour), Dirs: []string{"trip"}, Files: []string{"a.ARW"}}
+
+	c, err := Open(cacheDir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(".", modTime); ok {
+		t.Fatalf("New cache should be empty")
+	}
+	c.Put(".", listing)
+	c.Put("gone", listing)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(cacheDir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.Get(".", modTime)
+	if !ok {
+		t.Fatalf("Expected cached listing")
+	}
+	if !reflect.DeepEqual(got.Files, listing.Files) || !reflect.DeepEqual(got.Dirs, listing.Dirs) {
+		t.Errorf("got %v, want %v", got, listing)
+	}
+	if _, ok := c.Get(".", modTime.Add(time.Second)); ok {
+		t.Errorf("Changed directory should not use the cache")
+	}
+	// Only listings used in the last run are kept
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Open(cacheDir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("gone", modTime); ok {
+		t.Errorf("Unused listing should have been dropped")
+	}
+
+	// Each tree has its own cache
+	other, err := Open(cacheDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Get(".", modTime); ok {
+		t.Errorf("Listing from another tree should not be used")
+	}
+}
+
+func TestOpenInvalidCache(t *testing.T) {
+	var tests = []struct {
+		name    string
+		content string
+	}{
+		{"corrupt", "{not json"},
+		{"old version", `{"version": 0, "dirs": {".": {}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheDir := t.TempDir()
+			root := t.TempDir()
+			c, err := Open(cacheDir, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(c.path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err = Open(cacheDir, root)
+			if err != nil {
+				t.Fatalf("Invalid cache should start empty, got error %v", err)
+			}
+			if len(c.previous) != 0 {
+				t.Errorf("Invalid cache should start empty, got %v", c.previous)
+			}
+		})
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing"), "."); err != nil {
+		t.Errorf("Missing cache dir should not be an error: %v", err)
+	}
+}
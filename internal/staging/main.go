@@ -0,0 +1,229 @@
+// Package staging moves source files that clean would delete into a staging directory,
+// recording each one in a manifest so they can be restored exactly where they were
+package staging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/figadore/darktable-auto-export/internal/fileutil"
+	"github.com/figadore/darktable-auto-export/internal/outputs"
+)
+
+// Dir is the directory in the input directory that files are staged in, keeping their
+// relative paths
+const Dir = "delete"
+
+// ManifestFileName is the file in Dir recording each staged file
+const ManifestFileName = ".dae-staged.json"
+
+// Entry is a staged file. Paths are relative to the input directory with "/" separators
+type Entry struct {
+	Original string    `json:"original"`
+	Staged   string    `json:"staged"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"sha256"`
+	StagedAt time.Time `json:"staged_at"`
+	Reason   string    `json:"reason"`
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s (staged %s, %s)", e.Original, e.StagedAt.Local().Format("2006-01-02 15:04"), e.Reason)
+}
+
+// Manifest is the log of files staged in an input directory
+type Manifest struct {
+	srcDir  string
+	entries []Entry
+	dirty   bool
+}
+
+// Load reads the manifest of srcDir, or starts an empty one
+func Load(srcDir string) (*Manifest, error) {
+	m := &Manifest{srcDir: srcDir}
+	content, err := os.ReadFile(m.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &m.entries); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", m.path(), err)
+	}
+	return m, nil
+}
+
+func (m *Manifest) path() string {
+	return filepath.Join(m.srcDir, Dir, ManifestFileName)
+}
+
+// abs gets the full path of a path relative to the input directory
+func (m *Manifest) abs(rel string) string {
+	return filepath.Join(m.srcDir, filepath.FromSlash(rel))
+}
+
+// Entries lists the staged files, oldest first
+func (m *Manifest) Entries() []Entry {
+	return append([]Entry{}, m.entries...)
+}
+
+// Stage moves a file in the input directory to the same relative path in Dir, recording
+// its hash and the reason it was staged. It returns the staged path
+func (m *Manifest) Stage(file, reason string, dryRun bool) (string, error) {
+	rel, err := filepath.Rel(m.srcDir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in the input directory %s", file, m.srcDir)
+	}
+	staged := filepath.Join(m.srcDir, Dir, rel)
+	fmt.Println("Move", file, "to", staged)
+	if dryRun {
+		return staged, nil
+	}
+	if _, err := os.Stat(staged); err == nil {
+		return "", fmt.Errorf("%s is already staged, restore or delete it first", staged)
+	}
+	size, hash, err := outputs.HashFile(file)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(staged), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file, staged); err != nil {
+		return "", err
+	}
+	m.entries = append(m.entries, Entry{
+		Original: filepath.ToSlash(rel),
+		Staged:   path.Join(Dir, filepath.ToSlash(rel)),
+		Size:     size,
+		Hash:     hash,
+		StagedAt: time.Now().UTC(),
+		Reason:   reason,
+	})
+	m.dirty = true
+	return staged, nil
+}
+
+// Forget drops the entry of a staged file, e.g. after deleting it
+func (m *Manifest) Forget(staged string) {
+	for i, e := range m.entries {
+		if m.abs(e.Staged) == staged {
+			m.entries = append(m.entries[:i], m.entries[i+1:]...)
+			m.dirty = true
+			return
+		}
+	}
+}
+
+// IsStaged checks whether the file at original is staged, and could still be restored
+func (m *Manifest) IsStaged(original string) bool {
+	for _, e := range m.entries {
+		if m.abs(e.Original) == original {
+			return true
+		}
+	}
+	return false
+}
+
+// Select lists the entries whose original path matches one of the glob patterns, all of
+// them without patterns
+// A pattern matches the relative path, the file name, or one of the parent directories,
+// so 2024/trip selects every file staged from that directory
+func (m *Manifest) Select(patterns []string) ([]Entry, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	var selected []Entry
+	for _, e := range m.entries {
+		if len(patterns) == 0 || Matches(patterns, e.Original) {
+			selected = append(selected, e)
+		}
+	}
+	return selected, nil
+}
+
+// Matches checks whether a relative path with "/" separators, its file name or one of its
+// parent directories matches one of the glob patterns
+func Matches(patterns []string, original string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+		if ok, _ := path.Match(pattern, path.Base(original)); ok {
+			return true
+		}
+		for p := original; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Restore moves the selected entries back to their original paths
+// Every entry is checked before anything is moved: the staged file must still have the
+// recorded size and hash, and nothing may have been created at the original path since
+func (m *Manifest) Restore(entries []Entry, dryRun bool) error {
+	var problems []string
+	for _, e := range entries {
+		if _, err := os.Stat(m.abs(e.Original)); err == nil {
+			problems = append(problems, fmt.Sprintf("%s already exists", e.Original))
+			continue
+		}
+		size, hash, err := outputs.HashFile(m.abs(e.Staged))
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if size != e.Size || hash != e.Hash {
+			problems = append(problems, fmt.Sprintf("%s changed since it was staged", e.Staged))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Not restoring anything:\n  %s", strings.Join(problems, "\n  "))
+	}
+	for _, e := range entries {
+		fmt.Println("Restore", m.abs(e.Staged), "to", m.abs(e.Original))
+		if dryRun {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(m.abs(e.Original)), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Rename(m.abs(e.Staged), m.abs(e.Original)); err != nil {
+			return err
+		}
+		m.Forget(m.abs(e.Staged))
+	}
+	return nil
+}
+
+// Save writes the manifest if it changed
+func (m *Manifest) Save() error {
+	if !m.dirty {
+		return nil
+	}
+	entries := m.entries
+	if entries == nil {
+		entries = []Entry{}
+	}
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(m.path(), content); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
@@ -0,0 +1,146 @@
+package staging
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/figadore/darktable-auto-export/internal/testutil"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageAndRestore(t *testing.T) {
+	src := t.TempDir()
+	raw := filepath.Join(src, "2024", "trip", "A.ARW")
+	xmp := filepath.Join(src, "2024", "trip", "A.ARW.xmp")
+	other := filepath.Join(src, "2023", "B.ARW")
+	for _, path := range []string{raw, xmp, other} {
+		writeFile(t, path, path)
+	}
+
+	m, err := Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{raw, xmp, other} {
+		staged, err := m.Stage(path, "no jpg", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(src, path)
+		if want := filepath.Join(src, Dir, rel); staged != want {
+			t.Errorf("Staged to %s, want %s", staged, want)
+		}
+		if testutil.Exists(path) || !testutil.Exists(staged) {
+			t.Errorf("%s should have been moved to %s", path, staged)
+		}
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloaded, as restore runs separately from clean
+	m, err = Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := m.Entries()
+	if len(entries) != 3 || entries[0].Original != "2024/trip/A.ARW" || entries[0].Staged != "delete/2024/trip/A.ARW" || entries[0].Hash == "" || entries[0].Reason != "no jpg" {
+		t.Fatalf("got entries %v", entries)
+	}
+	selected, err := m.Select([]string{"2024/trip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Restore(selected, false); err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.Exists(raw) || !testutil.Exists(xmp) || testutil.Exists(other) {
+		t.Errorf("Only the files staged from 2024/trip should be restored")
+	}
+	if got := m.Entries(); len(got) != 1 || got[0].Original != "2023/B.ARW" {
+		t.Errorf("Restored entries should be forgotten, got %v", got)
+	}
+}
+
+func TestRestoreChecks(t *testing.T) {
+	src := t.TempDir()
+	a := filepath.Join(src, "A.ARW")
+	b := filepath.Join(src, "B.ARW")
+	writeFile(t, a, "a")
+	writeFile(t, b, "b")
+	m, err := Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagedA, err := m.Stage(a, "no jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stage(b, "no jpg", false); err != nil {
+		t.Fatal(err)
+	}
+	// Changed after staging, so it isn't the file that was staged
+	writeFile(t, stagedA, "edited")
+	if err := m.Restore(m.Entries(), false); err == nil {
+		t.Fatalf("Expected error restoring a changed file")
+	}
+	if testutil.Exists(a) || testutil.Exists(b) {
+		t.Errorf("Nothing should be restored when one entry fails its checks")
+	}
+	// Something new at the original path is never overwritten
+	writeFile(t, b, "new b")
+	selected, _ := m.Select([]string{"B.ARW"})
+	if err := m.Restore(selected, false); err == nil {
+		t.Errorf("Expected error restoring over an existing file")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	m := &Manifest{entries: []Entry{
+		{Original: "2024/trip/_DSC1234.ARW"},
+		{Original: "2024/trip/_DSC1234.ARW.xmp"},
+		{Original: "2024/home/_DSC5678.ARW"},
+		{Original: "IMG.CR3"},
+	}}
+	var tests = []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"all", nil, []string{"2024/trip/_DSC1234.ARW", "2024/trip/_DSC1234.ARW.xmp", "2024/home/_DSC5678.ARW", "IMG.CR3"}},
+		{"directory", []string{"2024/trip/"}, []string{"2024/trip/_DSC1234.ARW", "2024/trip/_DSC1234.ARW.xmp"}},
+		{"name glob", []string{"*.ARW"}, []string{"2024/trip/_DSC1234.ARW", "2024/home/_DSC5678.ARW"}},
+		{"path glob", []string{"2024/*/_DSC5*"}, []string{"2024/home/_DSC5678.ARW"}},
+		{"several", []string{"IMG.CR3", "2024/home"}, []string{"2024/home/_DSC5678.ARW", "IMG.CR3"}},
+		{"no match", []string{"2023"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := m.Select(tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range selected {
+				got = append(got, e.Original)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := m.Select([]string{"[2024"}); err == nil {
+		t.Errorf("Expected error for an invalid pattern")
+	}
+}
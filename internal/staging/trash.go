@@ -0,0 +1,147 @@
+package staging
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Expired lists the entries staged more than retention before now
+func (m *Manifest) Expired(retention time.Duration, now time.Time) []Entry {
+	var expired []Entry
+	for _, e := range m.entries {
+		if now.Sub(e.StagedAt) > retention {
+			expired = append(expired, e)
+		}
+	}
+	return expired
+}
+
+// Size adds up the recorded sizes of entries
+func Size(entries []Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	return size
+}
+
+// inDir checks that a staged path recorded in the manifest is inside Dir
+func inDir(staged string) bool {
+	return path.Clean(staged) == staged && strings.HasPrefix(staged, Dir+"/") && !strings.HasPrefix(staged, Dir+"/../")
+}
+
+// Purge deletes the staged files of entries for good, and forgets them. It returns the
+// number of bytes freed
+// Only files recorded in the manifest are deleted, and only if they still have their
+// recorded size. Anything else in Dir is left alone
+func (m *Manifest) Purge(entries []Entry, dryRun bool) (int64, error) {
+	recorded := make(map[string]bool, len(m.entries))
+	for _, e := range m.entries {
+		recorded[e.Staged] = true
+	}
+	var freed int64
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		if !recorded[e.Staged] || !inDir(e.Staged) {
+			return freed, fmt.Errorf("%s is not a staged file", e.Staged)
+		}
+		staged := m.abs(e.Staged)
+		info, err := os.Lstat(staged)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted by hand, there's nothing left to purge
+			fmt.Println("Forget", staged, "(already deleted)")
+			if !dryRun {
+				m.Forget(staged)
+			}
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+		if !info.Mode().IsRegular() || info.Size() != e.Size {
+			fmt.Println("Keeping", staged, "as it changed since it was staged")
+			continue
+		}
+		fmt.Println("Purge", staged)
+		freed += e.Size
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(staged); err != nil {
+			return freed, err
+		}
+		m.Forget(staged)
+		dirs[filepath.Dir(staged)] = true
+	}
+	if dryRun {
+		return freed, nil
+	}
+	return freed, m.removeEmptyDirs(dirs)
+}
+
+// removeEmptyDirs removes the given directories in Dir, and their parents in Dir, that
+// have nothing left in them
+func (m *Manifest) removeEmptyDirs(dirs map[string]bool) error {
+	root := filepath.Join(m.srcDir, Dir)
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	// Deepest first
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		for ; dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+			entries, err := os.ReadDir(dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				break
+			}
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Untracked lists files in Dir that aren't in the manifest, e.g. staged by an older
+// version, which Purge never deletes
+func (m *Manifest) Untracked() ([]string, error) {
+	recorded := make(map[string]bool, len(m.entries))
+	for _, e := range m.entries {
+		recorded[e.Staged] = true
+	}
+	var untracked []string
+	err := filepath.WalkDir(filepath.Join(m.srcDir, Dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || p == m.path() {
+			return nil
+		}
+		rel, err := filepath.Rel(m.srcDir, p)
+		if err != nil {
+			return err
+		}
+		if !recorded[filepath.ToSlash(rel)] {
+			untracked = append(untracked, p)
+		}
+		return nil
+	})
+	return untracked, err
+}
@@ -0,0 +1,95 @@
+package staging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	m := &Manifest{entries: []Entry{
+		{Original: "old.ARW", StagedAt: now.Add(-31 * 24 * time.Hour), Size: 10},
+		{Original: "recent.ARW", StagedAt: now.Add(-29 * 24 * time.Hour), Size: 20},
+	}}
+	expired := m.Expired(30*24*time.Hour, now)
+	if len(expired) != 1 || expired[0].Original != "old.ARW" {
+		t.Errorf("got expired %v, want old.ARW", expired)
+	}
+	if got := Size(m.Entries()); got != 30 {
+		t.Errorf("got size %d, want 30", got)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	src := t.TempDir()
+	a := filepath.Join(src, "2024", "trip", "A.ARW")
+	b := filepath.Join(src, "2024", "B.ARW")
+	writeFile(t, a, "raw a")
+	writeFile(t, b, "raw b")
+	m, err := Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagedA, err := m.Stage(a, "no jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagedB, err := m.Stage(b, "no jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not staged by clean, so never purged
+	stray := filepath.Join(src, Dir, "2024", "stray.ARW")
+	writeFile(t, stray, "stray")
+	// Changed since it was staged
+	writeFile(t, stagedB, "edited raw b")
+
+	untracked, err := m.Untracked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(untracked) != 1 || untracked[0] != stray {
+		t.Errorf("got untracked %v, want %s", untracked, stray)
+	}
+
+	freed, err := m.Purge(m.Entries(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != int64(len("raw a")) {
+		t.Errorf("got %d bytes freed, want %d", freed, len("raw a"))
+	}
+	var tests = []struct {
+		path   string
+		exists bool
+	}{
+		{stagedA, false},
+		{filepath.Dir(stagedA), false},
+		{stagedB, true},
+		{stray, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := os.Stat(tt.path)
+			if exists := err == nil; exists != tt.exists {
+				t.Errorf("got exists %v, want %v", exists, tt.exists)
+			}
+		})
+	}
+	if got := m.Entries(); len(got) != 1 || got[0].Original != "2024/B.ARW" {
+		t.Errorf("Only purged files should be forgotten, got %v", got)
+	}
+
+	// Entries that aren't in the manifest, or point outside Dir, are refused
+	for _, e := range []Entry{{Staged: Dir + "/2024/stray.ARW"}, {Staged: Dir + "/../2024/B.ARW"}} {
+		if _, err := m.Purge([]Entry{e}, false); err == nil {
+			t.Errorf("Expected error purging %s", e.Staged)
+		}
+	}
+	m.entries = append(m.entries, Entry{Staged: Dir + "/../other.ARW"})
+	if _, err := m.Purge(m.entries[1:], false); err == nil {
+		t.Errorf("Expected error purging a path outside %s", Dir)
+	}
+}
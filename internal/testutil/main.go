@@ -0,0 +1,28 @@
+// Package testutil has file helpers shared by the tests of other packages
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// WriteTree creates files at the given paths, relative to root, containing their paths
+func WriteTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		path := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Exists checks whether there is a file at path
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,198 @@
+// Package xmpmeta reads metadata from xmp sidecar files as written by darktable
+package xmpmeta
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespaces of the properties read from sidecars
+const (
+	NsRdf  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NsExif = "http://ns.adobe.com/exif/1.0/"
+	NsXmp  = "http://ns.adobe.com/xap/1.0/"
+	NsTiff = "http://ns.adobe.com/tiff/1.0/"
+	NsDc   = "http://purl.org/dc/elements/1.1/"
+	NsDt   = "http://darktable.sf.net/"
+	NsLr   = "http://ns.adobe.com/lightroom/1.0/"
+)
+
+// colorLabels are darktable's color labels, by the number stored in darktable:colorlabels
+var colorLabels = []string{"red", "yellow", "green", "blue", "purple"}
+
+// Metadata holds the properties of a sidecar's rdf:Description
+// Simple properties have a single value, arrays (rdf:Seq, rdf:Bag, rdf:Alt) one value per item
+type Metadata struct {
+	properties map[xml.Name][]string
+}
+
+// Read parses the xmp file at path
+func Read(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse xmp '%s': %w", path, err)
+	}
+	return m, nil
+}
+
+// Parse reads the properties of every rdf:Description, whether written as
+// attributes or as child elements
+func Parse(r io.Reader) (*Metadata, error) {
+	m := &Metadata{properties: make(map[xml.Name][]string)}
+	decoder := xml.NewDecoder(r)
+	// Depth of elements inside the current rdf:Description, -1 when outside
+	depth := -1
+	var property xml.Name
+	var text strings.Builder
+	var items []string
+	inItem := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case depth < 0 && t.Name == xml.Name{Space: NsRdf, Local: "Description"}:
+				depth = 0
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "xmlns" || attr.Name.Space == "" || attr.Name.Space == NsRdf {
+						continue
+					}
+					m.properties[attr.Name] = append(m.properties[attr.Name], attr.Value)
+				}
+			case depth == 0:
+				depth++
+				property = t.Name
+				text.Reset()
+				items = nil
+			case depth > 0:
+				depth++
+				if t.Name == (xml.Name{Space: NsRdf, Local: "li"}) {
+					inItem = true
+					text.Reset()
+				}
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case depth == 0:
+				depth = -1
+			case depth == 1:
+				depth--
+				if items != nil {
+					m.properties[property] = append(m.properties[property], items...)
+				} else if value := strings.TrimSpace(text.String()); value != "" {
+					m.properties[property] = append(m.properties[property], value)
+				}
+			case depth > 1:
+				depth--
+				if inItem && t.Name == (xml.Name{Space: NsRdf, Local: "li"}) {
+					items = append(items, strings.TrimSpace(text.String()))
+					inItem = false
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// Get returns the first value of a property, or "" if missing
+func (m *Metadata) Get(space, local string) string {
+	values := m.properties[xml.Name{Space: space, Local: local}]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// GetAll returns every value of a property
+func (m *Metadata) GetAll(space, local string) []string {
+	return m.properties[xml.Name{Space: space, Local: local}]
+}
+
+// DateTimeOriginal is the capture time, in local time if the sidecar has no zone
+func (m *Metadata) DateTimeOriginal() (time.Time, bool) {
+	return ParseDate(m.Get(NsExif, "DateTimeOriginal"))
+}
+
+// Rating is xmp:Rating, -1 for images rejected in darktable. ok is false if missing or invalid
+func (m *Metadata) Rating() (rating int, ok bool) {
+	rating, err := strconv.Atoi(m.Get(NsXmp, "Rating"))
+	return rating, err == nil
+}
+
+// Title is the first dc:title
+func (m *Metadata) Title() string {
+	return m.Get(NsDc, "title")
+}
+
+// ColorLabels lists the names of darktable's color labels, e.g. red and green
+func (m *Metadata) ColorLabels() []string {
+	var labels []string
+	for _, value := range m.GetAll(NsDt, "colorlabels") {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i >= len(colorLabels) {
+			continue
+		}
+		labels = append(labels, colorLabels[i])
+	}
+	return labels
+}
+
+// IsColorLabel checks whether name is one of darktable's color labels
+func IsColorLabel(name string) bool {
+	for _, label := range colorLabels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Tags lists the hierarchical tags in lr:hierarchicalSubject, e.g. albums|Family|2024 Trip,
+// followed by the plain tags in dc:subject
+func (m *Metadata) Tags() []string {
+	tags := append([]string{}, m.GetAll(NsLr, "hierarchicalSubject")...)
+	return append(tags, m.GetAll(NsDc, "subject")...)
+}
+
+// Exif style dates as well as XMP's ISO 8601 dates, with or without fractional seconds or zone
+var dateLayouts = []string{
+	"2006:01:02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ParseDate reads a date in any of the formats used in xmp files
+func ParseDate(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
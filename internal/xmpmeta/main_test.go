@@ -0,0 +1,169 @@
+package xmpmeta
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Trimmed down sidecar as written by darktable
+const darktableXmp = `<?xml version="1.0" encoding="UTF-8"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 4.4.0-Exiv2">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:darktable="http://darktable.sf.net/"
+    xmlns:lr="http://ns.adobe.com/lightroom/1.0/"
+   exif:DateTimeOriginal="2022:05:14 10:11:12.345"
+   xmp:Rating="3"
+   xmpMM:DerivedFrom="_DSC1234.ARW"
+   darktable:xmp_version="5">
+   <darktable:colorlabels>
+    <rdf:Seq>
+     <rdf:li>0</rdf:li>
+     <rdf:li>2</rdf:li>
+    </rdf:Seq>
+   </darktable:colorlabels>
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">Harbour at dawn</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>2024 Trip</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <lr:hierarchicalSubject>
+    <rdf:Bag>
+     <rdf:li>albums|Family|2024 Trip</rdf:li>
+    </rdf:Bag>
+   </lr:hierarchicalSubject>
+   <darktable:history>
+    <rdf:Seq>
+     <rdf:li darktable:operation="exposure" darktable:enabled="1"/>
+    </rdf:Seq>
+   </darktable:history>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+// Properties written as elements rather than attributes, as other tools do
+const elementXmp = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/" xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+   <exif:DateTimeOriginal>2021-12-31T23:59:58+01:00</exif:DateTimeOriginal>
+   <xmp:Rating>1</xmp:Rating>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(darktableXmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		space string
+		local string
+		want  []string
+	}{
+		{NsXmp, "Rating", []string{"3"}},
+		{"http://ns.adobe.com/xap/1.0/mm/", "DerivedFrom", []string{"_DSC1234.ARW"}},
+		{"http://darktable.sf.net/", "colorlabels", []string{"0", "2"}},
+		{"http://purl.org/dc/elements/1.1/", "title", []string{"Harbour at dawn"}},
+		{"http://darktable.sf.net/", "missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.local, func(t *testing.T) {
+			got := m.GetAll(tt.space, tt.local)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := m.Get(NsRdf, "about"); got != "" {
+		t.Errorf("rdf attributes should not be properties, got %s", got)
+	}
+}
+
+func TestDarktableProperties(t *testing.T) {
+	m, err := Parse(strings.NewReader(darktableXmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rating, ok := m.Rating(); !ok || rating != 3 {
+		t.Errorf("got rating %d %v, want 3", rating, ok)
+	}
+	if got := m.Title(); got != "Harbour at dawn" {
+		t.Errorf("got title %s", got)
+	}
+	if got, want := m.ColorLabels(), []string{"red", "green"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels %v, want %v", got, want)
+	}
+	if got, want := m.Tags(), []string{"albums|Family|2024 Trip", "2024 Trip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+	empty, err := Parse(strings.NewReader(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := empty.Rating(); ok {
+		t.Errorf("Missing rating should not be ok")
+	}
+	if got := empty.ColorLabels(); len(got) != 0 {
+		t.Errorf("got labels %v, want none", got)
+	}
+}
+
+func TestParseElements(t *testing.T) {
+	m, err := Parse(strings.NewReader(elementXmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Get(NsXmp, "Rating"); got != "1" {
+		t.Errorf("got rating %s, want 1", got)
+	}
+	got, ok := m.DateTimeOriginal()
+	want := time.Date(2021, 12, 31, 22, 59, 58, 0, time.UTC)
+	if !ok || !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse(strings.NewReader("<x:xmpmeta><rdf:RDF>")); err == nil {
+		t.Errorf("Expected error for truncated xmp")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	var tests = []struct {
+		date string
+		want time.Time
+		ok   bool
+	}{
+		{"2022:05:14 10:11:12", time.Date(2022, 5, 14, 10, 11, 12, 0, time.Local), true},
+		{"2022:05:14 10:11:12.5", time.Date(2022, 5, 14, 10, 11, 12, 5e8, time.Local), true},
+		{"2022-05-14T10:11:12", time.Date(2022, 5, 14, 10, 11, 12, 0, time.Local), true},
+		{"2022-05-14T10:11:12Z", time.Date(2022, 5, 14, 10, 11, 12, 0, time.UTC), true},
+		{"2022-05-14T10:11+02:00", time.Date(2022, 5, 14, 8, 11, 0, 0, time.UTC), true},
+		{"2022-05-14", time.Date(2022, 5, 14, 0, 0, 0, 0, time.Local), true},
+		{"", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			got, ok := ParseDate(tt.date)
+			if ok != tt.ok || !got.Equal(tt.want) {
+				t.Errorf("got %v %v, want %v %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}